@@ -1,40 +1,475 @@
 package client
 
 import (
-	log "github.com/sirupsen/logrus"
+	"bufio"
 	"cs-425-mp4/server"
-	"io/ioutil"
-	"math/rand"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
-// Function that will try to dial the lowest number server possible
-func initClientRequest(requestType string, fileName string, mjRequest *server.MapleJuiceRequest) (server.ClientResponseArgs) {
-	for i := 1; i <= 10; i++ {
-		numStr := strconv.Itoa(i)
-		if len(numStr) == 1 {
-			numStr = "0" + numStr
-		}
+var ErrNoServer = server.ErrNoServer
+var ErrFileNotFound = errors.New("file not found in the sdfs")
+var ErrNoQuorum = server.ErrNoQuorum
+
+// Line written before every version of a file by get-versions
+var VERSION_MARKER string = "===== version %d =====\n"
 
-		connectName := "fa19-cs425-g84-" + numStr + ".cs.illinois.edu"
+// Function that will try to dial the servers in the order they are listed in the cluster config
+func initClientRequest(requestType string, fileName string, mjRequest *server.MapleJuiceRequest) (server.ClientResponseArgs, error) {
+	fileName = server.CleanPath(fileName)
+	for _, connectName := range server.Config.NodeIDs() {
 		if mjRequest != nil {
-			server.CallMapleJuiceRPC(connectName, requestType, mjRequest)
-			return server.ClientResponseArgs{}
+			if response, success := server.CallMapleJuiceRPC(connectName, requestType, mjRequest); success {
+				return response, nil
+			}
+			continue
 		}
 
 		response, success := server.CallFileSystemRPC(connectName, requestType, fileName)
 		if success {
 			log.Infof("Connected to server %s and recieved a response", connectName)
-			return response
+			return response, nil
 		}
 	}
 
-	log.Fatal("Could not connect to any server!")
-	return server.ClientResponseArgs{}
+	return server.ClientResponseArgs{}, ErrNoServer
+}
+
+// Uploads the file at localPath to the sdfs under sdfsName. The file is streamed to the replicas
+// in chunks, so it is never loaded into memory as a whole. Files larger than BLOCK_SIZE are split
+// into blocks, and every block is stored on its own replicas. Puts of the same file are made one
+// at a time, a put that fails gives the file up for the next one
+func Put(localPath string, sdfsName string) (err error) {
+	sdfsName = server.CleanPath(sdfsName)
+	if !server.ValidFileName(sdfsName) {
+		return server.ErrInvalidName
+	}
+
+	checksum, size, err := server.FileChecksumAt(localPath)
+	if err != nil {
+		return err
+	}
+	blocks, err := server.SplitBlocks(localPath)
+	if err != nil {
+		return err
+	}
+
+	response, _, err := server.ReserveVersion(server.Config.NodeIDs(), "ClientRequest.Put", sdfsName, server.NewUploadID())
+	if err != nil {
+		return err
+	}
+	version := response.File.Version
+	metadata := &server.FileMetadata{Name: sdfsName, Version: version, Size: size, Checksum: checksum}
+	defer func() {
+		if err != nil {
+			server.AbortPut(server.Config.NodeIDs(), metadata)
+		}
+	}()
+
+	if len(blocks) > 1 {
+		blockFiles, err := putBlocks(localPath, sdfsName, version, blocks)
+		if err != nil {
+			return err
+		}
+
+		for _, blockFile := range blockFiles {
+			metadata.Blocks = append(metadata.Blocks, blockFile.Name)
+		}
+		return commitPut(&server.CommitPutArgs{File: metadata, Blocks: blockFiles})
+	}
+
+	log.Infof("Putting version %d of the file to %s", version, response.HostList)
+	metadata.Replicas, err = server.StoreReplicas(response.HostList, sdfsName, version, func(hostname string) bool {
+		return server.StreamVersion(hostname, localPath, sdfsName, version, checksum, response.HostList)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The put is only visible once it is in the metadata directory
+	return commitPut(&server.CommitPutArgs{File: metadata})
+}
+
+// Appends the file at localPath to sdfsName, which is created if it does not exist. Appends of the
+// same file are applied one after another, and readers see all of an append or none of it
+func Append(localPath string, sdfsName string) error {
+	sdfsName = server.CleanPath(sdfsName)
+	if !server.ValidFileName(sdfsName) {
+		return server.ErrInvalidName
+	}
+
+	return server.AppendFile(server.Config.NodeIDs(), localPath, sdfsName, "")
+}
+
+// Stores every block of a put on the servers it is placed on. Returns the entries of the blocks
+// for the metadata directory
+func putBlocks(localPath string, sdfsName string, version int, blocks []server.FileBlock) ([]*server.FileMetadata, error) {
+	blockFiles := []*server.FileMetadata{}
+	for i, block := range blocks {
+		blockName := server.BlockName(sdfsName, i)
+		response, err := initClientRequest("ClientRequest.PlaceBlock", blockName, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Infof("Putting block %d of %d of version %d of the file to %s", i+1, len(blocks), version, response.HostList)
+		storedList, err := server.StoreReplicas(response.HostList, blockName, version, func(hostname string) bool {
+			return server.StreamBlock(hostname, localPath, block, blockName, version, response.HostList)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		blockFiles = append(blockFiles, &server.FileMetadata{
+			Name:     blockName,
+			Replicas: storedList,
+			Version:  version,
+			Size:     block.Size,
+			Checksum: block.Checksum,
+		})
+	}
+
+	return blockFiles, nil
+}
+
+// Adds a stored put to the metadata directory through the first server that answers
+func commitPut(request *server.CommitPutArgs) error {
+	metadata := request.File
+	for _, connectName := range server.Config.NodeIDs() {
+		response, success := server.CallCommitPutRPC(connectName, request)
+		if success && response.Error != "" {
+			return response.Err()
+		}
+		if success && !response.Success {
+			return server.ErrStaleVersion
+		}
+		if success {
+			log.Infof("Stored version %d of file %s on %s", metadata.Version, metadata.Name, response.HostList)
+			return nil
+		}
+	}
+
+	return ErrNoServer
+}
+
+// Downloads the newest version of sdfsName and writes it to localPath. READ_QUORUM replicas are
+// asked which versions they store, and the newest of those is downloaded. A version that is split
+// into blocks is downloaded one block at a time
+func Get(sdfsName string, localPath string) error {
+	response, err := initClientRequest("ClientRequest.Get", sdfsName, nil)
+	if err != nil {
+		return err
+	}
+
+	if !response.Success {
+		return ErrFileNotFound
+	}
+
+	if len(response.File.Blocks) != 0 {
+		fileVersion, _ := response.File.FindVersion(response.File.Version)
+		return fetchBlocks(response.Blocks, sdfsName, fileVersion, localPath)
+	}
+
+	return getQuorum(response.File, localPath)
+}
+
+// Compares the versions stored on READ_QUORUM replicas of a file, tried in a random order, and
+// downloads the newest one that is kept in the metadata directory to localPath from the replicas
+// that have it. A download that does not match the checksum of its version is started over from
+// the next replica
+func getQuorum(metadata *server.FileMetadata, localPath string) error {
+	request := &server.FileTransferRequest{FileName: metadata.Name}
+	readQuorum := server.Quorum(server.READ_QUORUM, len(metadata.Replicas))
+
+	answered := 0
+	newest := server.FileVersion{}
+	newestHosts := []string{}
+	for _, hostname := range server.RandomOrder(metadata.Replicas) {
+		if answered == readQuorum {
+			break
+		}
+
+		storedVersions, success := server.CallStoredVersionsRPC(hostname, request)
+		if !success {
+			continue
+		}
+
+		answered++
+		for _, version := range storedVersions {
+			fileVersion, kept := metadata.FindVersion(version)
+			if !kept || fileVersion.Version < newest.Version {
+				continue
+			}
+
+			if fileVersion.Version > newest.Version {
+				newest = fileVersion
+				newestHosts = []string{}
+			}
+			newestHosts = append(newestHosts, hostname)
+			break
+		}
+	}
+
+	if answered < readQuorum {
+		log.Infof("Only %d of %d replicas of file %s answered", answered, len(metadata.Replicas), metadata.Name)
+		return ErrNoQuorum
+	}
+
+	if len(newestHosts) == 0 {
+		return ErrFileNotFound
+	}
+
+	// The other replicas are tried last, in case the copies of the replicas that answered are corrupt
+	hostList := newestHosts
+	for _, hostname := range server.RandomOrder(metadata.Replicas) {
+		if !containsHost(hostList, hostname) {
+			hostList = append(hostList, hostname)
+		}
+	}
+	if !server.FetchVersion(hostList, metadata.Name, newest, localPath) {
+		return ErrFileNotFound
+	}
+
+	log.Infof("Got version %d of file %s", newest.Version, metadata.Name)
+	return nil
+}
+
+// Downloads the newest numVersions versions of sdfsName and writes them to localPath, newest
+// first. Each version starts with a line that marks which version it is
+func GetVersions(sdfsName string, numVersions int, localPath string) error {
+	metadata, blocks, err := StatBlocks(sdfsName)
+	if err != nil {
+		return err
+	}
+
+	versions := metadata.Versions
+	if numVersions < len(versions) {
+		versions = versions[:numVersions]
+	}
+
+	outputFile, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	// Every version is downloaded on its own from READ_QUORUM of the replicas it was stored on,
+	// then copied behind its marker
+	versionPath := localPath + ".version"
+	defer os.Remove(versionPath)
+	for _, fileVersion := range versions {
+		if len(fileVersion.Blocks) != 0 {
+			err = fetchBlocks(blocks, sdfsName, fileVersion, versionPath)
+		} else {
+			err = fetchVersion(sdfsName, fileVersion, versionPath)
+		}
+		if err != nil {
+			return err
+		}
+
+		versionFile, err := os.Open(versionPath)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(outputFile, VERSION_MARKER, fileVersion.Version)
+		_, err = io.Copy(outputFile, versionFile)
+		versionFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return outputFile.Close()
+}
+
+// Downloads a version of a file that is not split into blocks from READ_QUORUM of its replicas
+func fetchVersion(sdfsName string, fileVersion server.FileVersion, localPath string) error {
+	hostList, err := server.ReadQuorum(sdfsName, fileVersion.Version, fileVersion.Replicas)
+	if err != nil {
+		return err
+	}
+	if !server.FetchVersion(hostList, sdfsName, fileVersion, localPath) {
+		return ErrFileNotFound
+	}
+
+	return nil
+}
+
+// Downloads a version of a file that is split into blocks from READ_QUORUM of the replicas of
+// every block
+func fetchBlocks(blocks []server.FileMetadata, sdfsName string, fileVersion server.FileVersion, localPath string) error {
+	err := server.FetchBlocks(blocks, sdfsName, fileVersion, localPath)
+	if err == server.ErrFetchFailed {
+		return ErrFileNotFound
+	}
+
+	return err
+}
+
+func containsHost(hostList []string, hostname string) bool {
+	for _, listHost := range hostList {
+		if listHost == hostname {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Deletes sdfsName from every replica
+func Delete(sdfsName string) error {
+	response, err := initClientRequest("ClientRequest.Delete", sdfsName, nil)
+	if err == nil {
+		err = response.Err()
+	}
+	if err != nil {
+		return err
+	}
+
+	if !response.Success {
+		return ErrFileNotFound
+	}
+
+	return nil
+}
+
+// Returns the servers that store sdfsName
+func List(sdfsName string) ([]string, error) {
+	response, err := initClientRequest("ClientRequest.List", sdfsName, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if !response.Success {
+		return nil, ErrFileNotFound
+	}
+
+	return response.HostList, nil
+}
+
+// Returns the entry of sdfsName in the metadata directory
+func Stat(sdfsName string) (*server.FileMetadata, error) {
+	metadata, _, err := StatBlocks(sdfsName)
+	return metadata, err
+}
+
+// Returns the entry of sdfsName in the metadata directory and the entries of the blocks of its
+// kept versions
+func StatBlocks(sdfsName string) (*server.FileMetadata, []server.FileMetadata, error) {
+	response, err := initClientRequest("ClientRequest.List", sdfsName, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !response.Success || response.File == nil {
+		return nil, nil, ErrFileNotFound
+	}
+
+	return response.File, response.Blocks, nil
+}
+
+// Returns the files and the directories in a directory of the sdfs, or in all of its
+// subdirectories if recursive is set. Directories end with a separator
+func ListDir(dirName string, recursive bool) ([]string, error) {
+	response, err := initClientRequest("ClientRequest.ListDirectory", dirName, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if !response.Success {
+		return nil, server.ErrPathNotFound
+	}
+
+	dirName = server.CleanPath(dirName)
+	entries := []string{}
+	for _, entry := range response.Entries {
+		name := strings.TrimPrefix(strings.TrimSuffix(entry, server.PATH_SEPARATOR), dirName)
+		name = strings.TrimPrefix(name, server.PATH_SEPARATOR)
+		if recursive || !strings.Contains(name, server.PATH_SEPARATOR) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// Makes a directory in the sdfs and any of its parents that are missing
+func MakeDir(dirName string) error {
+	response, err := initClientRequest("ClientRequest.MakeDir", dirName, nil)
+	if err != nil {
+		return err
+	}
+
+	return response.Err()
+}
+
+// Removes an empty directory from the sdfs
+func RemoveDir(dirName string) error {
+	response, err := initClientRequest("ClientRequest.RemoveDir", dirName, nil)
+	if err != nil {
+		return err
+	}
+
+	if err = response.Err(); err != nil {
+		return err
+	}
+	if !response.Success {
+		return server.ErrPathNotFound
+	}
+
+	return nil
+}
+
+// Moves a file or a directory of the sdfs to a new path, or into a directory if the new path is
+// one. A file replaces the file at the new path if replace is set. Readers see every file under
+// either its old path or its new one, so a file can be written under a temporary name and then
+// published under its real one
+func Move(from string, to string, replace bool) error {
+	request := &server.MoveArgs{From: server.CleanPath(from), To: server.CleanPath(to), Replace: replace}
+	for _, connectName := range server.Config.NodeIDs() {
+		response, success := server.CallMoveRPC(connectName, request)
+		if !success {
+			continue
+		}
+
+		if err := response.Err(); err != nil {
+			return err
+		}
+		if !response.Success {
+			return server.ErrPathNotFound
+		}
+		return nil
+	}
+
+	return ErrNoServer
+}
+
+// Submits a maple or juice request to the cluster
+func SubmitMapleJuice(request *server.MapleJuiceRequest) error {
+	response, err := initClientRequest("ClientRequest."+request.Command, "", request)
+	if err != nil {
+		return err
+	}
+
+	return response.Err()
 }
 
 func ClientPut(args []string) {
+	force := false
+	if len(args) > 1 && args[0] == "-f" {
+		force = true
+		args = args[1:]
+	} else if len(args) == 3 {
+		log.Fatalf("Unknown option %s! Usage: put [-f] localFileName sdfsFileName", args[0])
+	}
+
 	var fileName string
 	if len(args) == 1 {
 		fileName = args[0]
@@ -42,82 +477,198 @@ func ClientPut(args []string) {
 		fileName = args[1]
 	}
 
-	response := initClientRequest("ClientRequest.Put", fileName, nil)
-	log.Infof("Putting file to %s", response.HostList)
+	if !force && !confirmOverwrite(fileName) {
+		log.Infof("Put of file %s cancelled", fileName)
+		return
+	}
+
+	err := Put(filepath.Join(server.LOCAL_FOLDER_NAME, args[0]), fileName)
+	if err == ErrNoQuorum {
+		log.Fatalf("File %s was stored on fewer than %d replicas and was not put!", fileName, server.WRITE_QUORUM)
+	} else if err != nil {
+		log.Fatalf("Unable to put file %s! %s", fileName, err)
+	}
+}
+
+// Returns how long ago sdfsName was updated if that was less than CONFLICT_WINDOW ago, since a put
+// would then likely overwrite a write the user has not seen. The server decides, by its own clock
+func RecentlyUpdated(sdfsName string) (time.Duration, bool) {
+	response, err := initClientRequest("ClientRequest.List", sdfsName, nil)
+	if err != nil || !response.Success || !response.Recent {
+		return 0, false
+	}
 
-	filePath := server.LOCAL_FOLDER_NAME + "/" + args[0]
-	fileContents, _ := ioutil.ReadFile(filePath)
+	return response.Age, true
+}
 
-	request := &server.FileTransferRequest{
-		FileName:  fileName,
-		FileGroup: response.HostList,
-		Data:      fileContents,
+// Asks the user on stdin whether to overwrite a file that was updated a moment ago. Returns true
+// if the file was not updated recently
+func confirmOverwrite(sdfsName string) bool {
+	age, recent := RecentlyUpdated(sdfsName)
+	if !recent {
+		return true
 	}
 
-	for i := 0; i < len(response.HostList); i++ {
-		server.CallFileTransferRPC(response.HostList[i], "FileTransfer.SendFile", request)
+	fmt.Printf("File %s was updated %s ago, overwrite it? [y/N] ", sdfsName, age.Round(time.Second))
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func ClientAppend(args []string) {
+	fileName := args[0]
+	err := Append(filepath.Join(server.LOCAL_FOLDER_NAME, args[1]), fileName)
+
+	if err == nil {
+		log.Infof("Appended %s to file %s!", args[1], fileName)
+	} else if err == ErrNoQuorum {
+		log.Fatalf("The append was stored on fewer than %d replicas and was not added to file %s!", server.WRITE_QUORUM, fileName)
+	} else {
+		log.Fatalf("Unable to append to file %s! %s", fileName, err)
 	}
 }
 
 func ClientGet(args []string) {
 	fileName := args[0]
-	response := initClientRequest("ClientRequest.Get", fileName, nil)
+	err := Get(fileName, filepath.Join(server.LOCAL_FOLDER_NAME, args[1]))
 
-	if !response.Success {
+	if err == ErrFileNotFound {
 		log.Infof("File %s not found in the sdfs!", fileName)
-		return
+	} else if err != nil {
+		log.Fatalf("Unable to get file %s! %s", fileName, err)
 	}
+}
 
-	rand.Seed(time.Now().UnixNano())
-	requestServer := response.HostList[rand.Intn(len(response.HostList))]
-	request := &server.FileTransferRequest{
-		FileName:  fileName,
-		FileGroup: nil,
-		Data:      nil,
+func ClientGetVersions(args []string) {
+	fileName := args[0]
+	numVersions, err := strconv.Atoi(args[1])
+	if err != nil || numVersions < 1 {
+		log.Fatalf("Number of versions %s is not a positive number!", args[1])
 	}
-	transferResponse := server.CallFileTransferRPC(requestServer, "FileTransfer.GetFile", request)
 
-	filePath := server.LOCAL_FOLDER_NAME + "/" + args[1]
-	err := ioutil.WriteFile(filePath, transferResponse, 0666)
-	if err != nil {
-		log.Fatalf("Unable to write bytes from get!", err)
+	err = GetVersions(fileName, numVersions, filepath.Join(server.LOCAL_FOLDER_NAME, args[2]))
+	if err == ErrFileNotFound {
+		log.Infof("File %s not found in the sdfs!", fileName)
+	} else if err != nil {
+		log.Fatalf("Unable to get the versions of file %s! %s", fileName, err)
 	}
 }
 
 func ClientDel(args []string) {
 	fileName := args[0]
-	response := initClientRequest("ClientRequest.Delete", fileName, nil)
+	err := Delete(fileName)
 
-	if response.Success {
+	if err == nil {
 		log.Infof("File %s deleted from the sdfs!", fileName)
-	} else {
+	} else if err == ErrFileNotFound {
 		log.Infof("File %s not found in the sdfs!", fileName)
+	} else {
+		log.Fatal(err)
 	}
 }
 
 func ClientLs(args []string) {
-	fileName := args[0]
-	response := initClientRequest("ClientRequest.List", fileName, nil)
+	if len(args) == 2 && args[0] == "-r" {
+		clientLsDir(args[1], true)
+		return
+	} else if len(args) == 2 {
+		log.Fatalf("Unknown option %s!", args[0])
+	}
+
+	fileName := server.CleanPath(args[0])
+	metadata, blocks, err := StatBlocks(fileName)
+	if err == ErrFileNotFound {
+		clientLsDir(fileName, false)
+		return
+	}
 
-	if response.Success {
-		log.Infof("File %s is stored at:\n%s", fileName, response.HostList)
+	if err == nil && len(metadata.Blocks) != 0 {
+		log.Infof("File %s (version %d, %d bytes, sha256 %s) is split into %d blocks:",
+			fileName, metadata.Version, metadata.Size, metadata.Checksum, len(metadata.Blocks))
+		for _, block := range blocks {
+			if block.Version == metadata.Version {
+				log.Infof("Block %s (%d bytes) is stored at:\n%s", block.Name, block.Size, block.Replicas)
+			}
+		}
+	} else if err == nil {
+		log.Infof("File %s (version %d, %d bytes, sha256 %s) is stored at:\n%s",
+			fileName, metadata.Version, metadata.Size, metadata.Checksum, metadata.Replicas)
 	} else {
-		log.Infof("File %s not found in the sdfs!", fileName)
+		log.Fatal(err)
+	}
+}
+
+func clientLsDir(dirName string, recursive bool) {
+	entries, err := ListDir(dirName, recursive)
+	if err == server.ErrPathNotFound {
+		log.Infof("Path %s not found in the sdfs!", dirName)
+	} else if err != nil {
+		log.Fatal(err)
+	} else {
+		log.Infof("Directory /%s contains %d entries:\n%s", server.CleanPath(dirName), len(entries), strings.Join(entries, "\n"))
+	}
+}
+
+func ClientMkdir(args []string) {
+	dirName := args[0]
+	err := MakeDir(dirName)
+
+	if err == nil {
+		log.Infof("Directory %s made in the sdfs!", dirName)
+	} else {
+		log.Fatalf("Unable to make directory %s! %s", dirName, err)
+	}
+}
+
+func ClientRmdir(args []string) {
+	dirName := args[0]
+	err := RemoveDir(dirName)
+
+	if err == nil {
+		log.Infof("Directory %s removed from the sdfs!", dirName)
+	} else if err == server.ErrPathNotFound {
+		log.Infof("Directory %s not found in the sdfs!", dirName)
+	} else {
+		log.Fatalf("Unable to remove directory %s! %s", dirName, err)
+	}
+}
+
+func ClientMv(args []string) {
+	replace := false
+	if len(args) == 3 && args[0] == "-f" {
+		replace = true
+		args = args[1:]
+	} else if len(args) == 3 {
+		log.Fatalf("Unknown option %s!", args[0])
+	}
+
+	err := Move(args[0], args[1], replace)
+	if err == nil {
+		log.Infof("Moved %s to %s in the sdfs!", args[0], args[1])
+	} else if err == server.ErrPathNotFound {
+		log.Infof("Path %s not found in the sdfs!", args[0])
+	} else if err == server.ErrFileExists {
+		log.Fatalf("Unable to move %s to %s, it already exists! Use mv -f to replace it", args[0], args[1])
+	} else {
+		log.Fatalf("Unable to move %s to %s! %s", args[0], args[1], err)
 	}
 }
 
 func ClientMaple(args []string) {
 	numMaples, _ := strconv.Atoi(args[1])
 	request := &server.MapleJuiceRequest{
-		Command: "Maple",
-		ExeName: args[0],
-		ProcessCount: numMaples,
-		FilePrefix: args[2],
+		Command:       "Maple",
+		ExeName:       args[0],
+		ProcessCount:  numMaples,
+		FilePrefix:    args[2],
 		FileDirectory: args[3],
-		DeleteInput: false,
+		DeleteInput:   false,
 	}
 
-	initClientRequest("ClientRequest.Maple", "", request)
+	err := SubmitMapleJuice(request)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 func ClientJuice(args []string) {
@@ -130,13 +681,16 @@ func ClientJuice(args []string) {
 	}
 
 	request := &server.MapleJuiceRequest{
-		Command: "Juice",
-		ExeName: args[0],
-		ProcessCount: numMaples,
-		FilePrefix: args[2],
+		Command:       "Juice",
+		ExeName:       args[0],
+		ProcessCount:  numMaples,
+		FilePrefix:    args[2],
 		FileDirectory: args[3],
-		DeleteInput: bool(deleteArg),
+		DeleteInput:   bool(deleteArg),
 	}
 
-	initClientRequest("ClientRequest.Juice", "", request)
+	err := SubmitMapleJuice(request)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
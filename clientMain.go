@@ -2,30 +2,50 @@ package main
 
 import (
 	"cs-425-mp4/client"
+	"cs-425-mp4/server"
+	"flag"
 	log "github.com/sirupsen/logrus"
 	"os"
 )
 
 func parseArgs() (string, []string) {
-	if len(os.Args) < 3 {
+	configPath := flag.String("config", os.Getenv("SDFS_CONFIG"), "path to the cluster config file")
+	flag.Parse()
+
+	_, err := server.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Could not load cluster config! %s", err)
+	}
+
+	if flag.NArg() < 2 {
 		log.Fatal("User did not specify enough arguments")
 	}
-	command := os.Args[1]
-	args := os.Args[2:]
+	command := flag.Arg(0)
+	args := flag.Args()[1:]
 
 	return command, args
 }
 
 func main() {
 	command, args := parseArgs()
-	if command == "put" && (len(args) == 2 || len(args) == 1) {
+	if command == "put" && len(args) >= 1 && len(args) <= 3 {
 		client.ClientPut(args)
+	} else if command == "append" && len(args) == 2 {
+		client.ClientAppend(args)
 	} else if command == "get" && len(args) == 2 {
 		client.ClientGet(args)
+	} else if command == "get-versions" && len(args) == 3 {
+		client.ClientGetVersions(args)
 	} else if command == "delete" && len(args) == 1 {
 		client.ClientDel(args)
-	} else if command == "ls" && len(args) == 1 {
+	} else if command == "ls" && (len(args) == 1 || len(args) == 2) {
 		client.ClientLs(args)
+	} else if command == "mkdir" && len(args) == 1 {
+		client.ClientMkdir(args)
+	} else if command == "rmdir" && len(args) == 1 {
+		client.ClientRmdir(args)
+	} else if command == "mv" && (len(args) == 2 || len(args) == 3) {
+		client.ClientMv(args)
 	} else if command == "maple" && len(args) == 4 {
 		client.ClientMaple(args)
 	} else if command == "juice" && len(args) == 5 {
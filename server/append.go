@@ -0,0 +1,348 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// Number of times an append is started over because another put or append of the file was
+// committed first, and the longest time it waits before it starts over
+var APPEND_RETRIES int = 10
+var APPEND_RETRY_INTERVAL time.Duration = 200 * time.Millisecond
+
+var ErrMissingBase = errors.New("the server does not store the version the append is written on")
+var ErrAppendConflict = errors.New("the file kept changing while the append was written")
+
+// Appends the file at localPath to an sdfs file through the first of the servers that answers.
+// Every append is stored as a new version that is the newest version with the data added, and it
+// is only committed if no other put or append of the file was committed in between, so appends
+// are applied in one order on every replica and readers see all of an append or none of it. An
+// append that lost the race is started over on top of the new newest version. A file that does
+// not exist is created. appendID makes the append happen at most once, even if it is retried
+// after it was committed, and a new one is made up if it is empty
+func AppendFile(servers []string, localPath string, fileName string, appendID string) error {
+	if appendID == "" {
+		appendID = newTransferID()
+	}
+
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+
+	for attempt := 0; attempt <= APPEND_RETRIES; attempt++ {
+		if attempt != 0 {
+			time.Sleep(time.Duration(rand.Int63n(int64(APPEND_RETRY_INTERVAL))))
+		}
+
+		err = appendVersion(servers, localPath, fileName, appendID)
+		if err != ErrStaleVersion {
+			return err
+		}
+		log.Infof("File %s was changed while the append was written, starting over", fileName)
+	}
+
+	return ErrAppendConflict
+}
+
+// Makes one attempt at an append. Returns ErrStaleVersion if another write of the file was
+// committed first. An attempt that failed gives up its version, so other writes of the file do not
+// wait for it
+func appendVersion(servers []string, localPath string, fileName string, appendID string) (err error) {
+	response, hostname, err := ReserveVersion(servers, "ClientRequest.Append", fileName, NewUploadID())
+	if err != nil {
+		return err
+	}
+
+	checksum, size, err := FileChecksumAt(localPath)
+	if err != nil {
+		return err
+	}
+
+	base := response.Base
+	version := response.File.Version
+	metadata := &FileMetadata{Name: fileName, Version: version, Size: base.Size + size}
+	request := &CommitPutArgs{File: metadata, Append: true, Base: base.Version, ID: appendID}
+	defer func() {
+		if err != nil {
+			AbortPut(append([]string{hostname}, servers...), metadata)
+		}
+	}()
+
+	if len(base.Blocks) != 0 {
+		request.Blocks, err = appendBlocks(hostname, response, localPath, version)
+		if err != nil {
+			return err
+		}
+
+		// The checksum of the whole version is not known, every block is checked on its own
+		for _, block := range request.Blocks {
+			metadata.Blocks = append(metadata.Blocks, block.Name)
+		}
+		metadata.Replicas = response.File.Replicas
+	} else if base.Version == 0 {
+		metadata.Checksum = checksum
+		metadata.Replicas, err = StoreReplicas(response.HostList, fileName, version, func(member string) bool {
+			return StreamVersion(member, localPath, fileName, version, checksum, response.HostList)
+		})
+	} else {
+		var file *os.File
+		file, err = os.Open(localPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		section := io.NewSectionReader(file, 0, size)
+		metadata.Replicas, metadata.Checksum, err = extendReplicas(response.HostList, section, checksum, fileName, base, version)
+	}
+	if err != nil {
+		return err
+	}
+
+	return sendCommitAppend(append([]string{hostname}, servers...), request)
+}
+
+// Adds the data of an append to a file that is split into blocks. The blocks of the base version
+// are linked as the new version on their replicas. The last block is filled up to BLOCK_SIZE with
+// the first lines of the data, and the rest is stored as new blocks after it. Returns the entries
+// of the blocks of the new version
+func appendBlocks(hostname string, response ClientResponseArgs, localPath string, version int) ([]*FileMetadata, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	blockFiles := []*FileMetadata{}
+	filled := int64(0)
+	for i, blockName := range response.Base.Blocks {
+		block, found := findBlockVersion(response.Blocks, blockName, response.Base.Version)
+		if !found {
+			log.Infof("Block %s of version %d is not in the metadata directory!", blockName, response.Base.Version)
+			return nil, ErrStaleVersion
+		}
+
+		// Blocks before the last one are only linked
+		fill := int64(0)
+		if i == len(response.Base.Blocks)-1 && block.Size < BLOCK_SIZE {
+			fill = info.Size()
+			if fill > BLOCK_SIZE-block.Size {
+				fill, err = lineBoundary(file, 0, BLOCK_SIZE-block.Size)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		hash := sha256.New()
+		_, err = io.CopyBuffer(hash, io.NewSectionReader(file, 0, fill), make([]byte, CHUNK_SIZE))
+		if err != nil {
+			return nil, err
+		}
+
+		replicas, checksum, err := extendReplicas(block.Replicas, io.NewSectionReader(file, 0, fill), hex.EncodeToString(hash.Sum(nil)), blockName, block, version)
+		if err != nil {
+			return nil, err
+		}
+		blockFiles = append(blockFiles, &FileMetadata{Name: blockName, Replicas: replicas, Version: version, Size: block.Size + fill, Checksum: checksum})
+		filled = fill
+	}
+
+	blocks, err := splitBlocksFrom(localPath, filled)
+	if err != nil {
+		return nil, err
+	}
+	for i, block := range blocks {
+		blockName := BlockName(response.File.Name, len(response.Base.Blocks)+i)
+		placement, success := CallFileSystemRPC(hostname, "ClientRequest.PlaceBlock", blockName)
+		if !success {
+			return nil, ErrNoServer
+		}
+
+		replicas, err := StoreReplicas(placement.HostList, blockName, version, func(member string) bool {
+			return StreamBlock(member, localPath, block, blockName, version, placement.HostList)
+		})
+		if err != nil {
+			return nil, err
+		}
+		blockFiles = append(blockFiles, &FileMetadata{Name: blockName, Replicas: replicas, Version: version, Size: block.Size, Checksum: block.Checksum})
+	}
+
+	return blockFiles, nil
+}
+
+// Sends the data of an append to the replicas of a file, which store their copy of the base version
+// with the data added as the new version. Returns the replicas that stored it and its checksum.
+// Every replica checks its base against the checksum of the base, so they all store the same bytes
+func extendReplicas(hostList []string, section *io.SectionReader, checksum string, fileName string, base FileVersion, version int) ([]string, string, error) {
+	checksums := map[string]string{}
+	var checksumMutex sync.Mutex
+	storedList, err := StoreReplicas(hostList, fileName, version, func(member string) bool {
+		header := FileChunk{FileName: fileName, Version: version, FileGroup: hostList, Checksum: checksum, Base: &base}
+		response, success := sendSection(member, "FileTransfer.ExtendChunk", section, fileName, header)
+		if !success || response.Checksum == "" {
+			return false
+		}
+
+		checksumMutex.Lock()
+		checksums[member] = response.Checksum
+		checksumMutex.Unlock()
+		return true
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return storedList, checksums[storedList[0]], nil
+}
+
+// Adds an append to the metadata directory through the first server that answers. Fails with
+// ErrStaleVersion if another write of the file was committed after the base of the append
+func sendCommitAppend(servers []string, request *CommitPutArgs) error {
+	for _, hostname := range servers {
+		response, success := CallCommitPutRPC(hostname, request)
+		if !success {
+			continue
+		}
+
+		if err := response.Err(); err != nil {
+			return err
+		}
+		if !response.Success {
+			return ErrStaleVersion
+		}
+		log.Infof("Appended version %d of file %s on %s", request.File.Version, request.File.Name, response.HostList)
+		return nil
+	}
+
+	return ErrNoServer
+}
+
+// Adds an append to the metadata directory if the newest version of the file is still its base.
+// An append that was committed before under the same ID is not added again
+func (node *Node) commitAppend(request *CommitPutArgs) error {
+	command := RaftCommand{Type: RAFT_APPEND_FILE, ID: request.ID, File: request.File, Blocks: request.Blocks, Base: request.Base}
+	err := node.proposeCommand(command)
+	if err != nil {
+		log.Infof("Could not append version %d of file %s! %s", request.File.Version, request.File.Name, err)
+		return err
+	}
+
+	if err := node.Queues().checkFilePath(request.File.Name); err != nil {
+		return err
+	}
+	if !node.Queues().isFinished(request.ID) {
+		log.Infof("Version %d of file %s is not on top of version %d anymore!", request.File.Version, request.File.Name, request.Base)
+		return ErrStaleVersion
+	}
+
+	return nil
+}
+
+// Stores the data of an append that was received as a new version of a file, and returns the
+// checksum of the new version. The base is read once, and its checksum is checked on the way, so
+// a corrupt or missing base is never extended. An append without data links the base instead
+func (node *Node) extendVersion(fileName string, base *FileVersion, version int, fileGroup []string, dataPath string) (string, error) {
+	if base == nil || !node.LocalFiles.HasVersion(fileName, base.Version) {
+		return "", ErrMissingBase
+	}
+	basePath := node.versionPath(fileName, base.Version)
+	versionPath := node.versionPath(fileName, version)
+
+	dataInfo, err := os.Stat(dataPath)
+	if err != nil {
+		return "", err
+	}
+	if dataInfo.Size() == 0 && base.Checksum != "" {
+		os.Remove(versionPath)
+		err = os.Link(basePath, versionPath)
+		if err != nil {
+			return "", err
+		}
+
+		node.LocalFiles.StoreVersion(fileName, version, fileGroup, node.mayBeAlive)
+		return base.Checksum, nil
+	}
+
+	tempPath := dataPath + ".extended"
+	tempFile, err := os.Create(tempPath)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tempPath)
+	defer tempFile.Close()
+
+	hash := sha256.New()
+	baseHash := sha256.New()
+	writer := io.MultiWriter(tempFile, hash)
+	for _, source := range []struct {
+		path   string
+		writer io.Writer
+	}{{basePath, io.MultiWriter(writer, baseHash)}, {dataPath, writer}} {
+		file, err := os.Open(source.path)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.CopyBuffer(source.writer, file, make([]byte, CHUNK_SIZE))
+		file.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if base.Checksum != "" && hex.EncodeToString(baseHash.Sum(nil)) != base.Checksum {
+		log.Infof("Version %d of file %s does not match its checksum, not appending to it", base.Version, fileName)
+		return "", ErrMissingBase
+	}
+
+	err = tempFile.Sync()
+	if err == nil {
+		err = tempFile.Close()
+	}
+	if err == nil {
+		err = os.Rename(tempPath, versionPath)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	node.LocalFiles.StoreVersion(fileName, version, fileGroup, node.mayBeAlive)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Reserves a version of a file for a put or an append through the first of the servers that
+// answers. Every server is sent the same uploadID, so the version is reserved once even if a
+// server that gave up on the reservation made it after all. Returns the response, the server that
+// answered and the error the request was refused with
+func ReserveVersion(servers []string, requestType string, fileName string, uploadID string) (ClientResponseArgs, string, error) {
+	request := &ReserveArgs{FileName: fileName, ID: uploadID}
+	for _, hostname := range servers {
+		response, success := CallReserveRPC(hostname, requestType, request)
+		if success {
+			return response, hostname, response.Err()
+		}
+	}
+
+	return ClientResponseArgs{}, "", ErrNoServer
+}
+
+// Returns a new ID for the reservation of a put or an append
+func NewUploadID() string {
+	return "upload[" + newTransferID() + "]"
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Helper that applies the commit of an append of a version on top of a base version
+func commitAppend(queues *RequestQueues, appendID string, version int, base int) *RequestQueues {
+	file := &FileMetadata{Name: "a.txt", Version: version, Replicas: []string{"n1"}}
+	return queues.apply(RaftCommand{Type: RAFT_APPEND_FILE, ID: appendID, Time: time.Now(), File: file, Base: base})
+}
+
+// An append is only committed on top of the version it was written on, so of two appends on the
+// same version the second one has to start over. Each append is committed once, even if it is
+// committed again after a retry
+func TestAppendConflict(t *testing.T) {
+	queues := commitAppend(&RequestQueues{}, "append1", 1, 0)
+	if queues.Files["a.txt"] == nil || !queues.isFinished("append1") {
+		t.Fatal("Append to a file that does not exist did not create it")
+	}
+	if next := commitAppend(&RequestQueues{}, "append1", 1, 3); next.Files["a.txt"] != nil {
+		t.Fatal("Append on top of a version of a file that does not exist was committed")
+	}
+
+	queues = commitAppend(queues, "append2", 2, 1)
+	lost := commitAppend(queues, "append3", 3, 1)
+	if lost.Files["a.txt"].Version != 2 || lost.isFinished("append3") {
+		t.Fatal("Append on top of a version that is not the newest anymore was committed")
+	}
+
+	retried := commitAppend(lost, "append3", 4, 2)
+	if retried.Files["a.txt"].Version != 4 || !retried.isFinished("append3") {
+		t.Fatal("Append that started over on the newest version was not committed")
+	}
+	if again := commitAppend(retried, "append3", 5, 4); again.Files["a.txt"].Version != 4 {
+		t.Fatal("Append that was already committed was committed again")
+	}
+}
+
+// The data of an append is added to the base version stored on the node. A base that is missing
+// or does not match its checksum is never extended
+func TestExtendVersion(t *testing.T) {
+	node, err := NewNode("127.0.0.1:25041", t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Kill()
+
+	storeLocalVersion(t, node, "a.txt", 1, []byte("one\n"))
+	base := &FileVersion{Version: 1, Checksum: FileChecksum([]byte("one\n"))}
+	dataPath := filepath.Join(t.TempDir(), "data")
+	ioutil.WriteFile(dataPath, []byte("two\n"), 0666)
+
+	checksum, err := node.extendVersion("a.txt", base, 2, []string{node.ID}, dataPath)
+	if err != nil || checksum != FileChecksum([]byte("one\ntwo\n")) {
+		t.Fatalf("Extended version has checksum %s %v, expected the checksum of both parts", checksum, err)
+	}
+	if content, _ := ioutil.ReadFile(node.versionPath("a.txt", 2)); string(content) != "one\ntwo\n" || !node.LocalFiles.HasVersion("a.txt", 2) {
+		t.Fatalf("Extended version is %q", content)
+	}
+
+	if _, err := node.extendVersion("a.txt", &FileVersion{Version: 5}, 6, nil, dataPath); err != ErrMissingBase {
+		t.Fatalf("Extending a version the node does not store returned %v", err)
+	}
+	ioutil.WriteFile(node.versionPath("a.txt", 1), []byte("corrupt"), 0666)
+	if _, err := node.extendVersion("a.txt", base, 3, nil, dataPath); err != ErrMissingBase {
+		t.Fatalf("Extending a corrupt version returned %v", err)
+	}
+	if node.LocalFiles.HasVersion("a.txt", 3) {
+		t.Fatal("Version on top of a corrupt base was stored")
+	}
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Files larger than BLOCK_SIZE are split into blocks of at most BLOCK_SIZE bytes. Every block is
+// stored as its own sdfs file, so the hash ring spreads the blocks of a file over the cluster
+var BLOCK_SIZE int64 = 64 << 20
+
+// Separates the name of a file from the number of its block. Names of files that are put can not
+// contain it
+var BLOCK_DELIMITER string = "#"
+
+// A block of a local file that is put. Blocks end after the last newline that fits, so every block
+// holds whole lines and maple can process the blocks of a file on their own
+type FileBlock struct {
+	Offset   int64
+	Size     int64
+	Checksum string
+}
+
+// Returns the name a block of a file is stored as
+func BlockName(fileName string, index int) string {
+	return fileName + BLOCK_DELIMITER + strconv.Itoa(index)
+}
+
+// Returns if a file is a block of another file
+func IsBlockName(fileName string) bool {
+	return strings.Contains(fileName, BLOCK_DELIMITER)
+}
+
+// Splits the file at localPath into blocks. A file that fits in one block is returned as a single
+// block
+func SplitBlocks(localPath string) ([]FileBlock, error) {
+	return splitBlocksFrom(localPath, 0)
+}
+
+// Splits the file at localPath into blocks, starting at the given offset. Nothing after the offset
+// is no blocks, unless the offset is 0, since an empty file is stored as one empty block
+func splitBlocksFrom(localPath string, start int64) ([]FileBlock, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := []FileBlock{}
+	for offset := start; offset < info.Size() || (len(blocks) == 0 && start == 0); {
+		size := info.Size() - offset
+		if size > BLOCK_SIZE {
+			size, err = lineBoundary(file, offset, BLOCK_SIZE)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		hash := sha256.New()
+		_, err = io.CopyBuffer(hash, io.NewSectionReader(file, offset, size), make([]byte, CHUNK_SIZE))
+		if err != nil {
+			return nil, err
+		}
+
+		blocks = append(blocks, FileBlock{Offset: offset, Size: size, Checksum: hex.EncodeToString(hash.Sum(nil))})
+		offset += size
+	}
+
+	return blocks, nil
+}
+
+// Returns the size of the block starting at offset, which ends after the last newline within size
+// bytes. A block without a newline is cut at size bytes
+func lineBoundary(file *os.File, offset int64, size int64) (int64, error) {
+	buffer := make([]byte, CHUNK_SIZE)
+	for end := size; end > 0; {
+		start := end - int64(len(buffer))
+		if start < 0 {
+			start = 0
+		}
+
+		readCount, err := file.ReadAt(buffer[:end-start], offset+start)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		if index := bytes.LastIndexByte(buffer[:readCount], '\n'); index != -1 {
+			return start + int64(index) + 1, nil
+		}
+		end = start
+	}
+
+	return size, nil
+}
+
+// Sends a block of the file at localPath to a server as a version of the block, and returns if the
+// server stored it
+func StreamBlock(hostname string, localPath string, block FileBlock, blockName string, version int, fileGroup []string) bool {
+	file, err := os.Open(localPath)
+	if err != nil {
+		log.Infof("Could not open %s to send it! %s", localPath, err)
+		return false
+	}
+	defer file.Close()
+
+	header := FileChunk{FileName: blockName, Version: version, FileGroup: fileGroup, Checksum: block.Checksum}
+	return streamSection(hostname, "FileTransfer.SendChunk", io.NewSectionReader(file, block.Offset, block.Size), blockName, header)
+}
+
+// Downloads a version of a file that is split into blocks to localPath. Every block is read from
+// READ_QUORUM of its replicas, and checked against its checksum, and the whole file against the
+// checksum of the version. The blocks are the entries of the blocks of the file in the metadata
+// directory. Returns ErrNoQuorum if too few replicas of a block answered, or ErrFetchFailed if the
+// version could not be downloaded
+func FetchBlocks(blocks []FileMetadata, fileName string, fileVersion FileVersion, localPath string) error {
+	tempPath := localPath + ".blocks"
+	tempFile, err := os.Create(tempPath)
+	if err != nil {
+		log.Infof("Could not create %s! %s", localPath, err)
+		return err
+	}
+	defer os.Remove(tempPath)
+	defer tempFile.Close()
+
+	blockPath := localPath + ".block"
+	defer os.Remove(blockPath)
+
+	hash := sha256.New()
+	writer := io.MultiWriter(tempFile, hash)
+	for _, blockName := range fileVersion.Blocks {
+		blockVersion, found := findBlockVersion(blocks, blockName, fileVersion.Version)
+		if !found {
+			log.Infof("Block %s of version %d is not in the metadata directory!", blockName, fileVersion.Version)
+			return ErrFetchFailed
+		}
+
+		hostList, err := ReadQuorum(blockName, blockVersion.Version, blockVersion.Replicas)
+		if err != nil {
+			return err
+		}
+		if !FetchVersion(hostList, blockName, blockVersion, blockPath) {
+			return ErrFetchFailed
+		}
+
+		blockFile, err := os.Open(blockPath)
+		if err != nil {
+			log.Infof("Could not read block %s! %s", blockName, err)
+			return err
+		}
+		_, err = io.CopyBuffer(writer, blockFile, make([]byte, CHUNK_SIZE))
+		blockFile.Close()
+		if err != nil {
+			log.Infof("Could not write block %s to %s! %s", blockName, localPath, err)
+			return err
+		}
+	}
+
+	if checksum := hex.EncodeToString(hash.Sum(nil)); fileVersion.Checksum != "" && checksum != fileVersion.Checksum {
+		log.Infof("Version %d of file %s does not match its checksum!", fileVersion.Version, fileName)
+		return ErrFetchFailed
+	}
+
+	err = tempFile.Close()
+	if err == nil {
+		err = os.Rename(tempPath, localPath)
+	}
+	if err != nil {
+		log.Infof("Could not write %s! %s", localPath, err)
+		return err
+	}
+
+	return nil
+}
+
+// Finds a version of a block in the entries of the blocks of a file
+func findBlockVersion(blocks []FileMetadata, blockName string, version int) (FileVersion, bool) {
+	for _, block := range blocks {
+		if block.Name == blockName {
+			return block.FindVersion(version)
+		}
+	}
+
+	return FileVersion{}, false
+}
+
+// Returns the entries of the blocks of every kept version of a file
+func (queues *RequestQueues) fileBlocks(metadata *FileMetadata) []FileMetadata {
+	blocks := []FileMetadata{}
+	added := map[string]bool{}
+	for _, fileVersion := range metadata.Versions {
+		for _, blockName := range fileVersion.Blocks {
+			if block := queues.Files[blockName]; block != nil && !added[blockName] {
+				blocks = append(blocks, *block)
+				added[blockName] = true
+			}
+		}
+	}
+
+	return blocks
+}
+
+// Returns a copy of the metadata directory with the entry of a file replaced and the blocks of its
+// new version added. Versions of its blocks that are not part of a kept version of the file are
+// dropped, and blocks without any kept version are removed
+func (queues *RequestQueues) updateFileBlocks(metadata *FileMetadata, blocks []*FileMetadata) map[string]*FileMetadata {
+	next := queues.updateFiles(metadata.Name, metadata)
+	for _, block := range blocks {
+		if block != nil && block.Version == metadata.Version && containsMember(metadata.Blocks, block.Name) {
+			next[block.Name] = next[block.Name].addVersion(block)
+		}
+	}
+
+	prefix := metadata.Name + BLOCK_DELIMITER
+	for name, block := range next {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		kept := block.keepVersions(func(version int) bool {
+			fileVersion, kept := metadata.FindVersion(version)
+			return kept && containsMember(fileVersion.Blocks, name)
+		})
+		if kept == nil {
+			delete(next, name)
+		} else {
+			next[name] = kept
+		}
+	}
+
+	return next
+}
+
+// Returns a copy of the directory without a file and its blocks
+func (queues *RequestQueues) removeFile(fileName string) map[string]*FileMetadata {
+	next := queues.updateFiles(fileName, nil)
+	for name := range next {
+		if strings.HasPrefix(name, fileName+BLOCK_DELIMITER) {
+			delete(next, name)
+		}
+	}
+
+	return next
+}
+
+// Returns the metadata of a file and of the blocks of its kept versions as of the last command
+// this node applied, or false if the file is not in the sdfs
+func (node *Node) FileBlocks(fileName string) (FileMetadata, []FileMetadata, bool) {
+	queues := node.Queues()
+	metadata := queues.Files[fileName]
+	if metadata == nil {
+		return FileMetadata{}, nil, false
+	}
+
+	return *metadata, queues.fileBlocks(metadata), true
+}
+
+// Returns the files that have to be processed for a file. A file that is split into blocks is
+// processed one block at a time
+func (node *Node) fileTasks(fileName string) []string {
+	metadata, success := node.FileMetadata(fileName)
+	if !success || len(metadata.Blocks) == 0 {
+		return []string{fileName}
+	}
+
+	return metadata.Blocks
+}
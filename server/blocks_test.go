@@ -0,0 +1,109 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Helper that stores a version of a file on a node like a finished transfer does
+func storeLocalVersion(t *testing.T, node *Node, fileName string, version int, data []byte) {
+	err := ioutil.WriteFile(node.versionPath(fileName, version), data, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.LocalFiles.StoreVersion(fileName, version, []string{node.ID}, func(member string) bool { return true })
+}
+
+// Helper that returns the sections of the content the blocks cover
+func blockContents(content string, blocks []FileBlock) []string {
+	contents := []string{}
+	for _, block := range blocks {
+		contents = append(contents, content[block.Offset:block.Offset+block.Size])
+	}
+
+	return contents
+}
+
+// Blocks hold whole lines of at most BLOCK_SIZE bytes, and a line longer than a block is cut
+func TestSplitBlocks(t *testing.T) {
+	defer func(blockSize int64) { BLOCK_SIZE = blockSize }(BLOCK_SIZE)
+	BLOCK_SIZE = 16
+
+	content := "one\ntwo\nthree\nfour\nfive\n" + strings.Repeat("x", 20) + "\nsix"
+	localPath := filepath.Join(t.TempDir(), "a.txt")
+	ioutil.WriteFile(localPath, []byte(content), 0666)
+
+	blocks, err := SplitBlocks(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"one\ntwo\nthree\n", "four\nfive\n", strings.Repeat("x", 16), "xxxx\nsix"}
+	if contents := blockContents(content, blocks); strings.Join(contents, "|") != strings.Join(expected, "|") {
+		t.Fatalf("Split into %q, expected %q", contents, expected)
+	}
+	for i, block := range blocks {
+		if block.Checksum != FileChecksum([]byte(expected[i])) {
+			t.Fatalf("Block %d does not match its checksum", i)
+		}
+	}
+
+	// Splitting from an offset continues where the blocks before it end
+	rest, err := splitBlocksFrom(localPath, blocks[2].Offset)
+	if err != nil || len(rest) != 2 || rest[0] != blocks[2] || rest[1] != blocks[3] {
+		t.Fatalf("Split from block 2 into %+v, expected the last 2 blocks %v", rest, err)
+	}
+	if rest, _ := splitBlocksFrom(localPath, int64(len(content))); len(rest) != 0 {
+		t.Fatalf("Split the end of the file into %+v, expected no blocks", rest)
+	}
+
+	emptyPath := filepath.Join(t.TempDir(), "empty.txt")
+	ioutil.WriteFile(emptyPath, nil, 0666)
+	if blocks, _ := SplitBlocks(emptyPath); len(blocks) != 1 || blocks[0].Size != 0 {
+		t.Fatalf("Split an empty file into %+v, expected one empty block", blocks)
+	}
+}
+
+// The blocks of a version are downloaded from their replicas and put back together in order. A
+// version that does not match its checksum is not written
+func TestFetchBlocks(t *testing.T) {
+	nodes := newFileNodes(t, 25011, 25012)
+	replicas := []string{nodes[0].ID, nodes[1].ID}
+
+	contents := []string{"one\ntwo\n", "three\n", "four\n"}
+	blocks := []FileMetadata{}
+	fileVersion := FileVersion{Version: 2, Checksum: FileChecksum([]byte(strings.Join(contents, "")))}
+	for i, content := range contents {
+		blockName := BlockName("a.txt", i)
+		for _, node := range nodes {
+			storeLocalVersion(t, node, blockName, 2, []byte(content))
+		}
+		checksum := FileChecksum([]byte(content))
+		blockVersion := FileVersion{Version: 2, Size: int64(len(content)), Checksum: checksum, Replicas: replicas}
+		blocks = append(blocks, FileMetadata{Name: blockName, Version: 2, Checksum: checksum, Replicas: replicas, Versions: []FileVersion{blockVersion}})
+		fileVersion.Blocks = append(fileVersion.Blocks, blockName)
+	}
+
+	localPath := filepath.Join(t.TempDir(), "a.txt")
+	err := FetchBlocks(blocks, "a.txt", fileVersion, localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(localPath); string(content) != strings.Join(contents, "") {
+		t.Fatalf("Fetched %q, expected the blocks in order", content)
+	}
+
+	otherPath := filepath.Join(t.TempDir(), "other.txt")
+	fileVersion.Checksum = FileChecksum([]byte("other"))
+	if err := FetchBlocks(blocks, "a.txt", fileVersion, otherPath); err != ErrFetchFailed {
+		t.Fatalf("Fetching a version that does not match its checksum returned %v", err)
+	}
+	fileVersion.Blocks = append(fileVersion.Blocks, BlockName("a.txt", 3))
+	if err := FetchBlocks(blocks, "a.txt", fileVersion, otherPath); err != ErrFetchFailed {
+		t.Fatalf("Fetching a version with a missing block returned %v", err)
+	}
+	if _, err := ioutil.ReadFile(otherPath); err == nil {
+		t.Fatal("Version that could not be fetched was written")
+	}
+}
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var CONFIG_ENV_PREFIX string = "SDFS_"
+
+// Topology of the cluster. The introducers are the seed nodes that a new node writes its
+// membership list to when joining, and Nodes is every server a client or introducer may dial.
+// RaftPeers are the nodes that vote on the replicated log, the other nodes only follow it.
+// Nodes are identified by host:port, where port is the UDP port of the node. A node on a port
+// other than UDPPort shifts all of its RPC ports by the same amount, so several nodes can share a host.
+// WriteQuorum and ReadQuorum are the number of replicas a put has to reach and a get has to ask,
+// BlockSize is the size of the blocks large files are split into, and a put asks before it
+// overwrites a file that was updated less than ConflictWindow seconds ago. 0 keeps the defaults.
+type ClusterConfig struct {
+	Introducers []string
+	Nodes       []NodeConfig
+	RaftPeers   []string
+
+	WriteQuorum int
+	ReadQuorum  int
+	BlockSize   int64
+
+	ConflictWindow int
+
+	UDPPort           string
+	ClientRPCPort     string
+	ServerRPCPort     string
+	FileRPCPort       string
+	MapleJuiceRPCPort string
+	RaftRPCPort       string
+}
+
+// Per node settings. Host is the name other nodes use to reach the node and BindAddr is the
+// address its listeners bind to. An empty BindAddr listens on every interface. Port defaults
+// to UDPPort and DataDir, where the node keeps its files, defaults to the working directory.
+type NodeConfig struct {
+	Host     string
+	Port     string
+	BindAddr string
+	DataDir  string
+}
+
+// Number of nodes that vote on the replicated log when RaftPeers is not set
+var DEFAULT_RAFT_PEER_COUNT int = 5
+
+// Global config so the listeners and the RPC helpers can access it
+var Config *ClusterConfig = DefaultConfig()
+
+// The original course cluster, used when no config file or environment overrides are given
+func DefaultConfig() *ClusterConfig {
+	config := &ClusterConfig{
+		Introducers:       []string{"fa19-cs425-g84-01.cs.illinois.edu"},
+		UDPPort:           "4000",
+		ClientRPCPort:     "5000",
+		ServerRPCPort:     "6000",
+		FileRPCPort:       "7000",
+		MapleJuiceRPCPort: "8000",
+		RaftRPCPort:       "9000",
+	}
+
+	for i := 1; i <= 10; i++ {
+		numStr := strconv.Itoa(i)
+		if len(numStr) == 1 {
+			numStr = "0" + numStr
+		}
+
+		config.Nodes = append(config.Nodes, NodeConfig{Host: "fa19-cs425-g84-" + numStr + ".cs.illinois.edu"})
+	}
+
+	return config
+}
+
+// Loads the cluster config. Values are read from the JSON file at configPath if it is set,
+// then overridden by any SDFS_* environment variables. The result is applied to the globals.
+func LoadConfig(configPath string) (*ClusterConfig, error) {
+	config := DefaultConfig()
+
+	if configPath != "" {
+		fileContents, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(fileContents, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	applyEnvOverrides(config)
+	ApplyConfig(config)
+	return config, nil
+}
+
+// Environment variables take priority over the config file. Lists are comma separated.
+func applyEnvOverrides(config *ClusterConfig) {
+	if introducers := os.Getenv(CONFIG_ENV_PREFIX + "INTRODUCERS"); introducers != "" {
+		config.Introducers = splitList(introducers)
+	}
+
+	if raftPeers := os.Getenv(CONFIG_ENV_PREFIX + "RAFT_PEERS"); raftPeers != "" {
+		config.RaftPeers = splitList(raftPeers)
+	}
+
+	if nodes := os.Getenv(CONFIG_ENV_PREFIX + "NODES"); nodes != "" {
+		config.Nodes = []NodeConfig{}
+		for _, nodeID := range splitList(nodes) {
+			host, port, err := net.SplitHostPort(nodeID)
+			if err != nil {
+				host, port = nodeID, ""
+			}
+
+			config.Nodes = append(config.Nodes, NodeConfig{Host: host, Port: port})
+		}
+	}
+
+	envPorts := map[string]*string{
+		"UDP_PORT":            &config.UDPPort,
+		"CLIENT_RPC_PORT":     &config.ClientRPCPort,
+		"SERVER_RPC_PORT":     &config.ServerRPCPort,
+		"FILE_RPC_PORT":       &config.FileRPCPort,
+		"MAPLEJUICE_RPC_PORT": &config.MapleJuiceRPCPort,
+		"RAFT_RPC_PORT":       &config.RaftRPCPort,
+	}
+	for envName, port := range envPorts {
+		if value := os.Getenv(CONFIG_ENV_PREFIX + envName); value != "" {
+			*port = value
+		}
+	}
+
+	envQuorums := map[string]*int{
+		"WRITE_QUORUM": &config.WriteQuorum,
+		"READ_QUORUM":  &config.ReadQuorum,
+	}
+	for envName, quorum := range envQuorums {
+		if value, err := strconv.Atoi(os.Getenv(CONFIG_ENV_PREFIX + envName)); err == nil {
+			*quorum = value
+		}
+	}
+	if value, err := strconv.ParseInt(os.Getenv(CONFIG_ENV_PREFIX+"BLOCK_SIZE"), 10, 64); err == nil {
+		config.BlockSize = value
+	}
+	if value, err := strconv.Atoi(os.Getenv(CONFIG_ENV_PREFIX + "CONFLICT_WINDOW")); err == nil {
+		config.ConflictWindow = value
+	}
+}
+
+// Sets the global config and the port globals used by the listeners and RPC helpers
+func ApplyConfig(config *ClusterConfig) {
+	Config = config
+	UDP_PORT_NUM = config.UDPPort
+	CLIENT_RPC_PORT = config.ClientRPCPort
+	SERVER_RPC_PORT = config.ServerRPCPort
+	FILE_RPC_PORT = config.FileRPCPort
+	MAPLEJUICE_RPC_PORT = config.MapleJuiceRPCPort
+	if config.RaftRPCPort != "" {
+		RAFT_RPC_PORT = config.RaftRPCPort
+	}
+	if config.WriteQuorum > 0 {
+		WRITE_QUORUM = config.WriteQuorum
+	}
+	if config.ReadQuorum > 0 {
+		READ_QUORUM = config.ReadQuorum
+	}
+	if config.BlockSize > 0 {
+		BLOCK_SIZE = config.BlockSize
+	}
+	if config.ConflictWindow > 0 {
+		CONFLICT_WINDOW = time.Duration(config.ConflictWindow) * time.Second
+	}
+
+	for i, introducer := range config.Introducers {
+		config.Introducers[i] = NormalizeNodeID(introducer)
+	}
+	for i, raftPeer := range config.RaftPeers {
+		config.RaftPeers[i] = NormalizeNodeID(raftPeer)
+	}
+}
+
+// The host:port identity of the node
+func (node NodeConfig) ID() string {
+	port := node.Port
+	if port == "" {
+		port = UDP_PORT_NUM
+	}
+
+	return net.JoinHostPort(node.Host, port)
+}
+
+// Returns the IDs of all nodes in the cluster
+func (config *ClusterConfig) NodeIDs() []string {
+	nodeIDs := []string{}
+	for _, node := range config.Nodes {
+		nodeIDs = append(nodeIDs, node.ID())
+	}
+
+	return nodeIDs
+}
+
+// Returns the IDs of the nodes that vote on the replicated log. Defaults to the first
+// DEFAULT_RAFT_PEER_COUNT nodes of the cluster
+func (config *ClusterConfig) RaftPeerIDs() []string {
+	if len(config.RaftPeers) != 0 {
+		return config.RaftPeers
+	}
+
+	nodeIDs := config.NodeIDs()
+	if len(nodeIDs) > DEFAULT_RAFT_PEER_COUNT {
+		nodeIDs = nodeIDs[:DEFAULT_RAFT_PEER_COUNT]
+	}
+
+	return nodeIDs
+}
+
+// Checks if the node is one of the seed nodes
+func (config *ClusterConfig) IsIntroducer(nodeID string) bool {
+	for _, introducer := range config.Introducers {
+		if introducer == nodeID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the config of the node with the given ID, or a config with only the host and port set
+func (config *ClusterConfig) Node(nodeID string) NodeConfig {
+	for _, node := range config.Nodes {
+		if node.ID() == nodeID {
+			return node
+		}
+	}
+
+	host, port, _ := net.SplitHostPort(nodeID)
+	return NodeConfig{Host: host, Port: port}
+}
+
+// Adds the default UDP port to node IDs that are only a host name
+func NormalizeNodeID(nodeID string) string {
+	if _, _, err := net.SplitHostPort(nodeID); err == nil {
+		return nodeID
+	}
+
+	return net.JoinHostPort(nodeID, UDP_PORT_NUM)
+}
+
+// Address of the RPC service that listens on servicePort for the given node. The service port
+// is shifted by how far the node's UDP port is from the default UDP port.
+func rpcAddr(nodeID string, servicePort string) string {
+	host, port, err := net.SplitHostPort(nodeID)
+	if err != nil {
+		return net.JoinHostPort(nodeID, servicePort)
+	}
+
+	nodePort, _ := strconv.Atoi(port)
+	basePort, _ := strconv.Atoi(UDP_PORT_NUM)
+	rpcPort, _ := strconv.Atoi(servicePort)
+
+	return net.JoinHostPort(host, strconv.Itoa(rpcPort+nodePort-basePort))
+}
+
+// Helper that splits a comma separated list and drops empty entries
+func splitList(list string) []string {
+	values := []string{}
+	for _, value := range strings.Split(list, ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
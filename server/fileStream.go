@@ -0,0 +1,468 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"hash"
+	"io"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Files are sent in chunks of CHUNK_SIZE bytes, so only one chunk of a transfer is in memory at a
+// time no matter how large the file is
+var CHUNK_SIZE int = 1 << 20
+
+// Number of times a transfer is resumed after a chunk failed before it is given up, and how long
+// the sender waits before it resumes
+var TRANSFER_RETRIES int = 5
+var TRANSFER_RETRY_INTERVAL time.Duration = 500 * time.Millisecond
+
+// Folder the chunks of incoming transfers are written to until the last one arrives
+var TRANSFER_FOLDER_NAME string = "transfers"
+
+var ErrInvalidTransfer = errors.New("invalid transfer id")
+var ErrChecksumMismatch = errors.New("file does not match its checksum")
+var ErrFetchFailed = errors.New("could not download the file from its replicas")
+
+// One chunk of a file that is sent to a server. The chunks of a transfer share its TransferID and
+// are sent in order, and Last is set on the final one. FileName, Version and FileGroup describe
+// the file the transfer is stored as, and the whole file is checked against Checksum if it is set.
+// Base is the version an append is written on top of
+type FileChunk struct {
+	TransferID string
+	FileName   string
+	Version    int
+	FileGroup  []string
+	Checksum   string
+	Base       *FileVersion
+	Offset     int64
+	Data       []byte
+	Last       bool
+}
+
+// Answer to a chunk. Offset is where the receiver expects the next chunk, so a sender that lost
+// a chunk or its answer continues from there. Done is set once the whole file was received, and
+// Checksum is the checksum of the version an append was stored as
+type ChunkResponse struct {
+	Offset   int64
+	Done     bool
+	Checksum string
+}
+
+// An incoming transfer that has not received its last chunk yet. Chunks of one transfer are
+// written one at a time under its mutex, so transfers of different files do not wait for each
+// other. Hash is the checksum of the first Size bytes of the partial file, so the whole file does
+// not have to be read again once the last chunk arrives
+type incomingTransfer struct {
+	mutex    sync.Mutex
+	hash     hash.Hash
+	size     int64
+	fileName string
+	version  int
+	updated  time.Time
+}
+
+// Writes a chunk of an incoming transfer to the end of its partial file. Chunks that do not start
+// where the partial file ends are not written, and the sender is told where to continue instead.
+// Returns the path of the partial file and true once the last chunk is written, after which the
+// caller moves the file to where it belongs. A file that does not match its checksum is dropped,
+// so the sender starts over
+func (node *Node) receiveChunk(chunk *FileChunk) (ChunkResponse, string, bool, error) {
+	if chunk.TransferID == "" || filepath.Base(chunk.TransferID) != chunk.TransferID {
+		return ChunkResponse{}, "", false, ErrInvalidTransfer
+	}
+
+	transfer, completed := node.startChunk(chunk)
+	if completed {
+		return ChunkResponse{Offset: chunk.Offset + int64(len(chunk.Data)), Done: true}, "", false, nil
+	}
+	transfer.mutex.Lock()
+	defer transfer.mutex.Unlock()
+
+	// The transfer may have been finished by a copy of this chunk while this one waited
+	node.transferMutex.Lock()
+	_, completed = node.completedTransfers[chunk.TransferID]
+	node.transferMutex.Unlock()
+	if completed {
+		return ChunkResponse{Offset: chunk.Offset + int64(len(chunk.Data)), Done: true}, "", false, nil
+	}
+
+	partPath := node.dataPath(TRANSFER_FOLDER_NAME, chunk.TransferID)
+	partFile, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return ChunkResponse{}, "", false, err
+	}
+	defer partFile.Close()
+
+	info, err := partFile.Stat()
+	if err != nil {
+		return ChunkResponse{}, "", false, err
+	}
+	if info.Size() != chunk.Offset {
+		return ChunkResponse{Offset: info.Size()}, "", false, nil
+	}
+
+	// A partial file that was written before this node knew of the transfer is hashed once
+	if transfer.size != info.Size() {
+		err = transfer.rehash(partPath, info.Size())
+		if err != nil {
+			return ChunkResponse{}, "", false, err
+		}
+	}
+
+	_, err = partFile.WriteAt(chunk.Data, chunk.Offset)
+	if err == nil && chunk.Last {
+		err = partFile.Sync()
+	}
+	if err != nil {
+		// The partial file may have been written in part, so it is hashed again with the next chunk
+		transfer.size = -1
+		return ChunkResponse{}, "", false, err
+	}
+	transfer.hash.Write(chunk.Data)
+	transfer.size += int64(len(chunk.Data))
+
+	if chunk.Last && chunk.Checksum != "" && hex.EncodeToString(transfer.hash.Sum(nil)) != chunk.Checksum {
+		log.Infof("Transfer of version %d of file %s does not match its checksum, dropping it", chunk.Version, chunk.FileName)
+		os.Remove(partPath)
+		node.finishTransfer(chunk.TransferID, false)
+		return ChunkResponse{}, "", false, ErrChecksumMismatch
+	}
+
+	response := ChunkResponse{Offset: chunk.Offset + int64(len(chunk.Data)), Done: chunk.Last}
+	if chunk.Last {
+		node.finishTransfer(chunk.TransferID, true)
+	}
+
+	return response, partPath, chunk.Last, nil
+}
+
+// Returns the state of the transfer a chunk belongs to, or true if the transfer already finished
+func (node *Node) startChunk(chunk *FileChunk) (*incomingTransfer, bool) {
+	node.transferMutex.Lock()
+	defer node.transferMutex.Unlock()
+
+	if _, completed := node.completedTransfers[chunk.TransferID]; completed {
+		return nil, true
+	}
+
+	transfer := node.transfers[chunk.TransferID]
+	if transfer == nil {
+		transfer = &incomingTransfer{hash: sha256.New(), fileName: chunk.FileName, version: chunk.Version}
+		node.transfers[chunk.TransferID] = transfer
+	}
+	transfer.updated = time.Now()
+
+	return transfer, false
+}
+
+// Forgets about a transfer that received its last chunk, and remembers it if it was stored, so a
+// copy of the last chunk is not written again
+func (node *Node) finishTransfer(transferID string, stored bool) {
+	node.transferMutex.Lock()
+	defer node.transferMutex.Unlock()
+
+	delete(node.transfers, transferID)
+	if stored {
+		node.completedTransfers[transferID] = time.Now()
+	}
+}
+
+// Hashes the first size bytes of the partial file of the transfer again
+func (transfer *incomingTransfer) rehash(partPath string, size int64) error {
+	partFile, err := os.Open(partPath)
+	if err != nil {
+		return err
+	}
+	defer partFile.Close()
+
+	transfer.hash = sha256.New()
+	transfer.size, err = io.CopyBuffer(transfer.hash, io.LimitReader(partFile, size), make([]byte, CHUNK_SIZE))
+	if err == nil && transfer.size != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		transfer.size = -1
+	}
+
+	return err
+}
+
+// Drops the partial files of transfers that were given up, and forgets about transfers that
+// finished, once they are older than ORPHAN_FILE_TIMEOUT. A transfer of a put that still holds
+// its file is kept however long it takes
+func (node *Node) dropStaleTransfers() {
+	node.transferMutex.Lock()
+	defer node.transferMutex.Unlock()
+
+	for transferID, completedAt := range node.completedTransfers {
+		if time.Since(completedAt) > ORPHAN_FILE_TIMEOUT {
+			delete(node.completedTransfers, transferID)
+		}
+	}
+
+	queues := node.Queues()
+	for transferID, transfer := range node.transfers {
+		upload := queues.findUpload(transfer.fileName, transfer.version)
+		if time.Since(transfer.updated) > ORPHAN_FILE_TIMEOUT && (upload == nil || !upload.holds(time.Now())) {
+			delete(node.transfers, transferID)
+		}
+	}
+
+	partPaths, _ := filepath.Glob(node.dataPath(TRANSFER_FOLDER_NAME, "*"))
+	for _, partPath := range partPaths {
+		if node.transfers[filepath.Base(partPath)] != nil {
+			continue
+		}
+
+		info, err := os.Stat(partPath)
+		if err == nil && time.Since(info.ModTime()) > ORPHAN_FILE_TIMEOUT {
+			log.Infof("Transfer %s was given up, dropping it", filepath.Base(partPath))
+			os.Remove(partPath)
+		}
+	}
+}
+
+// Sends the file at localPath to a server as a version of an sdfs file, and returns if the server
+// stored it. The server checks the file against the checksum of the version
+func StreamVersion(hostname string, localPath string, fileName string, version int, checksum string, fileGroup []string) bool {
+	header := FileChunk{FileName: fileName, Version: version, FileGroup: fileGroup, Checksum: checksum}
+	return streamFile(hostname, "FileTransfer.SendChunk", localPath, header)
+}
+
+// Sends the file at localPath to a server in chunks through the given RPC
+func streamFile(hostname string, method string, localPath string, header FileChunk) bool {
+	file, err := os.Open(localPath)
+	if err != nil {
+		log.Infof("Could not open %s to send it! %s", localPath, err)
+		return false
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		log.Infof("Could not open %s to send it! %s", localPath, err)
+		return false
+	}
+
+	return streamSection(hostname, method, io.NewSectionReader(file, 0, info.Size()), localPath, header)
+}
+
+// Sends a section of a file to a server in chunks through the given RPC. The sender waits for
+// every chunk to be written before it sends the next one, so a slow receiver slows the sender down
+// instead of piling up chunks in memory. A failed chunk is sent again over a new connection, from
+// the offset the receiver reports
+func streamSection(hostname string, method string, section *io.SectionReader, name string, header FileChunk) bool {
+	_, success := sendSection(hostname, method, section, name, header)
+	return success
+}
+
+// Sends a section of a file the way streamSection does, and returns the answer to the last chunk
+func sendSection(hostname string, method string, section *io.SectionReader, name string, header FileChunk) (ChunkResponse, bool) {
+	header.TransferID = newTransferID()
+	buffer := make([]byte, CHUNK_SIZE)
+	offset := int64(0)
+	failures := 0
+
+	var err error
+	var client *rpc.Client
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+	}()
+
+	for failures <= TRANSFER_RETRIES {
+		if failures != 0 {
+			time.Sleep(TRANSFER_RETRY_INTERVAL)
+		}
+
+		// A server that can not be reached at all has most likely failed, so only transfers to a
+		// server that is still there are resumed
+		if client == nil {
+			client, err = rpc.DialHTTP("tcp", rpcAddr(hostname, FILE_RPC_PORT))
+			if err != nil {
+				log.Infof("Could not dial server for file transfer: %s", err)
+				return ChunkResponse{}, false
+			}
+		}
+
+		readCount, err := section.ReadAt(buffer, offset)
+		if err != nil && err != io.EOF {
+			log.Infof("Could not read %s to send it! %s", name, err)
+			return ChunkResponse{}, false
+		}
+
+		chunk := header
+		chunk.Offset = offset
+		chunk.Data = buffer[:readCount]
+		chunk.Last = offset+int64(readCount) >= section.Size()
+
+		// A file that does not match its checksum is sent the same way again, and an append the
+		// server does not have the base of can not be stored there, so neither is resumed
+		var response ChunkResponse
+		err = client.Call(method, &chunk, &response)
+		if err != nil && (err.Error() == ErrChecksumMismatch.Error() || err.Error() == ErrMissingBase.Error()) {
+			log.Infof("Server %s did not store %s! %s", hostname, name, err)
+			return ChunkResponse{}, false
+		}
+		if err != nil {
+			log.Infof("Chunk at offset %d of %s failed, resuming! %s", offset, name, err)
+			client.Close()
+			client = nil
+			failures++
+			continue
+		}
+
+		if response.Done {
+			return response, true
+		}
+		if response.Offset > section.Size() {
+			log.Infof("Server %s has more of %s than was sent!", hostname, name)
+			return ChunkResponse{}, false
+		}
+		offset = response.Offset
+	}
+
+	log.Infof("Giving up on sending %s to %s", name, hostname)
+	return ChunkResponse{}, false
+}
+
+// Asks the replicas of a version of a file, in a random order, which versions they store until
+// READ_QUORUM of them answered. Returns the replicas to download the version from, the ones that
+// answered that they store it first, or ErrNoQuorum if too few of them answered
+func ReadQuorum(fileName string, version int, replicas []string) ([]string, error) {
+	request := &FileTransferRequest{FileName: fileName}
+	readQuorum := Quorum(READ_QUORUM, len(replicas))
+
+	answered := 0
+	hostList := []string{}
+	for _, hostname := range RandomOrder(replicas) {
+		if answered == readQuorum {
+			break
+		}
+
+		storedVersions, success := CallStoredVersionsRPC(hostname, request)
+		if !success {
+			continue
+		}
+
+		answered++
+		for _, storedVersion := range storedVersions {
+			if storedVersion == version {
+				hostList = append(hostList, hostname)
+				break
+			}
+		}
+	}
+
+	if answered < readQuorum {
+		log.Infof("Only %d of %d replicas of file %s answered", answered, len(replicas), fileName)
+		return nil, ErrNoQuorum
+	}
+
+	// The other replicas are tried last, in case the copies of the replicas that answered are corrupt
+	for _, hostname := range RandomOrder(replicas) {
+		if !containsMember(hostList, hostname) {
+			hostList = append(hostList, hostname)
+		}
+	}
+
+	return hostList, nil
+}
+
+// Downloads a version of an sdfs file to localPath in chunks. The servers are tried in order, and
+// a download that fails is resumed at the same offset on the next server. If the version has a
+// checksum, a download that does not match it is started over from the next server, since one of
+// the servers it came from has a corrupt copy. Returns if the version was written
+func FetchVersion(hostList []string, fileName string, fileVersion FileVersion, localPath string) bool {
+	tempPath := localPath + ".tmp"
+	tempFile, err := os.Create(tempPath)
+	if err != nil {
+		log.Infof("Could not create %s! %s", localPath, err)
+		return false
+	}
+	defer os.Remove(tempPath)
+	defer tempFile.Close()
+
+	hash := sha256.New()
+	writer := io.MultiWriter(tempFile, hash)
+	request := &FileTransferRequest{FileName: fileName, Version: fileVersion.Version}
+	for _, hostname := range hostList {
+		if !fetchChunks(hostname, request, writer) {
+			continue
+		}
+
+		checksum := hex.EncodeToString(hash.Sum(nil))
+		if fileVersion.Checksum != "" && checksum != fileVersion.Checksum {
+			log.Infof("Version %d of file %s from %s does not match its checksum!", fileVersion.Version, fileName, hostname)
+			if tempFile.Truncate(0) != nil {
+				return false
+			}
+			tempFile.Seek(0, io.SeekStart)
+			hash.Reset()
+			request.Offset = 0
+			continue
+		}
+
+		err = tempFile.Close()
+		if err == nil {
+			err = os.Rename(tempPath, localPath)
+		}
+		if err != nil {
+			log.Infof("Could not write %s! %s", localPath, err)
+			return false
+		}
+
+		return true
+	}
+
+	log.Infof("Could not fetch version %d of file %s from any of %v", fileVersion.Version, fileName, hostList)
+	return false
+}
+
+// Gets the chunks of a file from a server starting at the offset of the request, and writes them
+// out. The request is moved past every chunk that was written, so the next server continues where
+// this one stopped. Returns if the last chunk was written
+func fetchChunks(hostname string, request *FileTransferRequest, writer io.Writer) bool {
+	client, err := rpc.DialHTTP("tcp", rpcAddr(hostname, FILE_RPC_PORT))
+	if err != nil {
+		log.Infof("Could not dial server for file transfer: %s", err)
+		return false
+	}
+	defer client.Close()
+
+	for {
+		var chunk FileChunk
+		err = client.Call("FileTransfer.GetChunk", request, &chunk)
+		if err != nil {
+			log.Infof("Error in request %s", err)
+			return false
+		}
+
+		_, err = writer.Write(chunk.Data)
+		if err != nil {
+			log.Infof("Could not write chunk of file %s! %s", request.FileName, err)
+			return false
+		}
+
+		request.Offset += int64(len(chunk.Data))
+		if chunk.Last {
+			return true
+		}
+	}
+}
+
+// Returns a random id for a transfer, so the receiver can tell the chunks of transfers apart
+func newTransferID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Helper that returns a node that only receives transfers into a temporary directory
+func newTransferNode(t *testing.T) *Node {
+	node := &Node{DataDir: t.TempDir(), queues: &RequestQueues{}, transfers: map[string]*incomingTransfer{}, completedTransfers: map[string]time.Time{}}
+	err := os.MkdirAll(node.dataPath(TRANSFER_FOLDER_NAME), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return node
+}
+
+// Helper that returns nodes that only serve the file transfer RPCs on the given ports. A node
+// listens on FILE_RPC_PORT offset by its port, like the nodes of a test cluster
+func newFileNodes(t *testing.T, ports ...int) []*Node {
+	nodes := []*Node{}
+	for _, port := range ports {
+		node, err := NewNode("127.0.0.1:"+strconv.Itoa(port), t.TempDir(), "127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(node.Kill)
+		go node.rpcListener(&FileTransfer{node: node}, FILE_RPC_PORT)
+		nodes = append(nodes, node)
+	}
+
+	for _, node := range nodes {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, listening := CallStoredVersionsRPC(node.ID, &FileTransferRequest{}); listening {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Node %s is not listening for file transfers", node.ID)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	return nodes
+}
+
+// Helper that sends the chunks of data to the node in order and returns the path of the file
+func sendChunks(node *Node, transferID string, data []byte, chunkSize int) (string, error) {
+	for offset := 0; offset < len(data); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		chunk := &FileChunk{TransferID: transferID, FileName: "a.txt", Version: 1, Checksum: FileChecksum(data), Offset: int64(offset), Data: data[offset:end], Last: end == len(data)}
+		response, partPath, complete, err := node.receiveChunk(chunk)
+		if err != nil {
+			return "", err
+		}
+		if response.Offset != int64(end) {
+			return "", fmt.Errorf("chunk at %d was answered with offset %d", offset, response.Offset)
+		}
+		if complete {
+			return partPath, nil
+		}
+	}
+
+	return "", errors.New("last chunk did not complete the transfer")
+}
+
+func TestReceiveChunks(t *testing.T) {
+	node := newTransferNode(t)
+	data := []byte("the quick brown fox jumps over the lazy dog\n")
+
+	partPath, err := sendChunks(node, "transfer1", data, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(partPath)
+	if string(content) != string(data) {
+		t.Fatalf("Received %q, expected %q", content, data)
+	}
+
+	// A copy of the last chunk is answered without writing it again
+	response, _, complete, err := node.receiveChunk(&FileChunk{TransferID: "transfer1", Offset: 40, Data: data[40:], Last: true})
+	if err != nil || complete || !response.Done {
+		t.Fatalf("Copy of the last chunk was answered with %+v %t %v", response, complete, err)
+	}
+}
+
+// A chunk that does not start where the partial file ends is not written, and the sender is told
+// where to continue. A transfer this node forgot about continues from its partial file
+func TestReceiveChunkResume(t *testing.T) {
+	node := newTransferNode(t)
+	data := []byte("0123456789abcdefghij")
+	checksum := FileChecksum(data)
+
+	_, _, _, err := node.receiveChunk(&FileChunk{TransferID: "transfer1", Checksum: checksum, Offset: 0, Data: data[:8]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, _, _, err := node.receiveChunk(&FileChunk{TransferID: "transfer1", Checksum: checksum, Offset: 12, Data: data[12:16]})
+	if err != nil || response.Offset != 8 {
+		t.Fatalf("Chunk after a gap was answered with offset %d, expected 8 %v", response.Offset, err)
+	}
+
+	delete(node.transfers, "transfer1")
+	response, partPath, complete, err := node.receiveChunk(&FileChunk{TransferID: "transfer1", Checksum: checksum, Offset: 8, Data: data[8:], Last: true})
+	if err != nil || !complete || !response.Done {
+		t.Fatalf("Resumed transfer was answered with %+v %t %v", response, complete, err)
+	}
+	content, _ := ioutil.ReadFile(partPath)
+	if string(content) != string(data) {
+		t.Fatalf("Received %q, expected %q", content, data)
+	}
+}
+
+// A file that does not match its checksum is dropped, so the sender can start over
+func TestReceiveChunkChecksumMismatch(t *testing.T) {
+	node := newTransferNode(t)
+
+	_, _, _, err := node.receiveChunk(&FileChunk{TransferID: "transfer1", Checksum: FileChecksum([]byte("other")), Data: []byte("data"), Last: true})
+	if err != ErrChecksumMismatch {
+		t.Fatalf("Transfer was answered with %v, expected a checksum mismatch", err)
+	}
+	if _, err := os.Stat(node.dataPath(TRANSFER_FOLDER_NAME, "transfer1")); !os.IsNotExist(err) {
+		t.Fatal("Partial file that does not match its checksum was kept")
+	}
+
+	_, err = sendChunks(node, "transfer1", []byte("data"), 2)
+	if err != nil {
+		t.Fatalf("Transfer that started over failed! %s", err)
+	}
+}
+
+// Transfers are received at the same time without mixing up their chunks
+func TestReceiveChunksConcurrently(t *testing.T) {
+	node := newTransferNode(t)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := []byte{}
+			for j := 0; j < 100; j++ {
+				data = append(data, []byte(strconv.Itoa(i*1000+j))...)
+			}
+			_, err := sendChunks(node, "transfer"+strconv.Itoa(i), data, 7)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// A read asks READ_QUORUM replicas which versions they store, and downloads from the ones that
+// have the version first. It fails if fewer than READ_QUORUM replicas answer
+func TestReadQuorum(t *testing.T) {
+	nodes := newFileNodes(t, 25001, 25002, 25003)
+	replicas := []string{nodes[0].ID, nodes[1].ID, nodes[2].ID}
+	for _, node := range nodes[:2] {
+		node.LocalFiles.StoreVersion("a.txt", 2, replicas, func(member string) bool { return true })
+	}
+
+	nodes[2].Kill()
+	hostList, err := ReadQuorum("a.txt", 2, replicas)
+	if err != nil || len(hostList) != 3 {
+		t.Fatalf("Read returned %v %v, expected every replica", hostList, err)
+	}
+	stored := append([]string{}, hostList[:2]...)
+	sort.Strings(stored)
+	if !reflect.DeepEqual(stored, replicas[:2]) {
+		t.Fatalf("Read tries %v first, expected the replicas that store the version", hostList)
+	}
+
+	nodes[1].Kill()
+	if _, err := ReadQuorum("a.txt", 2, replicas); err != ErrNoQuorum {
+		t.Fatalf("Read with one replica alive returned %v, expected no quorum", err)
+	}
+}
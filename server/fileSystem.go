@@ -2,264 +2,278 @@ package server
 
 import (
 	log "github.com/sirupsen/logrus"
-	"io/ioutil"
-	"math/rand"
 	"net"
-	"net/rpc"
 	"net/http"
+	"net/rpc"
+	"net/url"
 	"os"
-	"runtime"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
 
 var NUM_REPLICAS int = 4
-var FILE_RESHARD_TIMEOUT int64 = 8000
-var FindFileResponseMutex sync.Mutex
-var FileSystemMutex sync.Mutex
 
-// Local datastore that keeps track of the other nodes that have the same files
+// Number of replicas a put has to be stored on before it is committed, and number of replicas a
+// get compares the versions of. With WRITE_QUORUM + READ_QUORUM > NUM_REPLICAS a get always asks
+// at least one replica that has the newest version
+var WRITE_QUORUM int = 3
+var READ_QUORUM int = 2
+
+// Separates the name of a file from its version in the names of the files in serverFiles
+var VERSION_DELIMITER string = "@"
+
+// Local datastore that keeps track of the other nodes that have the same files and the versions
+// of them this node stores. It is shared by the file system manager and the RPC handlers, so it is
+// only accessed through its methods, which hand out copies. Every change is logged in dir, so a
+// node that restarts still knows which files it stores
 type LocalFileSystem struct {
-	Files       map[string][]string
-	UpdateTimes map[string]int64
+	mutex       sync.RWMutex
+	files       map[string][]string
+	versions    map[string]map[int]time.Time
+	updateTimes map[string]int64
+
+	dir        string
+	logFile    *os.File
+	logEntries int
 }
 
-// Need to keep a global file list and server response map
-var FileFoundResponses map[string][]string
-var FileNotFoundCounts map[string]int
-var LocalFiles *LocalFileSystem
-
-// go routine that will handle requests and resharding of files from failed nodes
-func FileSystemManager() {
-	FileFoundResponses = map[string][]string{}
-	FileNotFoundCounts =  map[string]int{}
-	LocalFiles = &LocalFileSystem{
-		Files:       map[string][]string{},
-		UpdateTimes: map[string]int64{},
-	}
-
-	go clientRequestListener()
-	go serverResponseListener()
-	go fileTransferListener()
-
-	completedRequests := map[string]int{}
-	for {
-		// Check if there are any requests in the membership list
-		for _, request := range Membership.Pending {
-
-			// If the request is in the complete list or the node doesnt have the file, continue
-			_, isRequestFinished := completedRequests[request.ID]
-			_, nodeContainsFile := LocalFiles.Files[request.FileName]
-			if isRequestFinished {
-				runtime.Gosched()
-				continue
-			}
+func newLocalFileSystem() *LocalFileSystem {
+	return &LocalFileSystem{files: map[string][]string{}, versions: map[string]map[int]time.Time{}, updateTimes: map[string]int64{}}
+}
 
-			if !nodeContainsFile {
-				fileStatusRPC("ServerCommunication.FileNotFound", request)
-				completedRequests[request.ID] = 0
-				runtime.Gosched()
-				continue
-			}
+// Returns the fileGroup of a file, or false if the file is not stored on this node
+func (localFiles *LocalFileSystem) FileGroup(fileName string) ([]string, bool) {
+	localFiles.mutex.RLock()
+	defer localFiles.mutex.RUnlock()
 
-			fileStatusRPC("ServerCommunication.FileFound", request)
-			if request.Type == "Delete" {
-				deleteLocalFile(request.FileName)
-			}
+	fileGroup, contains := localFiles.files[fileName]
+	return append([]string{}, fileGroup...), contains
+}
 
-			completedRequests[request.ID] = 0
-		}
+// Returns every stored file with its fileGroup
+func (localFiles *LocalFileSystem) Files() map[string][]string {
+	localFiles.mutex.RLock()
+	defer localFiles.mutex.RUnlock()
 
-		findFailedNodes()
-		completedRequests = cleanCompletedRequests(completedRequests)
-		runtime.Gosched()
+	files := map[string][]string{}
+	for fileName, fileGroup := range localFiles.files {
+		files[fileName] = append([]string{}, fileGroup...)
 	}
+
+	return files
 }
 
-// Goroutine that will listen for incoming RPC requests made from any client
-func clientRequestListener() {
-	server := rpc.NewServer()
-	clientRequestRPC := new(ClientRequest)
-	err := server.Register(clientRequestRPC)
-	if err != nil {
-		log.Fatalf("Format of service ClientRequest isn't correct. %s", err)
-	}
+// Records that the file is stored on this node with the given fileGroup, leaving out the members
+// that keep returns false for. This is done under the same lock as filterFileGroups, so a fileGroup
+// that was sent before a member failed can not bring it back after the failure was handled
+func (localFiles *LocalFileSystem) Store(fileName string, fileGroup []string, keep func(member string) bool) {
+	localFiles.mutex.Lock()
+	defer localFiles.mutex.Unlock()
+
+	localFiles.update(localFiles.storeEntry(LOCAL_STORE_FILE, fileName, fileGroup, keep))
+}
 
-	oldMux := http.DefaultServeMux
-    mux := http.NewServeMux()
-    http.DefaultServeMux = mux
-	server.HandleHTTP(rpc.DefaultRPCPath, rpc.DefaultDebugPath)
-	http.DefaultServeMux = oldMux
+// Records that a version of the file is stored on this node, with the given fileGroup
+func (localFiles *LocalFileSystem) StoreVersion(fileName string, version int, fileGroup []string, keep func(member string) bool) {
+	localFiles.mutex.Lock()
+	defer localFiles.mutex.Unlock()
 
-	listener, _ := net.Listen("tcp", ":"+CLIENT_RPC_PORT)
-	http.Serve(listener, mux)
+	entry := localFiles.storeEntry(LOCAL_STORE_VERSION, fileName, fileGroup, keep)
+	entry.Version = version
+	entry.StoredAt = time.Now()
+	localFiles.update(entry)
 }
 
-// Goroutine that will listen for incoming RPC calls from other servers
-func serverResponseListener() {
-	server := rpc.NewServer()
-	serverResponseRPC := new(ServerCommunication)
-	err := server.Register(serverResponseRPC)
-	if err != nil {
-		log.Fatalf("Format of service ServerCommunication isn't correct. %s", err)
+// Returns the change that stores the file with the members of the fileGroup that keep returns
+// true for. The caller must hold the mutex
+func (localFiles *LocalFileSystem) storeEntry(entryType string, fileName string, fileGroup []string, keep func(member string) bool) localFileEntry {
+	keptMembers := []string{}
+	for _, member := range fileGroup {
+		if keep(member) {
+			keptMembers = append(keptMembers, member)
+		}
 	}
 
-	oldMux := http.DefaultServeMux
-    mux := http.NewServeMux()
-    http.DefaultServeMux = mux
-	server.HandleHTTP(rpc.DefaultRPCPath, rpc.DefaultDebugPath)
-	http.DefaultServeMux = oldMux
+	return localFileEntry{
+		Type:       entryType,
+		FileName:   fileName,
+		FileGroup:  keptMembers,
+		UpdateTime: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+}
 
-	listener, _ := net.Listen("tcp", ":"+SERVER_RPC_PORT)
-	http.Serve(listener, mux)
+// Applies a change and logs it. The caller must hold the mutex
+func (localFiles *LocalFileSystem) update(entry localFileEntry) {
+	localFiles.apply(entry)
+	localFiles.persist(entry)
 }
 
-// Goroutine that will listen for incoming RPC connection to transfer a file
-func fileTransferListener() {
-	server := rpc.NewServer()
-	fileTransferRPC := new(FileTransfer)
-	err := server.Register(fileTransferRPC)
-	if err != nil {
-		log.Fatalf("Format of service fileTransfer isn't correct. %s", err)
+// Returns the versions of the file stored on this node, newest first
+func (localFiles *LocalFileSystem) Versions(fileName string) []int {
+	localFiles.mutex.RLock()
+	defer localFiles.mutex.RUnlock()
+
+	versions := []int{}
+	for version := range localFiles.versions[fileName] {
+		versions = append(versions, version)
 	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
 
-	oldMux := http.DefaultServeMux
-    mux := http.NewServeMux()
-    http.DefaultServeMux = mux
-	server.HandleHTTP(rpc.DefaultRPCPath, rpc.DefaultDebugPath)
-	http.DefaultServeMux = oldMux
+	return versions
+}
 
-	listener, _ := net.Listen("tcp", ":"+FILE_RPC_PORT)
-	http.Serve(listener, mux)
+// Checks if a version of the file is stored on this node
+func (localFiles *LocalFileSystem) HasVersion(fileName string, version int) bool {
+	_, contains := localFiles.StoredAt(fileName, version)
+	return contains
 }
 
-// Function that deletes data for a file from the server and the localFiles struct
-func deleteLocalFile(fileName string) {
-	delete(LocalFiles.Files, fileName)
-	delete(LocalFiles.UpdateTimes, fileName)
-	log.Infof("File %s deleted from the server!", fileName)
+// Returns when a version of the file was stored on this node
+func (localFiles *LocalFileSystem) StoredAt(fileName string, version int) (time.Time, bool) {
+	localFiles.mutex.RLock()
+	defer localFiles.mutex.RUnlock()
 
-	err := os.Remove(SERVER_FOLDER_NAME + "/" + fileName)
-	if err != nil {
-		log.Infof("Unable to remove file %s from local node!", fileName)
-		return
-	}
+	storedAt, contains := localFiles.versions[fileName][version]
+	return storedAt, contains
 }
 
-// Function that will send an RPC call to the leader indicating whether the file was found. If the
-// file was found on the server, only the fileMaster will respond
-func fileStatusRPC(requestType string, request *Request) {
-	args := &ServerRequestArgs{
-		ID: request.ID,
+// Forgets a version of the file. The file is forgotten once it has no versions left
+func (localFiles *LocalFileSystem) RemoveVersion(fileName string, version int) {
+	localFiles.mutex.Lock()
+	defer localFiles.mutex.Unlock()
+
+	if _, contains := localFiles.versions[fileName][version]; contains {
+		localFiles.update(localFileEntry{Type: LOCAL_REMOVE_VERSION, FileName: fileName, Version: version})
 	}
+}
 
-	if requestType == "ServerCommunication.FileFound" {
-		hostname, _ := os.Hostname()
-		fileGroup, _ := LocalFiles.Files[request.FileName]
-		if fileGroup[0] != hostname {
-			return
-		}
+func (localFiles *LocalFileSystem) Remove(fileName string) {
+	localFiles.mutex.Lock()
+	defer localFiles.mutex.Unlock()
 
-		args.FileName = request.FileName
-		args.HostList = fileGroup
+	if _, contains := localFiles.files[fileName]; contains {
+		localFiles.update(localFileEntry{Type: LOCAL_REMOVE_FILE, FileName: fileName})
 	}
+}
 
-	CallServerCommunicationRPC(request.SrcHost, requestType, args)
+// Same as RemoveVersion. The caller must hold the mutex
+func (localFiles *LocalFileSystem) removeVersion(fileName string, version int) {
+	delete(localFiles.versions[fileName], version)
+	if len(localFiles.versions[fileName]) == 0 {
+		localFiles.remove(fileName)
+	}
 }
 
-// This will find all the files that need to be resharded to another node
-func findFailedNodes() {
-	hostname, _ := os.Hostname()
-	for fileName, fileGroup := range LocalFiles.Files {
+// Same as Remove. The caller must hold the mutex
+func (localFiles *LocalFileSystem) remove(fileName string) {
+	delete(localFiles.files, fileName)
+	delete(localFiles.versions, fileName)
+	delete(localFiles.updateTimes, fileName)
+}
 
-		currTime := time.Now().UnixNano() / int64(time.Millisecond)
-		fileGroupAliveNodes := []string{}
-		for _, node := range fileGroup {
+// Drops the members that keep returns false for from every fileGroup
+func (localFiles *LocalFileSystem) filterFileGroups(keep func(member string) bool) {
+	localFiles.mutex.Lock()
+	defer localFiles.mutex.Unlock()
 
-			// We want a longer time out than failure detection to duplicate a file
-			if currTime-Membership.Data[node] < FILE_RESHARD_TIMEOUT {
-				fileGroupAliveNodes = append(fileGroupAliveNodes, node)
+	for fileName, fileGroup := range localFiles.files {
+		keptMembers := []string{}
+		for _, member := range fileGroup {
+			if keep(member) {
+				keptMembers = append(keptMembers, member)
 			}
 		}
 
-		// If there are less than NUM_REPLICAS of a file, and the current node is the fileMaster, reshard
-		if len(fileGroupAliveNodes) < NUM_REPLICAS && fileGroupAliveNodes[0] == hostname {
-			// log.Infof("Resharding file %s", fileName)
-			// go reshardFiles(fileName, fileGroupAliveNodes)
-			runtime.Gosched()
-		} else if len(fileGroupAliveNodes) != len(fileGroup) {
-			LocalFiles.Files[fileName] = fileGroupAliveNodes
+		if len(keptMembers) != len(fileGroup) {
+			localFiles.update(localFileEntry{Type: LOCAL_FILE_GROUP, FileName: fileName, FileGroup: keptMembers})
 		}
 	}
 }
 
-// This will randomly pick nodes that doesnt have the file to reshard the file to them
-func reshardFiles(fileName string, fileGroupAliveNodes []string) {
-	newFileGroup := make([]string, len(fileGroupAliveNodes))
-	copy(newFileGroup, fileGroupAliveNodes)
-	rand.Seed(time.Now().UnixNano())
-
-	// Disgusting random function that will loop until it finds a node not in the runningNodes list
-	newGroupMembers := []string{}
-	for {
-		randIndex := rand.Intn(len(Membership.List))
-		nodeName := Membership.List[randIndex]
-
-		duplicate := false
-		for i := 0; i < len(newFileGroup); i++ {
-			if newFileGroup[i] == nodeName {
-				duplicate = true
-				break
+// go routine that will serve the file RPCs and handle resharding of files from failed nodes
+func (node *Node) FileSystemManager() {
+	defer node.LocalFiles.close()
+	go node.rpcListener(&ClientRequest{node: node}, CLIENT_RPC_PORT)
+	go node.rpcListener(&ServerCommunication{node: node}, SERVER_RPC_PORT)
+	go node.rpcListener(&FileTransfer{node: node}, FILE_RPC_PORT)
+
+	// The fileGroups only change when members leave or fail, and files move on the hash ring when
+	// members join or are removed
+	events, _ := node.SubscribeMembership()
+	for !node.isStopped() {
+		select {
+		case event := <-events:
+			if event.IsRemoval() {
+				node.findFailedNodes()
 			}
-		}
-
-		if duplicate {
-			continue
-		}
-
-		newFileGroup = append(newFileGroup, nodeName)
-		newGroupMembers = append(newGroupMembers, nodeName)
-		if len(newFileGroup) == NUM_REPLICAS {
-			sort.Strings(newFileGroup)
-			break
+			if event.IsRemoval() || event.Type == EVENT_MEMBER_JOINED {
+				node.placeFiles()
+			}
+		case <-node.stop:
 		}
 	}
+}
 
-	// Update the fileGroup for the original owners of the file
-	updateFileGroupArgs := &ServerRequestArgs{
-		ID:       "",
-		FileName: fileName,
-		HostList: newFileGroup,
-	}
-	for _, node := range fileGroupAliveNodes {
-		CallServerCommunicationRPC(node, "ServerCommunication.UpdateFileGroup", updateFileGroupArgs)
+// Goroutine that will serve an RPC service on the given port until the node is killed
+func (node *Node) rpcListener(service interface{}, servicePort string) {
+	server := rpc.NewServer()
+	err := server.Register(service)
+	if err != nil {
+		log.Fatalf("Format of service %T isn't correct. %s", service, err)
 	}
 
-	// Send the file and the new group over to the new members of the fileGroup
-	loadedFile, _ := ioutil.ReadFile(SERVER_FOLDER_NAME + "/" + fileName)
-	fileTransferArgs := &FileTransferRequest{
-		FileName:  fileName,
-		FileGroup: newFileGroup,
-		Data:      loadedFile,
-	}
-	for _, node := range newGroupMembers {
-		CallFileTransferRPC(node, "FileTransfer.SendFile", fileTransferArgs)
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, server)
+
+	listener, err := net.Listen("tcp", node.listenAddr(servicePort))
+	if err != nil {
+		log.Infof("Could not listen for %T on port %s! %s", service, servicePort, err)
+		return
 	}
+
+	node.addListener(listener)
+	http.Serve(listener, mux)
 }
 
-// After a request dissppears from the request buffer, remove it from the local completed requests map
-func cleanCompletedRequests(completedRequests map[string]int) (map[string]int) {
-	currentRequests := map[string]int{}
-	for _, request := range Membership.Pending {
-		currentRequests[request.ID] = 0
-	}
+// Function that deletes data for every version of a file from the server and the localFiles struct
+func (node *Node) deleteLocalFile(fileName string) {
+	versions := node.LocalFiles.Versions(fileName)
+	node.LocalFiles.Remove(fileName)
+	log.Infof("File %s deleted from the server!", fileName)
 
-	for requestID, _ := range completedRequests {
-		if _, contains := currentRequests[requestID]; !contains {
-			delete(completedRequests, requestID)
+	for _, version := range versions {
+		err := os.Remove(node.versionPath(fileName, version))
+		if err != nil {
+			log.Infof("Unable to remove version %d of file %s from local node!", version, fileName)
 		}
 	}
+}
 
-	return completedRequests
-}
\ No newline at end of file
+// Function that deletes the data of one version of a file
+func (node *Node) deleteLocalVersion(fileName string, version int) {
+	node.LocalFiles.RemoveVersion(fileName, version)
+
+	err := os.Remove(node.versionPath(fileName, version))
+	if err != nil {
+		log.Infof("Unable to remove version %d of file %s from local node!", version, fileName)
+	}
+}
+
+// Returns the path a version of a file is stored at
+func (node *Node) versionPath(fileName string, version int) string {
+	return node.dataPath(SERVER_FOLDER_NAME, localName(fileName)+VERSION_DELIMITER+strconv.Itoa(version))
+}
+
+// Returns the name a file of the sdfs has on disk. The directories of its path are escaped, so
+// every file is kept in the same folder
+func localName(fileName string) string {
+	return url.PathEscape(fileName)
+}
+
+// Drops failed nodes from the fileGroups, so the first alive node becomes the fileMaster. Members
+// only leave the list once the failure detector has confirmed the failure
+func (node *Node) findFailedNodes() {
+	node.LocalFiles.filterFileGroups(node.mayBeAlive)
+}
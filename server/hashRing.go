@@ -0,0 +1,67 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// Number of points every member has on the hash ring. More points spread the files more evenly
+// over the members
+var VIRTUAL_NODE_COUNT int = 64
+
+// Consistent hash ring over the membership list. Every member is placed on the ring at
+// VIRTUAL_NODE_COUNT points, and a file is stored on the first distinct members found walking
+// the ring clockwise from the hash of its name. Adding or removing a member only moves the files
+// next to its points, so every node can compute where a file belongs without asking the others.
+type HashRing struct {
+	points  []uint64
+	members map[uint64]string
+}
+
+// Builds the ring of the given members
+func newHashRing(members []string) *HashRing {
+	ring := &HashRing{members: map[uint64]string{}}
+	for _, member := range members {
+		for i := 0; i < VIRTUAL_NODE_COUNT; i++ {
+			point := ringHash(member + "#" + strconv.Itoa(i))
+			if _, taken := ring.members[point]; taken {
+				continue
+			}
+
+			ring.members[point] = member
+			ring.points = append(ring.points, point)
+		}
+	}
+
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// Returns the count members a file is placed on, in ring order. The first one is the fileMaster.
+// Fewer members are returned if the ring does not have count of them
+func (ring *HashRing) ReplicaSet(fileName string, count int) []string {
+	replicas := []string{}
+	if len(ring.points) == 0 {
+		return replicas
+	}
+
+	start := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= ringHash(fileName) })
+	seen := map[string]bool{}
+	for i := 0; i < len(ring.points) && len(replicas) < count; i++ {
+		member := ring.members[ring.points[(start+i)%len(ring.points)]]
+		if !seen[member] {
+			seen[member] = true
+			replicas = append(replicas, member)
+		}
+	}
+
+	return replicas
+}
+
+// Position of a key on the ring, the first 8 bytes of its SHA-1 hash
+func ringHash(key string) uint64 {
+	sum := sha1.Sum([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
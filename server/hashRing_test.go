@@ -0,0 +1,89 @@
+package server
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+var ringMembers = []string{"n1", "n2", "n3", "n4", "n5"}
+
+// Helper that returns the names of the files the ring tests place
+func ringKeys() []string {
+	keys := []string{}
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, "file"+strconv.Itoa(i)+".txt")
+	}
+
+	return keys
+}
+
+func TestReplicaSet(t *testing.T) {
+	ring := newHashRing(ringMembers)
+
+	replicas := ring.ReplicaSet("a.txt", 3)
+	seen := map[string]bool{}
+	for _, replica := range replicas {
+		seen[replica] = true
+	}
+	if len(replicas) != 3 || len(seen) != 3 {
+		t.Fatalf("File was placed on %v, expected 3 distinct members", replicas)
+	}
+	if !reflect.DeepEqual(newHashRing(ringMembers).ReplicaSet("a.txt", 3), replicas) {
+		t.Fatal("Rings of the same members placed a file differently")
+	}
+
+	if replicas := ring.ReplicaSet("a.txt", 8); len(replicas) != len(ringMembers) {
+		t.Fatalf("File was placed on %v, expected every member", replicas)
+	}
+	if replicas := newHashRing(nil).ReplicaSet("a.txt", 3); len(replicas) != 0 {
+		t.Fatalf("Empty ring placed a file on %v", replicas)
+	}
+}
+
+// A member that joins only takes files from the others, and only about its share of them
+func TestReplicaSetJoin(t *testing.T) {
+	before := newHashRing(ringMembers)
+	after := newHashRing(append(append([]string{}, ringMembers...), "n6"))
+
+	moved := 0
+	for _, key := range ringKeys() {
+		oldReplicas := before.ReplicaSet(key, 3)
+		newReplicas := after.ReplicaSet(key, 3)
+		for _, replica := range newReplicas {
+			if replica != "n6" && !containsMember(oldReplicas, replica) {
+				t.Fatalf("File %s moved from %v to %v, which is not the member that joined", key, oldReplicas, newReplicas)
+			}
+		}
+		if newReplicas[0] != oldReplicas[0] {
+			moved++
+		}
+	}
+
+	if moved > len(ringKeys())/3 {
+		t.Fatalf("The join moved the fileMaster of %d of %d files", moved, len(ringKeys()))
+	}
+}
+
+// Only the files of a member that left are moved, to the next members on the ring
+func TestReplicaSetLeave(t *testing.T) {
+	before := newHashRing(ringMembers)
+	after := newHashRing([]string{"n1", "n2", "n4", "n5"})
+
+	for _, key := range ringKeys() {
+		oldReplicas := before.ReplicaSet(key, 3)
+		newReplicas := after.ReplicaSet(key, 3)
+		if !containsMember(oldReplicas, "n3") {
+			if !reflect.DeepEqual(oldReplicas, newReplicas) {
+				t.Fatalf("File %s that was not on the member that left moved from %v to %v", key, oldReplicas, newReplicas)
+			}
+			continue
+		}
+
+		for _, replica := range oldReplicas {
+			if replica != "n3" && !containsMember(newReplicas, replica) {
+				t.Fatalf("File %s moved from %v to %v, dropping a member that is still alive", key, oldReplicas, newReplicas)
+			}
+		}
+	}
+}
@@ -1,264 +1,297 @@
 package server
 
 import (
-	"encoding/json"
+	"fmt"
 	log "github.com/sirupsen/logrus"
-	"math"
 	"net"
-	"os"
-	"sort"
-	"strconv"
 	"sync"
 	"time"
 )
 
 var UDP_PORT_NUM string = "4000"
-var NODE_FAIL_TIMEOUT int64 = 4000
-var INTRODUCER_NODE string = "fa19-cs425-g84-01.cs.illinois.edu"
 
-// Need to store extra list that maintains order or the list
+// Number of this node's protocol periods a member can stay suspected without refuting it
+// before it is declared failed
+var NODE_FAIL_PERIODS uint64 = 4
+
+// States a member can be in. A member that is alive or suspected is in the membership list.
+// Later states win over earlier ones for the same incarnation.
+type MemberState int
+
+const (
+	MEMBER_ALIVE MemberState = iota
+	MEMBER_SUSPECT
+	MEMBER_LEFT
+	MEMBER_FAILED
+)
+
+func (state MemberState) String() string {
+	switch state {
+	case MEMBER_ALIVE:
+		return "Alive"
+	case MEMBER_SUSPECT:
+		return "Suspect"
+	case MEMBER_LEFT:
+		return "Left"
+	case MEMBER_FAILED:
+		return "Failed"
+	}
+
+	return "Unknown"
+}
+
+// What a node knows about one member. Incarnation is only ever raised by the member itself to
+// refute a suspicion, and Heartbeat is the member's own count of its protocol periods. Neither
+// depends on the clocks of the machines, so they can be compared across nodes.
+type Member struct {
+	State       MemberState
+	Incarnation uint64
+	Heartbeat   uint64
+
+	// Heartbeat of this node when the member was suspected
+	SuspectedAt uint64
+}
+
+// Checks if a member in this state is in the membership list
+func (state MemberState) IsActive() bool {
+	return state == MEMBER_ALIVE || state == MEMBER_SUSPECT
+}
+
+// Need to store extra list that maintains order or the list. The list holds the alive and suspected
+// members, and members holds every member this node has heard of, including removed ones.
+// The members are guarded by the swimMutex of the node. The list is read by every manager and RPC
+// handler, so it has its own lock and is only handed out as a copy. The hash ring is rebuilt
+// along with the list
 type MembershipList struct {
 	SrcHost string
-	Data    map[string]int64
-	List    []string
+	members map[string]*Member
 
-	RequestUTime int64
-	Pending      []*Request
+	mutex sync.RWMutex
+	list  []string
+	ring  *HashRing
+}
 
-	MapleJuiceUTime int64
-	MJQueue         []*MapleJuiceRequest
+// Creates the membership list of a node that only knows about itself
+func newMembershipList(nodeID string) *MembershipList {
+	return &MembershipList{
+		SrcHost: nodeID,
+		members: map[string]*Member{nodeID: &Member{State: MEMBER_ALIVE}},
+		list:    []string{nodeID},
+		ring:    newHashRing([]string{nodeID}),
+	}
 }
 
-// We need to make this a global so RPC can access it
-var Membership *MembershipList
+// Returns a copy of the sorted list of alive and suspected members
+func (membership *MembershipList) List() []string {
+	membership.mutex.RLock()
+	defer membership.mutex.RUnlock()
 
-// Goroutine that will send out heartbeats every half second.
-func HeartbeatManager() {
-	serverStartup()
-	go listenForUDP()
+	return append([]string{}, membership.list...)
+}
 
-	hostname, _ := os.Hostname()
-	ticker := time.NewTicker(1000 * time.Millisecond)
-	var wg sync.WaitGroup
+// Returns the number of members in the list
+func (membership *MembershipList) Len() int {
+	membership.mutex.RLock()
+	defer membership.mutex.RUnlock()
 
-	for {
-		<-ticker.C
+	return len(membership.list)
+}
 
-		wg.Add(1)
-		go sendHeartbeats(&wg)
-		wg.Wait()
+// Checks if the member is in the list
+func (membership *MembershipList) Contains(member string) bool {
+	membership.mutex.RLock()
+	defer membership.mutex.RUnlock()
 
-		// If the current node has not left the network then update its time
-		if Membership.Data[hostname] > 0 {
-			Membership.Data[hostname] = time.Now().UnixNano() / int64(time.Millisecond)
+	for _, listMember := range membership.list {
+		if listMember == member {
+			return true
 		}
-
-		removeExitedNodes()
 	}
+
+	return false
 }
 
-// Server setup that will make initial connections and set global Membership
-func serverStartup() {
-	hostname, _ := os.Hostname()
-
-	var requests []*Request
-	var mapleJuiceQueue []*MapleJuiceRequest
-	currTime := time.Now().UnixNano() / int64(time.Millisecond)
-	Membership = &MembershipList{
-		SrcHost:         hostname,
-		Data:            map[string]int64{hostname: time.Now().UnixNano() / int64(time.Millisecond)},
-		List:            []string{hostname},
-		RequestUTime:    currTime,
-		Pending:         requests,
-		MapleJuiceUTime: currTime,
-		MJQueue:         mapleJuiceQueue,
-	}
+// Returns the members the hash ring places a file on, see HashRing.ReplicaSet
+func (membership *MembershipList) ReplicaSet(fileName string, count int) []string {
+	membership.mutex.RLock()
+	defer membership.mutex.RUnlock()
 
-	if hostname != INTRODUCER_NODE {
-		log.Info("Writing to the introducer!")
-		writeMembershipList(INTRODUCER_NODE)
+	return membership.ring.ReplicaSet(fileName, count)
+}
 
-	} else {
-		log.Info("Introducer attempting to reconnect to any node!")
-		for i := 2; i <= 10; i++ {
-			numStr := strconv.Itoa(i)
-			if len(numStr) == 1 {
-				numStr = "0" + numStr
-			}
+func (membership *MembershipList) setList(list []string) {
+	ring := newHashRing(list)
 
-			connectName := "fa19-cs425-g84-" + numStr + ".cs.illinois.edu"
-			writeMembershipList(connectName)
-		}
-	}
+	membership.mutex.Lock()
+	defer membership.mutex.Unlock()
+
+	membership.list = list
+	membership.ring = ring
 }
 
-// Function called by the heartbeat manager that will send heartbeats to neighbors
-func sendHeartbeats(wg *sync.WaitGroup) {
-	hostName, _ := os.Hostname()
-	index := findHostnameIndex(hostName)
-	lastIndex := index
-
-	// Sends two heartbeats to its immediate successors
-	for i := 1; i <= 2; i++ {
-		nameIndex := (index + i) % len(Membership.List)
-		lastIndex = nameIndex
-		if nameIndex == index {
-			break
+// Goroutine that runs the SWIM failure detector on the socket opened by Start. Every protocol
+// period it probes one member and times out the members that have been suspected for too long.
+func (node *Node) HeartbeatManager(socketUDP *net.UDPConn) {
+	if socketUDP == nil {
+		return
+	}
+	go node.listenForUDP(socketUDP)
+	node.serverStartup()
+
+	hostname := node.ID
+	ticker := time.NewTicker(PROTOCOL_PERIOD)
+	defer ticker.Stop()
+	var wg sync.WaitGroup
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-node.stop:
+			return
 		}
 
-		go writeMembershipList(Membership.List[nameIndex])
-	}
+		// A paused node goes silent like a hung process would
+		if node.isPaused() {
+			continue
+		}
+
+		wg.Add(1)
+		go node.probeNextMember(&wg)
+		wg.Wait()
 
-	// Sends two heartbeats to its immediate predecessors
-	for i := -1; i >= -2; i-- {
-		nameIndex := (len(Membership.List) + index + i) % len(Membership.List)
-		if lastIndex == index || nameIndex == lastIndex {
-			break
+		// If the current node has not left the network then count the period
+		node.swimMutex.Lock()
+		if self := node.Membership.members[hostname]; self.State != MEMBER_LEFT {
+			self.Heartbeat++
 		}
+		node.swimMutex.Unlock()
 
-		go writeMembershipList(Membership.List[nameIndex])
+		node.removeExitedNodes()
 	}
-
-	wg.Done()
 }
 
-// This writes the Membership lists to the socket which is called by sendHeartbeats
-func writeMembershipList(hostName string) {
-	conn, err := net.Dial("udp", hostName+":"+UDP_PORT_NUM)
-	if err != nil {
-		log.Fatal("Could not connect to node! %s", err)
-	}
-	defer conn.Close()
+// Server setup that will send a join to the introducers. The introducers answer with every
+// member they know of, and the join itself is gossiped to the rest of the cluster.
+func (node *Node) serverStartup() {
+	hostname := node.ID
+	node.swimMutex.Lock()
+	join := node.selfUpdate()
+	node.swimMutex.Unlock()
+
+	if !Config.IsIntroducer(hostname) {
+		log.Info("Writing to the introducers!")
+		for _, introducer := range Config.Introducers {
+			node.sendMessage(introducer, &SwimMessage{Type: SWIM_JOIN, Updates: []MemberUpdate{join}})
+		}
 
-	memberSend, err := json.Marshal(Membership)
-	if err != nil {
-		log.Fatal("Could not encode message %s", err)
-		return
+	} else {
+		log.Info("Introducer attempting to reconnect to any node!")
+		for _, connectName := range Config.NodeIDs() {
+			if connectName != hostname {
+				node.sendMessage(connectName, &SwimMessage{Type: SWIM_JOIN, Updates: []MemberUpdate{join}})
+			}
+		}
 	}
-
-	conn.Write(memberSend)
 }
 
-// Loops through the Membership and checks if any of the times on the nodes are past the
-// allowed timeout. If the last time is 0 then the node has left the network. We call this
-// after we send heartbeats because if the current node leaves, it sets its Data map enty
-// to 0 and must propogate this out to the other nodes.
-func removeExitedNodes() {
-	currTime := time.Now().UnixNano() / int64(time.Millisecond)
-	tempList := Membership.List[:0]
-	rootName, _ := os.Hostname()
-
-	for _, hostName := range Membership.List {
-		lastPing := Membership.Data[hostName]
-		if lastPing < 0 {
-			if hostName != rootName {
-				log.Infof("Node %s left the network!", hostName)
-			} else {
-				tempList = append(tempList, hostName)
-			}
-		} else if !(currTime-lastPing > NODE_FAIL_TIMEOUT) {
-			tempList = append(tempList, hostName)
-		} else {
-			log.Infof("Node %s timed out!", hostName)
+// Declares every member that has been suspected for more than NODE_FAIL_PERIODS as failed.
+// The failure is gossiped out with the next probes.
+func (node *Node) removeExitedNodes() {
+	failedNodes := []MemberUpdate{}
+
+	node.swimMutex.Lock()
+	currPeriod := node.Membership.members[node.ID].Heartbeat
+	for memberName, member := range node.Membership.members {
+		if member.State == MEMBER_SUSPECT && currPeriod-member.SuspectedAt > NODE_FAIL_PERIODS {
+			failedNodes = append(failedNodes, MemberUpdate{Node: memberName, State: MEMBER_FAILED, Incarnation: member.Incarnation, Heartbeat: member.Heartbeat})
 		}
 	}
+	node.swimMutex.Unlock()
 
-	Membership.List = tempList
+	for _, update := range failedNodes {
+		node.applyUpdate(update)
+	}
 }
 
 // Goroutine that constantly listens for incoming UDP calls
-func listenForUDP() {
-	socketUDP := openUDPConn()
-
-	// This will fail when heartbeats grow beyond 1024 bytes
-	buffer := make([]byte, 1024)
+func (node *Node) listenForUDP(socketUDP *net.UDPConn) {
+	buffer := make([]byte, UDP_READ_BUFFER_SIZE)
 	for {
 		readLen, _, err := socketUDP.ReadFromUDP(buffer)
+		if node.isStopped() {
+			return
+		}
 		if err != nil {
 			log.Infof("Encountered error while reading UDP socket! %s", err)
 			continue
 		}
-		if readLen == 0 {
+		if readLen == 0 || node.isPaused() {
 			continue
 		}
 
-		newMembership := &MembershipList{}
-		err = json.Unmarshal(buffer[:readLen], &newMembership)
+		message, err := decodeSwimMessage(buffer[:readLen])
 		if err != nil {
 			log.Infof("Could not decode request! %s", err)
-			return
+			continue
 		}
 
-		processNewMembershipList(newMembership)
-		if newMembership.RequestUTime > Membership.RequestUTime {
-			Membership.Pending = newMembership.Pending
-		}
-		if newMembership.MapleJuiceUTime > Membership.MapleJuiceUTime {
-			Membership.MJQueue = newMembership.MJQueue
-		}
+		node.handleMessage(message)
 	}
 }
 
-// Helper method that will open a UDP connection
-func openUDPConn() *net.UDPConn {
-	hostname, _ := os.Hostname()
-	addr, err := net.ResolveUDPAddr("udp", hostname+":"+UDP_PORT_NUM)
+// Helper method that will open a UDP connection. Returns nil without an error if the node was
+// killed in the meantime
+func (node *Node) openUDPConn() (*net.UDPConn, error) {
+	hostname := node.ID
+	_, port, _ := net.SplitHostPort(hostname)
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(node.BindAddr, port))
 	if err != nil {
-		log.Fatal("Could not resolve hostname!: %s", err)
+		return nil, fmt.Errorf("could not resolve %s: %w", hostname, err)
 	}
 	socketUDP, err := net.ListenUDP("udp", addr)
 	if err != nil {
-		log.Fatal("Server could not set up UDP listener %s", err)
+		return nil, fmt.Errorf("could not set up the UDP listener: %w", err)
 	}
 	log.Infof("Connected to %s!", hostname)
 
-	return socketUDP
+	node.listenerMutex.Lock()
+	defer node.listenerMutex.Unlock()
+	if node.isStopped() {
+		socketUDP.Close()
+		return nil, nil
+	}
+	node.udpConn = socketUDP
+
+	return socketUDP, nil
 }
 
-// Loop through the new Membership and update the timestamps in the current node.
-func processNewMembershipList(newMembership *MembershipList) {
-	for i := 0; i < len(newMembership.List); i++ {
-		nextHostname := newMembership.List[i]
-		newPingTime := newMembership.Data[nextHostname]
-
-		// If it finds a node that is not in the data map, add it to list and map
-		if pingTime, contains := Membership.Data[nextHostname]; !contains {
-			log.Infof("Added %s to membership list!", nextHostname)
-			Membership.Data[nextHostname] = newPingTime
-
-			Membership.List = append(Membership.List, nextHostname)
-			sort.Strings(Membership.List)
-
-			// If the new Membership has a more recent time, update it
-		} else if math.Abs(float64(pingTime)) < math.Abs(float64(newPingTime)) {
-			Membership.Data[nextHostname] = newPingTime
-
-			// If the hostname is not in the list but it's in the data map,
-			// it was removed from the list because it faile or left, and
-			// we just recieved a new time indicating that it's rejoining.
-			currTime := time.Now().UnixNano() / int64(time.Millisecond)
-			if findHostnameIndex(nextHostname) >= len(Membership.List) &&
-				currTime-newPingTime < NODE_FAIL_TIMEOUT {
-
-				Membership.List = append(Membership.List, nextHostname)
-				sort.Strings(Membership.List)
-				log.Infof("Recieved updated time from node %s. Adding back to list", nextHostname)
-			}
+// Marks the node as having left the network. The leave is gossiped out with the next probes
+func (node *Node) Leave() {
+	node.swimMutex.Lock()
+	defer node.swimMutex.Unlock()
 
-			// This will only happen if the node has left the network
-		} else if newPingTime < 0 {
-			Membership.Data[nextHostname] = -1 * newMembership.Data[nextHostname]
-		}
-	}
+	node.Membership.members[node.ID].State = MEMBER_LEFT
+	node.queueBroadcast(node.selfUpdate())
 }
 
-// Search that will find the index of the hostname in the list
-func findHostnameIndex(hostName string) int {
-	for i := 0; i < len(Membership.List); i++ {
-		if Membership.List[i] == hostName {
-			return i
-		}
+// Returns the state of a member as seen by this node. Members it never heard of count as failed
+func (node *Node) MemberState(memberName string) MemberState {
+	node.swimMutex.Lock()
+	defer node.swimMutex.Unlock()
+
+	if member, known := node.Membership.members[memberName]; known {
+		return member.State
 	}
 
-	return len(Membership.List)
+	return MEMBER_FAILED
+}
+
+// Checks if a member may be alive. Unlike MemberState, members this node never heard of count as
+// alive, since they may have joined through another node that already knows them
+func (node *Node) mayBeAlive(memberName string) bool {
+	node.swimMutex.Lock()
+	defer node.swimMutex.Unlock()
+
+	member, known := node.Membership.members[memberName]
+	return !known || member.State.IsActive()
 }
@@ -2,71 +2,137 @@ package server
 
 import (
 	log "github.com/sirupsen/logrus"
-	"io/ioutil"
 	"os"
 	"os/exec"
-	"runtime"
+	"path/filepath"
+	"strconv"
 )
 
 var JUICE_EXE_FOLDER_NAME string = "mapleExe"
 var JUICE_OUTPUT_FILE_NAME string = "reducerOutputFile.txt"
 
-func JuiceWorkerManager() {
-	hostname, _ := os.Hostname()
-	
-	for {
-		// If there is no mapleJuice request or if the top request is not a maple request
-		if len(Membership.MJQueue) == 0 || Membership.MJQueue[0].Command != "Juice" {
-			runtime.Gosched()
+// Folder in the sdfs the reducer output of every juice task is put in until the job is written
+// out. Every job has its own folder in it, which is removed once the job is completed
+var JUICE_OUTPUT_FOLDER_NAME string = "juiceOutputs"
+
+// Sleeps while there is no work, like the MapleWorkerManager
+func (node *Node) JuiceWorkerManager() {
+	events, _ := node.SubscribeMembership()
+	for !node.isStopped() {
+		changed := node.Log.Changed()
+
+		if node.isPaused() {
+			node.waitForChange(changed, events, MANAGER_RETRY_INTERVAL)
+			continue
+		}
+
+		// If there is no mapleJuice request or if the top request is not a juice request
+		mjQueue := node.Queues().MJQueue
+		if len(mjQueue) == 0 || mjQueue[0].Command != "Juice" {
+			node.waitForChange(changed, events, 0)
+			continue
+		}
+
+		job := mjQueue[0]
+		progress := node.workerProgress(job.ID)
+		master := node.getMaster()
+		if master == "" || master == node.ID || (!node.isWorker(master) && len(progress.Processed) == 0) {
+			node.waitForChange(changed, events, 0)
 			continue
 		}
 
-		workerCount := GetWorkerCount()
-		if (hostname == Membership.List[0] || hostname > Membership.List[workerCount]) {
-			runtime.Gosched()
+		// Outputs are sent until a master accepts them
+		if len(progress.Unreported) != 0 {
+			node.sendOutputs(master, progress)
+			if len(progress.Unreported) != 0 {
+				node.waitForChange(changed, events, MANAGER_RETRY_INTERVAL)
+			}
+
 			continue
 		}
 
 		// Make RPC call to get files
-		os.Remove(Membership.MJQueue[0].FileDirectory)
-		saveName := Membership.MJQueue[0].FileDirectory
-		fileList := CallRequestJuiceFilesRPC(Membership.List[0], hostname)
-		if len(fileList) == 0 {
-			runtime.Gosched()
+		response := CallRequestJuiceFilesRPC(master, node.masterRequestArgs(job.ID, progress.Processed, nil))
+		if len(response.Files) == 0 || node.isStaleMaster(response.MasterTerm) {
+			node.waitForChange(changed, events, MANAGER_RETRY_INTERVAL)
 			continue
 		}
 
-		exePath := getExePath(Membership.MJQueue[0].ExeName)
-		runReducer(exePath, fileList, saveName)
-		sendOutputFile(saveName)
+		exePath := node.getExePath(JUICE_EXE_FOLDER_NAME, job.ExeName)
+		node.runReducer(exePath, response.Files, progress)
+		if len(progress.Unreported) != 0 {
+			node.sendOutputs(master, progress)
+		}
 	}
 }
 
-// Gets the path of the exe, will fetch it if it doesnt exist
-func getExePath(exeName string) (string) {
-	exePath := JUICE_EXE_FOLDER_NAME + "/" + exeName
+// Gets the path of the newest version of the exe, will fetch it if it doesnt exist. Every version
+// is kept in its own folder under its own name, so a job uses the exe that was put last
+func (node *Node) getExePath(exeFolder string, exeName string) string {
+	metadata, _ := node.FileMetadata(exeName)
+	versionFolder := node.dataPath(exeFolder, strconv.Itoa(metadata.Version))
+	exePath := filepath.Join(versionFolder, localName(exeName))
 	if _, err := os.Stat(exePath); os.IsNotExist(err) {
-		FetchFile(exeName, JUICE_EXE_FOLDER_NAME)
+		os.MkdirAll(versionFolder, 0777)
+		node.FetchFile(exeName, exePath)
 	}
 
 	return exePath
 }
 
-// Runs the reducer for all the files in the filelist
-func runReducer(exePath string, fileList []string, saveName string) {
+// Runs the reducer for all the files in the filelist, keeping the output of each file apart in its
+// own file in the sdfs. Files the reducer fails on, or whose output could not be stored, are not
+// reported, so the master hands them out again
+func (node *Node) runReducer(exePath string, fileList []string, progress *WorkerProgress) {
+	outputPath := node.dataPath(JUICE_OUTPUT_FILE_NAME)
 	for _, fileName := range fileList {
-		filePath := MAPLE_TEMP_FOLDER_NAME + "/" + fileName
+		filePath := node.dataPath(MAPLE_TEMP_FOLDER_NAME, fileName)
+		os.Remove(outputPath)
 
-		mapCommand := exec.Command("go", "run", exePath, filePath, saveName)
+		mapCommand := exec.Command("go", "run", exePath, filePath, outputPath)
 		err := mapCommand.Run()
 		if err != nil {
 			log.Infof("Error %s", err)
+			continue
+		}
+
+		output, err := node.storeTaskOutput(progress.JobID, outputPath)
+		if err != nil {
+			log.Infof("Could not store the output of %s! %s", fileName, err)
+			continue
 		}
+		progress.Outputs[fileName] = output
+		progress.Processed = append(progress.Processed, fileName)
+		progress.Unreported = append(progress.Unreported, fileName)
+	}
+
+	os.Remove(outputPath)
+}
+
+// Puts the reducer output of a task in the folder of its job in the sdfs, under a name of its own
+// so a task that is done again does not replace the output the master already accepted. An empty
+// output is not stored
+func (node *Node) storeTaskOutput(jobID string, outputPath string) (TaskOutput, error) {
+	checksum, size, err := FileChecksumAt(outputPath)
+	if err != nil || size == 0 {
+		return TaskOutput{}, err
 	}
+
+	output := TaskOutput{FileName: jobOutputFolder(jobID) + PATH_SEPARATOR + newTransferID(), Checksum: checksum}
+	err = AppendFile(append([]string{node.ID}, node.Membership.List()...), outputPath, output.FileName, "")
+	return output, err
+}
+
+// Returns the folder in the sdfs the reducer outputs of a job are put in
+func jobOutputFolder(jobID string) string {
+	return JUICE_OUTPUT_FOLDER_NAME + PATH_SEPARATOR + FileChecksum([]byte(jobID))[:16]
 }
 
-// Sends the data to the master to append to the final output file
-func sendOutputFile(saveName string) {
-	fileContents, _ := ioutil.ReadFile(saveName)
-	CallAppendResultRPC(Membership.List[0], fileContents)
-}
\ No newline at end of file
+// Sends where the outputs are stored to the master, which keeps them until every key was reduced
+func (node *Node) sendOutputs(master string, progress *WorkerProgress) {
+	args := node.masterRequestArgs(progress.JobID, progress.Unreported, progress.Outputs)
+	if CallAppendResultRPC(master, args) {
+		progress.Unreported = nil
+		progress.Outputs = map[string]TaskOutput{}
+	}
+}
@@ -2,82 +2,191 @@ package server
 
 import (
 	log "github.com/sirupsen/logrus"
+	"io"
 	"os"
-	"runtime"
-	"time"
-	"sync"
 )
 
-var JuiceFileList []string
-var JuiceAssignmentMap map[string][]string
+// Added to the ID of a juice job to make the ID of the append of its output
+var JOB_OUTPUT_SUFFIX string = "/output"
 
-var JuiceMutex sync.Mutex
-
-func JuiceMasterManager() {
-	hostname, _ := os.Hostname()
-	JuiceMutex.Lock()
+func (node *Node) JuiceMasterManager() {
+	// The leader of the replicated log is the master node. Workers are refused until the master
+	// checkpointed the keys of the job
+LEADER_CHECK:
+	var masterTerm uint64
+	var job *MapleJuiceRequest
+	for {
+		if node.isStopped() {
+			return
+		}
 
-	LEADER_CHECK: for {
-		if Membership.List[0] == hostname && len(Membership.MJQueue) != 0 && Membership.MJQueue[0].Command == "Juice" {
-			log.Info("Juice request detected and the current node is the master node!")
+		changed := node.Log.Changed()
+		term, isLeader := node.Log.LeaderTerm()
+		mjQueue := node.Queues().MJQueue
+		if isLeader && len(mjQueue) != 0 && mjQueue[0].Command == "Juice" {
+			log.Infof("Juice request detected and the current node is the master node for term %d!", term)
+			masterTerm = term
+			job = mjQueue[0]
 			break
 		}
 
-		runtime.Gosched()
+		node.waitForChange(changed, nil, 0)
 	}
 
-	JuiceFileList = CallGrossFindDir(Membership.List[1])
-	JuiceAssignmentMap = map[string][]string{}
-	JuiceMutex.Unlock()
+	if !node.planJob(job, node.findKeyFiles) {
+		node.waitForChange(nil, nil, MANAGER_RETRY_INTERVAL)
+		goto LEADER_CHECK
+	}
 
-	for {
-		// If a lower node is added back to the Membership list, this node stops being the master
-		if Membership.List[0] != hostname {
-			log.Info("A lower ID node has joined! Current node no longer the master!")
-			goto LEADER_CHECK
+	// An output that can never be written fails the job, which is removed so the jobs after it
+	// run. The input is kept then, so the job can be submitted again with another destination
+	retry := false
+	node.superviseJob(job, masterTerm, func(progress *JobProgress) {
+		err := node.writeJobOutput(job, progress)
+		if isPermanentOutputError(err) {
+			log.Infof("Juice request %s failed, its output can not be written to %s! %s", job.ID, job.FileDirectory, err)
+			node.removeJobOutputs(job)
+			node.completeJob(job)
+			return
 		}
+		if err != nil {
+			log.Infof("Could not write the output of job %s, trying again! %s", job.ID, err)
+			retry = true
+			return
+		}
+
+		if job.DeleteInput {
+			log.Infof("Deleting temp folder!")
+			node.deleteFolder(masterTerm)
+		}
+
+		node.removeJobOutputs(job)
+		node.completeJob(job)
+		log.Infof("Juice request has been completed!")
+	})
+
+	if retry {
+		node.waitForChange(nil, nil, MANAGER_RETRY_INTERVAL)
+	}
+	goto LEADER_CHECK
+}
+
+// Checks if the output of a job failed because of its destination, which does not change when
+// the output is written again
+func isPermanentOutputError(err error) bool {
+	return err == ErrInvalidName || err == ErrIsDirectory || err == ErrNotDirectory
+}
+
+// Finds the intermediate key files of the last maple job. Every maple worker sends its aggregate
+// map to all other nodes, so the first worker that answers can list them
+func (node *Node) findKeyFiles(job *MapleJuiceRequest) ([]string, bool) {
+	for _, worker := range node.getWorkers(node.ID) {
+		if fileList, success := CallGrossFindDir(worker); success {
+			return fileList, true
+		}
+	}
+
+	return []string{}, false
+}
 
-		detectJuiceWorkerFailures()
-		if len(JuiceFileList) == 0 {
-			if Membership.MJQueue[0].DeleteInput {
-				log.Infof("Deleting temp folder!")
-				go deleteFolder()
-			}
+// Appends the output of every key of a finished juice job to its destination file in the sdfs.
+// The output of every task is read from the file its worker put it in, and gathered in MJOut.txt
+// first. The append is made under an ID of the job, so writing the same job again after a crash
+// or a lost leadership does not add a second copy
+func (node *Node) writeJobOutput(job *MapleJuiceRequest, progress *JobProgress) error {
+	outputPath := node.dataPath(MAPLEJUICE_OUTPUT_FILE_NAME)
+	fileDes, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(outputPath)
 
-			Membership.MJQueue = Membership.MJQueue[1:]
-			Membership.MapleJuiceUTime = time.Now().UnixNano() / int64(time.Millisecond)
+	taskPath := outputPath + ".task"
+	defer os.Remove(taskPath)
+	for _, task := range progress.Tasks {
+		output := progress.Outputs[task]
+		if output.FileName == "" {
+			continue
+		}
 
-			log.Infof("Juice request has been completed!")			
-			goto LEADER_CHECK	
+		err = node.fetchTaskOutput(output, taskPath)
+		if err == nil {
+			err = appendLocalFile(fileDes, taskPath)
+		}
+		if err != nil {
+			log.Infof("Could not read the output of %s from %s! %s", task, output.FileName, err)
+			fileDes.Close()
+			return err
 		}
 	}
+	err = fileDes.Close()
+	if err != nil {
+		return err
+	}
 
-	runtime.Gosched()
+	return AppendFile(append([]string{node.ID}, node.Membership.List()...), outputPath, job.FileDirectory, job.ID+JOB_OUTPUT_SUFFIX)
 }
 
-// Detects worker failures
-func detectJuiceWorkerFailures() {
-	workerCount := GetWorkerCount()
-	currentWorkerMap := map[string]int{}
-	for i := 0; i <= workerCount; i++ {
-		currentWorkerMap[Membership.List[i]] = 0
+// Downloads the reducer output of a task from READ_QUORUM of its replicas. The file has to match
+// the checksum the worker reported, so an output that was changed since is not used
+func (node *Node) fetchTaskOutput(output TaskOutput, localPath string) error {
+	metadata, found := node.FileMetadata(output.FileName)
+	fileVersion, _ := metadata.FindVersion(metadata.Version)
+	if !found || fileVersion.Checksum != output.Checksum {
+		return ErrFetchFailed
+	}
+
+	hostList, err := ReadQuorum(output.FileName, fileVersion.Version, fileVersion.Replicas)
+	if err != nil {
+		return err
+	}
+	if !FetchVersion(hostList, output.FileName, fileVersion, localPath) {
+		return ErrFetchFailed
 	}
 
-	for workerName, processedFiles := range JuiceAssignmentMap {
-		if _, contains := currentWorkerMap[workerName]; !contains {
-			currTime := time.Now().UnixNano() / int64(time.Millisecond)
-			if Membership.Data[workerName] - currTime > WORKER_TIMEOUT {
-				log.Infof("Detected that worker %s has failed! Reassigning those files", workerName)
-				JuiceFileList = append(JuiceFileList, processedFiles...)
-				delete(JuiceAssignmentMap, workerName)
-			}
+	return nil
+}
+
+// Helper that copies a local file to the end of an open file
+func appendLocalFile(fileDes *os.File, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.CopyBuffer(fileDes, file, make([]byte, CHUNK_SIZE))
+	return err
+}
+
+// Deletes the reducer outputs of a job from the sdfs once it is completed, along with the folder
+// they were put in. Outputs that are not deleted stay in the folder
+func (node *Node) removeJobOutputs(job *MapleJuiceRequest) {
+	folder := jobOutputFolder(job.ID)
+	fileList, _, _ := node.ListDirectory(folder, true)
+	for _, fileName := range fileList {
+		metadata, blocks, found := node.FileBlocks(fileName)
+		if !found {
+			continue
+		}
+
+		err := node.deleteFile(metadata, blocks)
+		if err != nil {
+			log.Infof("Could not delete the output %s of job %s! %s", fileName, job.ID, err)
 		}
 	}
+
+	if _, _, found := node.ListDirectory(folder, false); found {
+		node.removeDir(folder)
+	}
+	if _, _, found := node.ListDirectory(JUICE_OUTPUT_FOLDER_NAME, false); found {
+		node.removeDir(JUICE_OUTPUT_FOLDER_NAME)
+	}
 }
 
-// Helper that deletes a folder
-func deleteFolder() {
-	for i := 0; i < len(Membership.List); i++ {
-		CallDeleteFolder(Membership.List[i])
+// Helper that deletes a folder. Nodes that know of a newer term than masterTerm refuse
+func (node *Node) deleteFolder(masterTerm uint64) {
+	for _, member := range node.Membership.List() {
+		CallDeleteFolder(member, masterTerm)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,352 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The local file metadata is kept in LOCAL_METADATA_FOLDER_NAME as a snapshot and a log of the
+// changes made since. The log is compacted into the snapshot once it has LOCAL_SNAPSHOT_ENTRIES
+// entries
+var LOCAL_METADATA_FOLDER_NAME string = "localMetadata"
+var LOCAL_SNAPSHOT_FILE_NAME string = "snapshot.json"
+var LOCAL_LOG_FILE_NAME string = "log.jsonl"
+var LOCAL_SNAPSHOT_ENTRIES int = 1000
+
+// Changes of the local file metadata that are written to the log
+const (
+	LOCAL_STORE_FILE     = "StoreFile"
+	LOCAL_STORE_VERSION  = "StoreVersion"
+	LOCAL_REMOVE_VERSION = "RemoveVersion"
+	LOCAL_REMOVE_FILE    = "RemoveFile"
+	LOCAL_FILE_GROUP     = "FileGroup"
+)
+
+// An entry of the log. A store sets the fileGroup of the file and its UpdateTime, a store of a
+// version also records when the version was stored, and a change of the fileGroup only sets it
+type localFileEntry struct {
+	Type       string
+	FileName   string
+	FileGroup  []string
+	Version    int
+	StoredAt   time.Time
+	UpdateTime int64
+}
+
+type localFileSnapshot struct {
+	Files       map[string][]string
+	Versions    map[string]map[int]time.Time
+	UpdateTimes map[string]int64
+}
+
+// Loads the local file metadata a node persisted in metadataDir and checks it against the versions
+// in serverDir, which are what the node really stores. Versions that are missing on disk are
+// forgotten, and versions that are on disk but not in the metadata, since the node crashed before
+// the change was logged, are added without a fileGroup until the node reconciles them with the
+// cluster. Changes are logged from then on
+func openLocalFileSystem(metadataDir string, serverDir string) (*LocalFileSystem, error) {
+	localFiles := newLocalFileSystem()
+	localFiles.dir = metadataDir
+
+	err := os.MkdirAll(metadataDir, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	err = localFiles.load()
+	if err != nil {
+		return nil, err
+	}
+
+	err = localFiles.checkDisk(serverDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(localFiles.files) != 0 {
+		log.Infof("Recovered the metadata of %d local files", len(localFiles.files))
+	}
+
+	err = localFiles.compact()
+	if err != nil {
+		return nil, err
+	}
+
+	return localFiles, nil
+}
+
+// Reads the snapshot and applies the entries of the log. A log line that was only partly written
+// before a crash ends the log
+func (localFiles *LocalFileSystem) load() error {
+	snapshotContents, err := ioutil.ReadFile(localFiles.path(LOCAL_SNAPSHOT_FILE_NAME))
+	if err == nil {
+		snapshot := localFileSnapshot{}
+		err = json.Unmarshal(snapshotContents, &snapshot)
+		if err != nil {
+			return err
+		}
+
+		for fileName, fileGroup := range snapshot.Files {
+			localFiles.files[fileName] = fileGroup
+		}
+		for fileName, versions := range snapshot.Versions {
+			localFiles.versions[fileName] = versions
+		}
+		for fileName, updateTime := range snapshot.UpdateTimes {
+			localFiles.updateTimes[fileName] = updateTime
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	logFile, err := os.Open(localFiles.path(LOCAL_LOG_FILE_NAME))
+	if err == nil {
+		scanner := bufio.NewScanner(logFile)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for scanner.Scan() {
+			entry := localFileEntry{}
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+				break
+			}
+
+			localFiles.apply(entry)
+		}
+		logFile.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Applies an entry of the log. The caller must hold the mutex
+func (localFiles *LocalFileSystem) apply(entry localFileEntry) {
+	switch entry.Type {
+	case LOCAL_STORE_FILE, LOCAL_STORE_VERSION:
+		localFiles.files[entry.FileName] = entry.FileGroup
+		localFiles.updateTimes[entry.FileName] = entry.UpdateTime
+		if entry.Type == LOCAL_STORE_VERSION {
+			if localFiles.versions[entry.FileName] == nil {
+				localFiles.versions[entry.FileName] = map[int]time.Time{}
+			}
+			localFiles.versions[entry.FileName][entry.Version] = entry.StoredAt
+		}
+
+	case LOCAL_FILE_GROUP:
+		if _, contains := localFiles.files[entry.FileName]; contains {
+			localFiles.files[entry.FileName] = entry.FileGroup
+		}
+
+	case LOCAL_REMOVE_VERSION:
+		localFiles.removeVersion(entry.FileName, entry.Version)
+
+	case LOCAL_REMOVE_FILE:
+		localFiles.remove(entry.FileName)
+	}
+}
+
+// Makes the metadata match the versions stored in serverDir
+func (localFiles *LocalFileSystem) checkDisk(serverDir string) error {
+	dirFiles, err := ioutil.ReadDir(serverDir)
+	if err != nil {
+		return err
+	}
+
+	onDisk := map[string]map[int]bool{}
+	for _, file := range dirFiles {
+		fileName, version, valid := parseLocalName(file.Name())
+		if !valid || file.IsDir() {
+			continue
+		}
+
+		if onDisk[fileName] == nil {
+			onDisk[fileName] = map[int]bool{}
+		}
+		onDisk[fileName][version] = true
+
+		if _, contains := localFiles.versions[fileName][version]; !contains {
+			log.Infof("Version %d of file %s is on disk but not in the local metadata, adding it", version, fileName)
+			if _, contains := localFiles.files[fileName]; !contains {
+				localFiles.files[fileName] = []string{}
+				localFiles.updateTimes[fileName] = file.ModTime().UnixNano() / int64(time.Millisecond)
+			}
+			if localFiles.versions[fileName] == nil {
+				localFiles.versions[fileName] = map[int]time.Time{}
+			}
+			localFiles.versions[fileName][version] = file.ModTime()
+		}
+	}
+
+	for fileName, versions := range localFiles.versions {
+		for version := range versions {
+			if !onDisk[fileName][version] {
+				log.Infof("Version %d of file %s is not on disk anymore, forgetting it", version, fileName)
+				localFiles.removeVersion(fileName, version)
+			}
+		}
+	}
+	for fileName := range localFiles.files {
+		if len(localFiles.versions[fileName]) == 0 {
+			localFiles.remove(fileName)
+		}
+	}
+
+	return nil
+}
+
+// Returns the sdfs name and the version of a file in serverFiles, or false if it is not a version
+// of an sdfs file
+func parseLocalName(name string) (string, int, bool) {
+	delimiter := strings.LastIndex(name, VERSION_DELIMITER)
+	if delimiter == -1 {
+		return "", 0, false
+	}
+
+	version, err := strconv.Atoi(name[delimiter+len(VERSION_DELIMITER):])
+	if err != nil || version < 1 {
+		return "", 0, false
+	}
+
+	fileName, err := url.PathUnescape(name[:delimiter])
+	if err != nil || fileName == "" {
+		return "", 0, false
+	}
+
+	return fileName, version, true
+}
+
+// Appends a change to the log, and compacts the log once it is long enough. The log is not synced
+// on every change, a version that was stored but not logged is found again on disk. The caller
+// must hold the mutex
+func (localFiles *LocalFileSystem) persist(entry localFileEntry) {
+	if localFiles.logFile == nil {
+		return
+	}
+
+	entryContents, _ := json.Marshal(entry)
+	_, err := localFiles.logFile.Write(append(entryContents, '\n'))
+	if err != nil {
+		log.Infof("Could not persist the local file metadata! %s", err)
+		return
+	}
+
+	localFiles.logEntries++
+	if localFiles.logEntries >= LOCAL_SNAPSHOT_ENTRIES {
+		localFiles.compact()
+	}
+}
+
+// Writes the whole metadata as the snapshot and starts a new log. The caller must hold the mutex
+func (localFiles *LocalFileSystem) compact() error {
+	if localFiles.logFile != nil {
+		localFiles.logFile.Close()
+		localFiles.logFile = nil
+	}
+
+	snapshot := localFileSnapshot{Files: localFiles.files, Versions: localFiles.versions, UpdateTimes: localFiles.updateTimes}
+	snapshotContents, _ := json.Marshal(snapshot)
+	err := writeFileAtomic(localFiles.path(LOCAL_SNAPSHOT_FILE_NAME), snapshotContents)
+	if err == nil {
+		err = writeFileAtomic(localFiles.path(LOCAL_LOG_FILE_NAME), []byte{})
+	}
+	if err == nil {
+		localFiles.logFile, err = os.OpenFile(localFiles.path(LOCAL_LOG_FILE_NAME), os.O_APPEND|os.O_WRONLY, 0666)
+	}
+	if err != nil {
+		log.Infof("Could not persist the local file metadata! %s", err)
+	}
+	localFiles.logEntries = 0
+
+	return err
+}
+
+// Closes the log once the node is killed. Changes made afterwards are not persisted
+func (localFiles *LocalFileSystem) close() {
+	localFiles.mutex.Lock()
+	defer localFiles.mutex.Unlock()
+
+	if localFiles.logFile != nil {
+		localFiles.logFile.Close()
+		localFiles.logFile = nil
+	}
+}
+
+func (localFiles *LocalFileSystem) path(fileName string) string {
+	return filepath.Join(localFiles.dir, fileName)
+}
+
+// Brings the files this node recovered from disk in line with the metadata directory, once the
+// node caught up with the replicated log. Files the node is still a replica of get the replicas of
+// the directory as their fileGroup, so the node serves them again and their fileMaster moves them
+// as usual. Files that were copied to other replicas while the node was down are dropped, and so
+// are versions that are not kept and can not be committed anymore, since they were deleted or
+// replaced while the node was down. Files that were stored since the node started are left as
+// they are
+func (node *Node) reconcileLocalFiles() {
+	started := time.Now()
+	recovered := node.LocalFiles.Files()
+	if len(recovered) == 0 {
+		return
+	}
+
+	// An entry is only applied after every entry before it, so once this one is the directory is
+	// as new as the log of the leader
+	for node.proposeCommand(RaftCommand{Type: RAFT_NOOP}) != nil {
+		if node.isStopped() {
+			return
+		}
+	}
+
+	restored, dropped := 0, 0
+	queues := node.Queues()
+	for fileName := range recovered {
+		if node.LocalFiles.storedSince(fileName, started) {
+			continue
+		}
+
+		metadata, committed := node.FileMetadata(fileName)
+		for _, version := range node.LocalFiles.Versions(fileName) {
+			if _, kept := metadata.FindVersion(version); !kept && !queues.hasUpload(fileName, version) {
+				log.Infof("Version %d of file %s was dropped from the metadata directory while this node was down", version, fileName)
+				node.deleteLocalVersion(fileName, version)
+			}
+		}
+		if !committed || len(node.LocalFiles.Versions(fileName)) == 0 {
+			continue
+		}
+
+		if containsMember(metadata.Replicas, node.ID) {
+			node.LocalFiles.Store(fileName, metadata.Replicas, node.mayBeAlive)
+			restored++
+		} else {
+			log.Infof("File %s was moved to %v while this node was down, dropping it", fileName, metadata.Replicas)
+			node.deleteLocalFile(fileName)
+			dropped++
+		}
+	}
+
+	log.Infof("Reconciled the local files with the metadata directory, %d restored and %d dropped", restored, dropped)
+	node.placeFiles()
+}
+
+// Checks if a version of the file was stored after the given time
+func (localFiles *LocalFileSystem) storedSince(fileName string, since time.Time) bool {
+	localFiles.mutex.RLock()
+	defer localFiles.mutex.RUnlock()
+
+	for _, storedAt := range localFiles.versions[fileName] {
+		if storedAt.After(since) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Helper that opens the local file metadata persisted in a data directory
+func openTestLocalFiles(t *testing.T, dataDir string) *LocalFileSystem {
+	localFiles, err := openLocalFileSystem(filepath.Join(dataDir, LOCAL_METADATA_FOLDER_NAME), filepath.Join(dataDir, SERVER_FOLDER_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(localFiles.close)
+
+	return localFiles
+}
+
+// Helper that writes a version of a file to the server folder of a data directory
+func writeServerFile(t *testing.T, dataDir string, fileName string, version int) {
+	node := &Node{DataDir: dataDir}
+	err := ioutil.WriteFile(node.versionPath(fileName, version), []byte(fileName), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Helper that returns what the local file metadata knows about every file
+func localFilesState(localFiles *LocalFileSystem) map[string][]int {
+	state := map[string][]int{}
+	for fileName := range localFiles.Files() {
+		state[fileName] = localFiles.Versions(fileName)
+	}
+
+	return state
+}
+
+// The changes logged before a restart are replayed on top of the snapshot, and a change that was
+// only partly written ends the log
+func TestLocalFilesReplay(t *testing.T) {
+	defer func(snapshotEntries int) { LOCAL_SNAPSHOT_ENTRIES = snapshotEntries }(LOCAL_SNAPSHOT_ENTRIES)
+	LOCAL_SNAPSHOT_ENTRIES = 4
+
+	dataDir := t.TempDir()
+	os.MkdirAll(filepath.Join(dataDir, SERVER_FOLDER_NAME), 0777)
+	keep := func(member string) bool { return member != "n4" }
+
+	localFiles := openTestLocalFiles(t, dataDir)
+	for _, version := range []int{1, 2, 3} {
+		writeServerFile(t, dataDir, "a.txt", version)
+		localFiles.StoreVersion("a.txt", version, []string{"n1", "n2", "n4"}, keep)
+	}
+	writeServerFile(t, dataDir, "b/c.txt", 1)
+	localFiles.StoreVersion("b/c.txt", 1, []string{"n1", "n3"}, keep)
+	localFiles.RemoveVersion("a.txt", 1)
+	localFiles.filterFileGroups(func(member string) bool { return member != "n3" })
+	os.Remove((&Node{DataDir: dataDir}).versionPath("a.txt", 1))
+	localFiles.close()
+
+	logPath := filepath.Join(dataDir, LOCAL_METADATA_FOLDER_NAME, LOCAL_LOG_FILE_NAME)
+	logFile, _ := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0666)
+	logFile.WriteString(`{"Type":"RemoveFile","FileName":"a.t`)
+	logFile.Close()
+
+	recovered := openTestLocalFiles(t, dataDir)
+	if state := localFilesState(recovered); !reflect.DeepEqual(state, map[string][]int{"a.txt": {3, 2}, "b/c.txt": {1}}) {
+		t.Fatalf("Recovered %v", state)
+	}
+	if fileGroup, _ := recovered.FileGroup("a.txt"); !reflect.DeepEqual(fileGroup, []string{"n1", "n2"}) {
+		t.Fatalf("Recovered fileGroup %v of a.txt", fileGroup)
+	}
+	if fileGroup, _ := recovered.FileGroup("b/c.txt"); !reflect.DeepEqual(fileGroup, []string{"n1"}) {
+		t.Fatalf("Recovered fileGroup %v of b/c.txt", fileGroup)
+	}
+}
+
+// Versions that are missing on disk are forgotten, and versions on disk that were never logged
+// are added without a fileGroup
+func TestLocalFilesCheckDisk(t *testing.T) {
+	dataDir := t.TempDir()
+	os.MkdirAll(filepath.Join(dataDir, SERVER_FOLDER_NAME), 0777)
+
+	localFiles := openTestLocalFiles(t, dataDir)
+	writeServerFile(t, dataDir, "a.txt", 1)
+	localFiles.StoreVersion("a.txt", 1, []string{"n1"}, func(member string) bool { return true })
+	localFiles.StoreVersion("gone.txt", 1, []string{"n1"}, func(member string) bool { return true })
+	localFiles.close()
+	writeServerFile(t, dataDir, "a.txt", 2)
+	writeServerFile(t, dataDir, "new.txt", 4)
+	ioutil.WriteFile(filepath.Join(dataDir, SERVER_FOLDER_NAME, "notAVersion"), nil, 0666)
+
+	recovered := openTestLocalFiles(t, dataDir)
+	if state := localFilesState(recovered); !reflect.DeepEqual(state, map[string][]int{"a.txt": {2, 1}, "new.txt": {4}}) {
+		t.Fatalf("Recovered %v", state)
+	}
+	if fileGroup, contains := recovered.FileGroup("new.txt"); !contains || len(fileGroup) != 0 {
+		t.Fatalf("Version that was not logged was recovered with fileGroup %v", fileGroup)
+	}
+}
+
+// Once the node caught up with the log, the files it recovered get the replicas of the directory
+// as their fileGroup. Files moved to other replicas and versions that are not kept are dropped
+func TestReconcileLocalFiles(t *testing.T) {
+	dataDir := t.TempDir()
+	node, err := NewNode("127.0.0.1:25061", dataDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []struct {
+		name    string
+		version int
+	}{{"a.txt", 1}, {"moved.txt", 1}, {"b.txt", 2}, {"b.txt", 3}, {"deleted.txt", 1}} {
+		writeServerFile(t, dataDir, file.name, file.version)
+	}
+	node.Kill()
+	node.Log.close()
+
+	restarted, err := NewNode("127.0.0.1:25061", dataDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Kill()
+	defer restarted.Log.close()
+	restarted.Log.voters = []string{restarted.ID}
+	restarted.Log.isVoter = true
+	proposePuts(t, restarted.Log)
+
+	for _, file := range []FileMetadata{
+		{Name: "a.txt", Version: 1, Replicas: []string{restarted.ID, "n2"}},
+		{Name: "moved.txt", Version: 1, Replicas: []string{"n2", "n3"}},
+		{Name: "b.txt", Version: 2, Replicas: []string{restarted.ID}},
+	} {
+		file := file
+		_, err := restarted.Log.Propose(RaftCommand{Type: RAFT_PUT_FILE, Time: time.Now(), File: &file})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restarted.reconcileLocalFiles()
+	if state := localFilesState(restarted.LocalFiles); !reflect.DeepEqual(state, map[string][]int{"a.txt": {1}, "b.txt": {2}}) {
+		t.Fatalf("Reconciled the local files to %v", state)
+	}
+	if fileGroup, _ := restarted.LocalFiles.FileGroup("a.txt"); !reflect.DeepEqual(fileGroup, []string{restarted.ID, "n2"}) {
+		t.Fatalf("Reconciled fileGroup %v, expected the replicas in the directory", fileGroup)
+	}
+	if _, err := os.Stat(restarted.versionPath("moved.txt", 1)); !os.IsNotExist(err) {
+		t.Fatal("File that was moved to other replicas was not deleted")
+	}
+}
@@ -1,16 +1,15 @@
 package server
 
 import (
-	log "github.com/sirupsen/logrus"
 	"bufio"
+	log "github.com/sirupsen/logrus"
 	"io"
 	"io/ioutil"
-	"math/rand"
 	"os"
 	"os/exec"
-	"runtime"
+	"path/filepath"
 	"strings"
-	"time"
+	"sync"
 )
 
 var MAPLE_EXE_FOLDER_NAME string = "mapleExe"
@@ -18,62 +17,128 @@ var MAPLE_TEMP_FOLDER_NAME string = "mapleTempOutputs"
 var MAPPER_OUTPUT_FILE_NAME string = "mapperOutputFile.txt"
 var MAPPER_AGGREGATE_FILE_NAME string = "mapperAggregateOutput.txt"
 
-var ProcessedFiles []string
+// Every line of an aggregate map is tagged with the job and the file it was mapped from. A file
+// that was mapped again after its worker failed reaches the other nodes a second time, so every
+// node marks the files whose output it added in MAPLE_TASKS_FOLDER_NAME and skips them after that
+var MAPLE_TASKS_FOLDER_NAME string = "mapleTempTasks"
+
+// Progress of this node as a worker of the MapleJuice job at the head of the queue. Processed
+// are all the tasks it did for the job, Aggregated the maple files in the local aggregate map
+// that was not sent out yet, and Unreported the tasks the master did not accept yet, along with
+// their juice Outputs
+type WorkerProgress struct {
+	JobID      string
+	Processed  []string
+	Aggregated []string
+	Unreported []string
+	Outputs    map[string]TaskOutput
+}
 
-func MapleWorkerManager() {
-	ProcessedFiles = []string{}
-	hostname, _ := os.Hostname()
-	hasBroadcasted := false
+// Sleeps until the replicated log or the membership list changes while there is no work. Files
+// that are released by failed workers are checkpointed in the log, so idle workers wake up for them
+func (node *Node) MapleWorkerManager() {
+	events, _ := node.SubscribeMembership()
+	for !node.isStopped() {
+		changed := node.Log.Changed()
+
+		// A paused node is not woken when it resumes, so it checks again after a while
+		if node.isPaused() {
+			node.waitForChange(changed, events, MANAGER_RETRY_INTERVAL)
+			continue
+		}
 
-	for {
 		// If there is no mapleJuice request or if the top request is not a maple request
-		if len(Membership.MJQueue) == 0 || Membership.MJQueue[0].Command != "Maple" {
-			runtime.Gosched()
+		mjQueue := node.Queues().MJQueue
+		if len(mjQueue) == 0 || mjQueue[0].Command != "Maple" {
+			node.waitForChange(changed, events, 0)
+			continue
+		}
+
+		// Check if the current server is within the lowest ProcessCount servers other than the master,
+		// or if it has files of this job to finish
+		job := mjQueue[0]
+		progress := node.workerProgress(job.ID)
+		master := node.getMaster()
+		if master == "" || master == node.ID || (!node.isWorker(master) && len(progress.Processed) == 0) {
+			node.waitForChange(changed, events, 0)
 			continue
 		}
 
-		// Check if the current server is within the lowert ProcessCount servers or the master node
-		workerCount := GetWorkerCount()
-		if (hostname == Membership.List[0] || hostname > Membership.List[workerCount]) {
-			runtime.Gosched()
+		// Files whose aggregate map was sent out are reported until a master accepts them
+		if len(progress.Unreported) != 0 {
+			args := node.masterRequestArgs(job.ID, progress.Unreported, nil)
+			if CallProcessedMapOutputRPC(master, args) {
+				progress.Unreported = nil
+			} else {
+				node.waitForChange(changed, events, MANAGER_RETRY_INTERVAL)
+			}
+
 			continue
 		}
 
-		// Ask the server for next file to process. If the time is the same, there was nothing new
-		response := CallProcessFileRPC(Membership.List[0], hostname)
-		if response.Done && hasBroadcasted {
-			runtime.Gosched()
+		// Ask the master for the next file to process
+		response, success := CallProcessFileRPC(master, node.masterRequestArgs(job.ID, progress.Processed, nil))
+		if !success || node.isStaleMaster(response.MasterTerm) {
+			node.waitForChange(changed, events, MANAGER_RETRY_INTERVAL)
 			continue
 		}
 
 		// If the fileName is empty, there are no more files to process, send the map to other workers
 		if response.FileName == "" {
-			log.Info("Processing the local aggregate map")
-			go ProcessAggregateMap(MAPPER_AGGREGATE_FILE_NAME)
-			log.Info("Sending out the aggregate map!")
-			sendAggregateMap(workerCount)
-			os.Remove(MAPPER_AGGREGATE_FILE_NAME)
-			hasBroadcasted = true
-
-			CallProcessedMapOutputRPC(Membership.List[0], hostname)			
-			runtime.Gosched()
+			if len(progress.Aggregated) != 0 {
+				log.Info("Processing the local aggregate map")
+				node.ProcessAggregateMap(node.dataPath(MAPPER_AGGREGATE_FILE_NAME))
+				log.Info("Sending out the aggregate map!")
+				node.sendAggregateMap()
+				os.Remove(node.dataPath(MAPPER_AGGREGATE_FILE_NAME))
+
+				progress.Unreported = progress.Aggregated
+				progress.Aggregated = nil
+				continue
+			}
+
+			node.waitForChange(changed, events, MANAGER_RETRY_INTERVAL)
 			continue
-		} 
+		}
 
 		log.Infof("Recieved file %s to process from the master!", response.FileName)
-		ProcessedFiles = append(ProcessedFiles, response.FileName)
-		exeName := Membership.MJQueue[0].ExeName
-		exePath, filePath := fetchFiles(response.FileName, exeName)
-		aggregateMapperFile(exePath, filePath)
-		runtime.Gosched()
+		exePath, filePath := node.fetchFiles(response.FileName, job.ExeName)
+		err := node.aggregateMapperFile(exePath, filePath, mapleTaskTag(job.ID, response.FileName))
+		if err != nil {
+			log.Infof("Could not process file %s! %s", response.FileName, err)
+			node.waitForChange(changed, events, MANAGER_RETRY_INTERVAL)
+			continue
+		}
+
+		progress.Processed = append(progress.Processed, response.FileName)
+		progress.Aggregated = append(progress.Aggregated, response.FileName)
 	}
 }
 
+// Returns the progress of this node on a job. The progress and the aggregate map of an earlier
+// job are dropped
+func (node *Node) workerProgress(jobID string) *WorkerProgress {
+	node.workerMutex.Lock()
+	defer node.workerMutex.Unlock()
+
+	if node.worker == nil || node.worker.JobID != jobID {
+		os.Remove(node.dataPath(MAPPER_AGGREGATE_FILE_NAME))
+		node.worker = &WorkerProgress{JobID: jobID, Outputs: map[string]TaskOutput{}}
+	}
+
+	return node.worker
+}
+
 // Simple function the get the number of workers. Export it because other files use it too
-func GetWorkerCount() (int) {
-	processCount := Membership.MJQueue[0].ProcessCount
-	maxWorkers := len(Membership.List) - 1
-	
+func (node *Node) GetWorkerCount() int {
+	mjQueue := node.Queues().MJQueue
+	if len(mjQueue) == 0 {
+		return 0
+	}
+
+	processCount := mjQueue[0].ProcessCount
+	maxWorkers := node.Membership.Len() - 1
+
 	if processCount < maxWorkers {
 		return processCount
 	} else {
@@ -82,107 +147,184 @@ func GetWorkerCount() (int) {
 }
 
 // Helper that will fetch the exe and process file if needed and return their relative paths
-func fetchFiles(fileName string, exeName string) (exePath string, filePath string) {
-	exePath = MAPLE_EXE_FOLDER_NAME + "/" +exeName
-	if _, err := os.Stat(exePath); os.IsNotExist(err) {
-		FetchFile(exeName, MAPLE_EXE_FOLDER_NAME)
-	}
+func (node *Node) fetchFiles(fileName string, exeName string) (exePath string, filePath string) {
+	exePath = node.getExePath(MAPLE_EXE_FOLDER_NAME, exeName)
 
-	if _, contains := LocalFiles.Files[fileName]; contains {
-		filePath = SERVER_FOLDER_NAME + "/" + fileName
+	metadata, _ := node.FileMetadata(fileName)
+	if node.verifyVersion(metadata, metadata.Version) {
+		filePath = node.versionPath(fileName, metadata.Version)
 	} else {
-		FetchFile(fileName, LOCAL_FOLDER_NAME)
-		filePath = LOCAL_FOLDER_NAME + "/" + fileName
+		filePath = node.dataPath(LOCAL_FOLDER_NAME, localName(fileName))
+		node.FetchFile(fileName, filePath)
 	}
 
 	log.Info("Exe and file to process are stored locally!")
 	return exePath, filePath
 }
 
-// Function that will make a call to fetch a file from the sdsf and stoes it in the specified fileDest
-func FetchFile(fileName string, fileDest string) {
+// Function that will make a call to fetch the newest version of a file from the sdsf and stores it
+// at filePath
+func (node *Node) FetchFile(fileName string, filePath string) {
 	log.Infof("Fetching file %s", fileName)
-	response, _ := CallFileSystemRPC(Membership.List[0], "ClientRequest.Get", fileName)
+	metadata, blocks, success := node.FileBlocks(fileName)
+	fileVersion, _ := metadata.FindVersion(metadata.Version)
+	if success && len(fileVersion.Blocks) != 0 {
+		if err := FetchBlocks(blocks, fileName, fileVersion, filePath); err != nil {
+			log.Infof("Could not fetch the blocks of file %s! %s", fileName, err)
+		}
+		return
+	}
 
-	rand.Seed(time.Now().UnixNano())
-	fileLocationHost := response.HostList[rand.Intn(len(response.HostList))]
-	request := &FileTransferRequest{
-		FileName:  fileName,
-		FileGroup: nil,
-		Data:      nil,
+	if !success || len(metadata.Replicas) == 0 {
+		log.Infof("Could not find file %s to fetch!", fileName)
+		return
 	}
-	transferResponse := CallFileTransferRPC(fileLocationHost, "FileTransfer.GetFile", request)
 
-	filePath := fileDest + "/" + fileName
-	err := ioutil.WriteFile(filePath, transferResponse, 0666)
-	if err != nil {
-		log.Fatalf("Unable to write bytes from get!", err)
+	// Replicas are tried in a random order, since some of them may have failed. A download that
+	// fails is resumed on the next replica
+	if !FetchVersion(RandomOrder(metadata.Replicas), fileName, fileVersion, filePath) {
+		log.Infof("Could not fetch file %s from any of its replicas!", fileName)
 	}
 }
 
-// This function will call exec and sort the file and will then append it to the aggregate file
-func aggregateMapperFile(exePath string, filePath string) {
-	mapCommand := exec.Command("go", "run", exePath, filePath, MAPPER_OUTPUT_FILE_NAME)
-	mapCommand.Run()
+// This function will call exec and sort the file and will then append it to the aggregate file,
+// every line tagged with taskTag. If the mapper fails nothing is added, and the master hands out
+// the file again
+func (node *Node) aggregateMapperFile(exePath string, filePath string, taskTag string) error {
+	mapperOutputPath := node.dataPath(MAPPER_OUTPUT_FILE_NAME)
+	mapperAggregatePath := node.dataPath(MAPPER_AGGREGATE_FILE_NAME)
 
-	sortOutCommand := exec.Command("sort", "-o", MAPPER_OUTPUT_FILE_NAME, MAPPER_OUTPUT_FILE_NAME)
+	mapCommand := exec.Command("go", "run", exePath, filePath, mapperOutputPath)
+	err := mapCommand.Run()
+	if err != nil {
+		os.Remove(mapperOutputPath)
+		return err
+	}
+
+	sortOutCommand := exec.Command("sort", "-o", mapperOutputPath, mapperOutputPath)
 	sortOutCommand.Run()
 
-	fileContents, _ := ioutil.ReadFile(MAPPER_OUTPUT_FILE_NAME)
-	fileDes, _ := os.OpenFile(MAPPER_AGGREGATE_FILE_NAME, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
-	fileDes.Write(fileContents)
+	mapperOutput, _ := os.Open(mapperOutputPath)
+	fileDes, _ := os.OpenFile(mapperAggregatePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
+	writer := bufio.NewWriter(fileDes)
+	scanner := bufio.NewScanner(mapperOutput)
+	for scanner.Scan() {
+		writer.WriteString(taskTag + " " + scanner.Text() + "\n")
+	}
+	writer.Flush()
 	fileDes.Close()
-	os.Remove(MAPPER_OUTPUT_FILE_NAME)
+	mapperOutput.Close()
+	os.Remove(mapperOutputPath)
 
-	sortAggregateCommand := exec.Command("sort", "-o", MAPPER_AGGREGATE_FILE_NAME, MAPPER_AGGREGATE_FILE_NAME)
+	sortAggregateCommand := exec.Command("sort", "-o", mapperAggregatePath, mapperAggregatePath)
 	sortAggregateCommand.Run()
 
 	log.Info("Finished writing commands!")
+	return nil
 }
 
-// Sends the aggregate map stored at this machine to others for processing
-func sendAggregateMap(workerCount int) {
-	hostname, _ := os.Hostname()
-	fileContents, _ := ioutil.ReadFile(MAPPER_AGGREGATE_FILE_NAME)
-
-	request := &FileTransferRequest{
-		FileName: hostname,
-		FileGroup: []string{},
-		Data: fileContents,
+// Streams the aggregate map stored at this machine to others for processing, and waits until they
+// processed it
+func (node *Node) sendAggregateMap() {
+	hostname := node.ID
+	aggregatePath := node.dataPath(MAPPER_AGGREGATE_FILE_NAME)
+	checksum, _, err := FileChecksumAt(aggregatePath)
+	if err != nil {
+		log.Infof("Could not read the aggregate map! %s", err)
+		return
 	}
 
-	// This will send it to all the other nodes in the system, not just other workers
-	for i := 1; i < len(Membership.List); i++ {
-		if Membership.List[i] == hostname {
+	// This will send it to all the other nodes in the system, not just other workers, so any node
+	// can be a juice worker or master later
+	var sendGroup sync.WaitGroup
+	for _, member := range node.Membership.List() {
+		if member == hostname {
 			continue
 		}
 
-		go CallFileTransferRPC(Membership.List[i], "FileTransfer.AppendData", request)
+		sendGroup.Add(1)
+		go func(member string) {
+			defer sendGroup.Done()
+			streamFile(member, "FileTransfer.AppendChunk", aggregatePath, FileChunk{FileName: hostname, Checksum: checksum})
+		}(member)
 	}
+	sendGroup.Wait()
 }
 
-// Process the mapleOutput file and seperate it out into pre intermediate files
+// Process the mapleOutput file and seperate it out into pre intermediate files. The output of
+// files this node already has from another aggregate map is skipped
 // RPC will also use this function so we need to export it
-func ProcessAggregateMap(filePath string) {
+func (node *Node) ProcessAggregateMap(filePath string) {
+	node.mapleOutputMutex.Lock()
+	defer node.mapleOutputMutex.Unlock()
+
 	mapleOutputFileDes, _ := os.Open(filePath)
+	defer mapleOutputFileDes.Close()
 	scanner := bufio.NewScanner(mapleOutputFileDes)
 
 	currentKey := ""
 	var openedFile *os.File
+	processed := map[string]bool{}
 
 	// Loop through each line in the file and create files based on each key in the aggregate map file
-	for scanner.Scan()  {
-		line := scanner.Text()
+	for scanner.Scan() {
+		taggedLine := strings.SplitN(scanner.Text(), " ", 2)
+		if len(taggedLine) != 2 || len(strings.Fields(taggedLine[1])) == 0 {
+			continue
+		}
+
+		taskTag, line := taggedLine[0], taggedLine[1]
+		if _, checked := processed[taskTag]; !checked {
+			processed[taskTag] = node.hasMapleTask(taskTag)
+			if processed[taskTag] {
+				log.Infof("The output of %s was processed before, skipping it", taskTag)
+			}
+		}
+		if processed[taskTag] {
+			continue
+		}
+
 		outputKey := strings.Fields(line)[0]
 
 		if currentKey != outputKey {
 			openedFile.Close()
 
 			currentKey = outputKey
-			filePath := MAPLE_TEMP_FOLDER_NAME + "/" + currentKey + ".txt"
+			filePath := node.dataPath(MAPLE_TEMP_FOLDER_NAME, currentKey+".txt")
 			openedFile, _ = os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
 		}
 
-		io.WriteString(openedFile, line + "\n")
+		io.WriteString(openedFile, line+"\n")
 	}
-}
\ No newline at end of file
+	openedFile.Close()
+
+	for taskTag, processedBefore := range processed {
+		if !processedBefore {
+			node.markMapleTask(taskTag)
+		}
+	}
+}
+
+// Returns the tag of the lines a file of a maple job is mapped to. The file and the job are
+// escaped, so the tag has no spaces and the job is its only folder
+func mapleTaskTag(jobID string, fileName string) string {
+	return localName(jobID) + "/" + localName(fileName)
+}
+
+// Checks if the output of the tagged file was added to the intermediate files of this node
+func (node *Node) hasMapleTask(taskTag string) bool {
+	_, err := os.Stat(node.dataPath(MAPLE_TASKS_FOLDER_NAME, taskTag))
+	return err == nil
+}
+
+// Marks the output of the tagged file as added to the intermediate files of this node
+func (node *Node) markMapleTask(taskTag string) {
+	markerPath := node.dataPath(MAPLE_TASKS_FOLDER_NAME, taskTag)
+	err := os.MkdirAll(filepath.Dir(markerPath), 0777)
+	if err == nil {
+		err = ioutil.WriteFile(markerPath, []byte{}, 0666)
+	}
+	if err != nil {
+		log.Infof("Could not mark the output of %s as processed! %s", taskTag, err)
+	}
+}
@@ -2,177 +2,172 @@ package server
 
 import (
 	log "github.com/sirupsen/logrus"
-	"net"
-	"net/rpc"
-	"net/http"
-	"os"
-	"runtime"
-	"sync"
-	"time"
+	"sort"
 )
 
-var MapleFileList []string
-var FileAssignmentMap map[string][]string
-var WorkerResponses map[string]bool
+func (node *Node) MapleMasterManager() {
+	go node.rpcListener(&ExecuteMapleJuice{node: node}, MAPLEJUICE_RPC_PORT)
 
-var WORKER_TIMEOUT int64 = 6000
-var ProcessFileMutex sync.Mutex
-
-func MapleMasterManager() {
-	ProcessFileMutex.Lock()
-	go mapleJuiceRequestListener()
+	// The leader of the replicated log is the master node, for as long as it leads the same term.
+	// Workers are refused until the master checkpointed the files of the job
+LEADER_CHECK:
+	var masterTerm uint64
+	var job *MapleJuiceRequest
+	for {
+		if node.isStopped() {
+			return
+		}
 
-	// If this node becomes the lowest, ID, it becomes the master node
-	hostname, _ := os.Hostname()
-	LEADER_CHECK: for {
-		if Membership.List[0] == hostname && len(Membership.MJQueue) != 0  && Membership.MJQueue[0].Command == "Maple" {
-			log.Info("Maple request detected and the current node is the master node!")
+		changed := node.Log.Changed()
+		term, isLeader := node.Log.LeaderTerm()
+		mjQueue := node.Queues().MJQueue
+		if isLeader && len(mjQueue) != 0 && mjQueue[0].Command == "Maple" {
+			log.Infof("Maple request detected and the current node is the master node for term %d!", term)
+			masterTerm = term
+			job = mjQueue[0]
 			break
 		}
 
-		runtime.Gosched()
+		node.waitForChange(changed, nil, 0)
 	}
 
-	FileAssignmentMap = getProcessedFileMap()
-	MapleFileList = findFileList()
-	WorkerResponses = map[string]bool{}
-
-	finishedProcessingFiles := false
-	ProcessFileMutex.Unlock()
-	log.Infof("Master got file list! Unlocking mutex.")
-
-	for {
-		// If a lower node is added back to the Membership list, this node stops being the master
-		if Membership.List[0] != hostname {
-			log.Info("A lower ID node has joined! Current node no longer the master!")
+	if !node.planJob(job, node.findFileList) {
+		// The input directory was removed after the job was submitted. The job can never run, so
+		// it fails instead of holding up the queue
+		if files, _, found := node.ListDirectory(job.FileDirectory, true); !found || len(files) == 0 {
+			log.Infof("Maple request %s failed, directory %s has no files!", job.ID, job.FileDirectory)
+			node.completeJob(job)
 			goto LEADER_CHECK
 		}
 
-		detectWorkerFailures()
-		if !finishedProcessingFiles && len(MapleFileList) == 0 {
-			finishedProcessingFiles = true
-			log.Info("Finished scheduling files to be processed!")
-		}
+		node.waitForChange(nil, nil, MANAGER_RETRY_INTERVAL)
+		goto LEADER_CHECK
+	}
+	log.Infof("Master got file list!")
+
+	// Once every worker sent out the aggregate map of its files, they are all in the sdfs
+	node.superviseJob(job, masterTerm, func(progress *JobProgress) {
+		node.completeJob(job)
+		log.Infof("Maple request has been completed!")
+	})
+	goto LEADER_CHECK
+}
 
-		// If all workers have sent out their aggregate mapper outputs, tell them to move them to the SDFS
-		if checkWorkerResponses() {
-			// broadcastFinishRequest(filePrefix)
+// Watches a job for as long as this node is the master of masterTerm. The tasks of workers are
+// handed out again when the workers fail, and finish is called once every task is done
+func (node *Node) superviseJob(job *MapleJuiceRequest, masterTerm uint64, finish func(progress *JobProgress)) {
+	events, unsubscribe := node.SubscribeMembership()
+	defer unsubscribe()
 
-			Membership.MJQueue = Membership.MJQueue[1:]
-			Membership.MapleJuiceUTime = time.Now().UnixNano() / int64(time.Millisecond)
+	// Workers that failed before the subscription, or this node if it was a worker
+	if progress := node.Queues().Progress[job.ID]; progress != nil {
+		node.detectWorkerFailures(job.ID, progress)
+	}
 
-			log.Infof("Maple request has been completed!")			
-			goto LEADER_CHECK	
+	for !node.isStopped() {
+		changed := node.Log.Changed()
+
+		// If another node was elected, this node stops being the master
+		if !node.Log.IsLeader(masterTerm) {
+			log.Info("A new leader was elected! Current node no longer the master!")
+			return
+		}
+
+		progress := node.Queues().Progress[job.ID]
+		if progress == nil {
+			return
+		}
+
+		if progress.isDone() {
+			finish(progress)
+			return
 		}
 
-		runtime.Gosched()
+		// Progress is only made through the replicated log, and workers only fail through the
+		// membership list
+		select {
+		case <-changed:
+		case event := <-events:
+			if event.IsRemoval() {
+				node.detectWorkerFailures(job.ID, progress)
+			}
+		case <-node.stop:
+		}
 	}
 }
 
-// Goroutine that will listen for incoming RPC requests made to the Maple Juice main server
-func mapleJuiceRequestListener() {
-	server := rpc.NewServer()
-	mapleJuiceRequestRPC := new(ExecuteMapleJuice)
-	err := server.Register(mapleJuiceRequestRPC)
-	if err != nil {
-		log.Fatalf("Format of service ClientRequest isn't correct. %s", err)
+// Checkpoints the tasks of a job, unless an earlier master already did. In that case the job
+// continues from the checkpoint and finished tasks are not done again
+func (node *Node) planJob(job *MapleJuiceRequest, findTasks func(job *MapleJuiceRequest) ([]string, bool)) bool {
+	if progress := node.Queues().Progress[job.ID]; progress != nil {
+		log.Infof("Continuing job %s, %d of %d tasks are done", job.ID, len(progress.Completed), len(progress.Tasks))
+		return true
 	}
 
-	oldMux := http.DefaultServeMux
-    mux := http.NewServeMux()
-    http.DefaultServeMux = mux
-	server.HandleHTTP(rpc.DefaultRPCPath, rpc.DefaultDebugPath)
-	http.DefaultServeMux = oldMux
-
-	listener, _ := net.Listen("tcp", ":"+MAPLEJUICE_RPC_PORT)
-	http.Serve(listener, mux)
-}
-
-// Function that will query the worker nodes to see what files they have finished processing
-func getProcessedFileMap() (map[string][]string) {
-	processedFiles := map[string][]string{}
+	tasks, success := findTasks(job)
+	if !success {
+		log.Infof("Could not find the tasks of job %s!", job.ID)
+		return false
+	}
 
-	workerCount := GetWorkerCount()
-	for i := 1; i <= workerCount; i++ {
-		nodeName := Membership.List[i]
-		fileList := CallGetProcessedFilesRPC(nodeName)
-		processedFiles[nodeName] = fileList
+	err := node.proposeCommand(RaftCommand{Type: RAFT_PLAN_JOB, ID: job.ID, Tasks: tasks})
+	if err != nil {
+		log.Infof("Could not checkpoint the tasks of job %s! %s", job.ID, err)
+		return false
 	}
 
-	return processedFiles
+	return true
 }
 
-// Finds the files in the filesystem in the specified directory in the request
-func findFileList() (fileList []string) {
-	fileMap := map[string]int{}
-
-	for _, node := range Membership.List {
-		findDirResponse := CallFindDirectoryRPC(node, Membership.MJQueue[0].FileDirectory)
-
-		for _, responseNode := range findDirResponse {
-			fileMap[responseNode] = 0
+// Removes a finished job from the job queue. Keeps trying while there is no leader, since the
+// job would be started again if it stayed in the queue
+func (node *Node) completeJob(job *MapleJuiceRequest) {
+	for !node.isStopped() {
+		err := node.proposeCommand(RaftCommand{Type: RAFT_COMPLETE_JOB, ID: job.ID})
+		if err == nil {
+			return
 		}
-	}
 
-	// Remove files in the fileMap that were already in the FileAssignmentMap
-	for _, finishedFiles := range FileAssignmentMap {
-		for _, file := range finishedFiles {
-			if _, contains := fileMap[file]; contains {
-				delete(fileMap, file)
-			}
-		}
+		log.Infof("Could not remove job %s from the job queue! %s", job.ID, err)
 	}
+}
 
-	for file, _ := range fileMap {
-		fileList = append(fileList, file)
+// Finds the files in the filesystem in the specified directory in the request. Files that are
+// split into blocks are handed out one block at a time. Fails if the directory is missing or has
+// no files
+func (node *Node) findFileList(job *MapleJuiceRequest) (fileList []string, success bool) {
+	fileList = []string{}
+	for _, fileName := range node.findDirectory(job.FileDirectory) {
+		fileList = append(fileList, node.fileTasks(fileName)...)
+	}
+	if len(fileList) == 0 {
+		return fileList, false
 	}
 
-	return fileList
+	sort.Strings(fileList)
+	return fileList, true
 }
 
-// This will check to see if any of the worker nodes have failes and will add the files at
-// The failed node to be reprocessed again
-func detectWorkerFailures() {
-	workerCount := GetWorkerCount()
-	currentWorkerMap := map[string]int{}
-	for i := 0; i <= workerCount; i++ {
-		currentWorkerMap[Membership.List[i]] = 0
-	}
+// This will check to see if any of the worker nodes have failed and will release the tasks they
+// did not finish, so they are handed out to other workers. A worker that became the master does
+// not work on its tasks anymore, so they are released too
+func (node *Node) detectWorkerFailures(jobID string, progress *JobProgress) {
+	failedWorkers := map[string]bool{}
+	for task, workerName := range progress.Assigned {
+		if progress.Completed[task] {
+			continue
+		}
 
-	for workerName, processedFiles := range FileAssignmentMap {
-		if _, contains := currentWorkerMap[workerName]; !contains {
-			currTime := time.Now().UnixNano() / int64(time.Millisecond)
-			if Membership.Data[workerName] - currTime > WORKER_TIMEOUT {
-				log.Infof("Detected that worker %s has failed! Reassigning those files", workerName)
-				MapleFileList = append(MapleFileList, processedFiles...)
-				delete(FileAssignmentMap, workerName)
-			}
+		if workerName == node.ID || !node.MemberState(workerName).IsActive() {
+			failedWorkers[workerName] = true
 		}
 	}
-}
 
-// This will check if the master has recieved OKs from all workers. If it did, it will tell
-// All workers to move the temp files to the sdfs and update their fileGroups
-func checkWorkerResponses() (bool) {
-	workerCount := GetWorkerCount()
-	for i := 1; i <= workerCount; i++ {
-		workerHostname := Membership.List[i]
-		if _, contains := WorkerResponses[workerHostname]; !contains {
-			return false
+	for workerName := range failedWorkers {
+		log.Infof("Worker %s has failed or became the master! Reassigning those files", workerName)
+		err := node.proposeCommand(RaftCommand{Type: RAFT_RELEASE_TASKS, ID: jobID, Worker: workerName})
+		if err != nil {
+			log.Infof("Could not reassign the files of worker %s! %s", workerName, err)
 		}
 	}
-
-	return true
 }
-
-// The master will broadcast to all worker nodes to move the files to the SDFS and update the filesystem
-// func broadcastFinishRequest() {
-// 	log.Info("Master broadcasting finish request!")
-// 	filePrefix := Membership.MJQueue[0].FilePrefix
-// 	workerNodes := Membership.List
-// 	// filePrefix := Membership.MJQueue[0].FilePrefix
-// 	for _, woker := range workerNodes{
-// 		CallUploadKeyFilesRPC(woker, filePrefix)
-// 	}
-// 	log.Info("done")
-// }
\ No newline at end of file
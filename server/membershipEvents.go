@@ -0,0 +1,139 @@
+package server
+
+import (
+	"sync"
+)
+
+// Kinds of membership changes a subscriber is told about
+type MembershipEventType int
+
+const (
+	EVENT_MEMBER_JOINED MembershipEventType = iota
+	EVENT_MEMBER_SUSPECTED
+	EVENT_MEMBER_ALIVE
+	EVENT_MEMBER_LEFT
+	EVENT_MEMBER_FAILED
+)
+
+func (eventType MembershipEventType) String() string {
+	switch eventType {
+	case EVENT_MEMBER_JOINED:
+		return "Joined"
+	case EVENT_MEMBER_SUSPECTED:
+		return "Suspected"
+	case EVENT_MEMBER_ALIVE:
+		return "Alive"
+	case EVENT_MEMBER_LEFT:
+		return "Left"
+	case EVENT_MEMBER_FAILED:
+		return "Failed"
+	}
+
+	return "Unknown"
+}
+
+// A change of one member of the membership list. Joined is sent whenever a member is added to the
+// list, also when a removed member comes back with a higher incarnation. Alive is sent when a
+// member refuted a suspicion
+type MembershipEvent struct {
+	Type        MembershipEventType
+	Node        string
+	Incarnation uint64
+}
+
+// Checks if the event removed the member from the membership list
+func (event MembershipEvent) IsRemoval() bool {
+	return event.Type == EVENT_MEMBER_LEFT || event.Type == EVENT_MEMBER_FAILED
+}
+
+// One subscriber. Events wait in pending until the subscriber reads them, so the failure
+// detector never blocks on a slow subscriber
+type membershipSubscription struct {
+	events  chan MembershipEvent
+	wake    chan struct{}
+	done    chan struct{}
+	mutex   sync.Mutex
+	pending []MembershipEvent
+}
+
+// Subscribes to the changes of the membership list. Events are delivered in the order they
+// happened on the returned channel, which is closed once the subscription ends. Calling the
+// returned function ends the subscription, and it also ends when the node is killed.
+func (node *Node) SubscribeMembership() (<-chan MembershipEvent, func()) {
+	subscription := &membershipSubscription{
+		events: make(chan MembershipEvent),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	node.subscriberMutex.Lock()
+	node.subscribers = append(node.subscribers, subscription)
+	node.subscriberMutex.Unlock()
+
+	go node.deliverEvents(subscription)
+
+	var unsubscribeOnce sync.Once
+	unsubscribe := func() {
+		unsubscribeOnce.Do(func() {
+			node.subscriberMutex.Lock()
+			for i, other := range node.subscribers {
+				if other == subscription {
+					node.subscribers = append(node.subscribers[:i:i], node.subscribers[i+1:]...)
+					break
+				}
+			}
+			node.subscriberMutex.Unlock()
+
+			close(subscription.done)
+		})
+	}
+
+	return subscription.events, unsubscribe
+}
+
+// Hands an event to every subscriber without waiting for them to read it
+func (node *Node) publishEvent(event MembershipEvent) {
+	node.subscriberMutex.Lock()
+	defer node.subscriberMutex.Unlock()
+
+	for _, subscription := range node.subscribers {
+		subscription.mutex.Lock()
+		subscription.pending = append(subscription.pending, event)
+		subscription.mutex.Unlock()
+
+		select {
+		case subscription.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Goroutine that moves the pending events of a subscription to its channel
+func (node *Node) deliverEvents(subscription *membershipSubscription) {
+	defer close(subscription.events)
+
+	for {
+		select {
+		case <-subscription.wake:
+		case <-subscription.done:
+			return
+		case <-node.stop:
+			return
+		}
+
+		subscription.mutex.Lock()
+		pending := subscription.pending
+		subscription.pending = nil
+		subscription.mutex.Unlock()
+
+		for _, event := range pending {
+			select {
+			case subscription.events <- event:
+			case <-subscription.done:
+				return
+			case <-node.stop:
+				return
+			}
+		}
+	}
+}
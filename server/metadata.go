@@ -0,0 +1,578 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Files that are stored on this node but not in the metadata directory this long after they were
+// stored are dropped. They are left over from a put that was never committed or a delete this node
+// did not hear about
+var ORPHAN_FILE_TIMEOUT time.Duration = time.Minute
+
+var ErrStaleVersion = errors.New("a newer version of the file was put first")
+var ErrNoQuorum = errors.New("could not reach a quorum of the replicas")
+var ErrNoServer = errors.New("could not connect to any server")
+var ErrFileBusy = errors.New("another put of the file is still running")
+
+// Puts of a file are made one at a time. A put holds the file until it is committed or given up,
+// or until PUT_LEASE_TIMEOUT passed, so a client that failed does not hold it forever. A put that
+// finds the file held waits up to PUT_WAIT_TIMEOUT for it
+var PUT_LEASE_TIMEOUT time.Duration = time.Minute
+var PUT_WAIT_TIMEOUT time.Duration = 30 * time.Second
+
+// Files that were updated less than CONFLICT_WINDOW ago are only overwritten once the user confirms
+var CONFLICT_WINDOW time.Duration = time.Minute
+
+// Number of versions of every file that are kept. Older versions are dropped from the replicas
+var NUM_VERSIONS int = 5
+
+// Entry of the metadata directory. Every node has the whole directory in its replicated log, so
+// any server can answer where a file is stored without asking the others. Size, Version and
+// Checksum are those of the newest version, and Updated is when it was committed. Versions holds
+// the kept versions, newest first. Blocks lists the blocks a version is split into, a version
+// without blocks is stored under the name of the file. Entries are never changed once they are
+// applied, a change replaces the entry
+type FileMetadata struct {
+	Name     string
+	Replicas []string
+	Size     int64
+	Version  int
+	Checksum string
+	Updated  time.Time
+	Blocks   []string
+	Versions []FileVersion
+}
+
+// A kept version of a file. Replicas are the servers that store it, which stay the same when newer
+// versions are put on other servers. A version that is split into blocks is stored on the replicas
+// of its blocks
+type FileVersion struct {
+	Version  int
+	Size     int64
+	Checksum string
+	Blocks   []string
+	Replicas []string
+}
+
+// A put that has a version but is not stored on its replicas yet. Started is when the put reserved
+// the file or last renewed its lease
+type FileUpload struct {
+	FileName string
+	Version  int
+	Started  time.Time
+	Aborted  bool
+}
+
+// Returns the checksum that is stored with the contents of a file
+func FileChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the checksum and the size of a file on disk, reading it one chunk at a time
+func FileChecksumAt(filePath string) (string, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.CopyBuffer(hash, file, make([]byte, CHUNK_SIZE))
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// Returns a copy of the metadata directory with the entry of a file replaced, or removed if nil
+func (queues *RequestQueues) updateFiles(fileName string, metadata *FileMetadata) map[string]*FileMetadata {
+	next := map[string]*FileMetadata{}
+	for name, fileMetadata := range queues.Files {
+		next[name] = fileMetadata
+	}
+
+	if metadata == nil {
+		delete(next, fileName)
+	} else {
+		next[fileName] = metadata
+	}
+
+	return next
+}
+
+// Returns the metadata with a new newest version, dropping the versions past NUM_VERSIONS. The
+// metadata may be nil for a file that is not in the directory yet
+func (metadata *FileMetadata) addVersion(file *FileMetadata) *FileMetadata {
+	next := &FileMetadata{
+		Name:     file.Name,
+		Replicas: file.Replicas,
+		Size:     file.Size,
+		Version:  file.Version,
+		Checksum: file.Checksum,
+		Updated:  file.Updated,
+		Blocks:   file.Blocks,
+		Versions: []FileVersion{{Version: file.Version, Size: file.Size, Checksum: file.Checksum, Blocks: file.Blocks}},
+	}
+	if len(file.Blocks) == 0 {
+		next.Versions[0].Replicas = file.Replicas
+	}
+	if metadata != nil {
+		next.Versions = append(next.Versions, metadata.Versions...)
+
+		// A version that is split into blocks is not stored under the name of the file, so the
+		// older versions stay on their replicas
+		if len(file.Blocks) != 0 {
+			next.Replicas = metadata.Replicas
+		}
+	}
+	if len(next.Versions) > NUM_VERSIONS {
+		next.Versions = next.Versions[:NUM_VERSIONS]
+	}
+
+	return next
+}
+
+// Returns the metadata with only the versions keep returns true for, or nil if none are left
+func (metadata *FileMetadata) keepVersions(keep func(version int) bool) *FileMetadata {
+	versions := []FileVersion{}
+	for _, fileVersion := range metadata.Versions {
+		if keep(fileVersion.Version) {
+			versions = append(versions, fileVersion)
+		}
+	}
+	if len(versions) == 0 {
+		return nil
+	}
+	if len(versions) == len(metadata.Versions) {
+		return metadata
+	}
+
+	next := *metadata
+	next.Versions = versions
+	next.Version = versions[0].Version
+	next.Size = versions[0].Size
+	next.Checksum = versions[0].Checksum
+	next.Blocks = versions[0].Blocks
+	return &next
+}
+
+// Returns a copy of the metadata with the given versions stored on the replicas. The other versions
+// are only left on those of their replicas that are still among them, since the servers that are
+// not drop their copies of the file
+func (metadata *FileMetadata) moveVersions(versions []int, replicas []string) *FileMetadata {
+	next := *metadata
+	next.Versions = []FileVersion{}
+	for _, fileVersion := range metadata.Versions {
+		if len(fileVersion.Blocks) == 0 {
+			moved := false
+			for _, version := range versions {
+				moved = moved || version == fileVersion.Version
+			}
+			if moved {
+				fileVersion.Replicas = replicas
+			} else {
+				fileVersion.Replicas = commonMembers(fileVersion.Replicas, replicas)
+			}
+		}
+		next.Versions = append(next.Versions, fileVersion)
+	}
+
+	return &next
+}
+
+// Returns the members of the first list that are also in the second one
+func commonMembers(members []string, others []string) []string {
+	common := []string{}
+	for _, member := range members {
+		if containsMember(others, member) {
+			common = append(common, member)
+		}
+	}
+
+	return common
+}
+
+// Returns a kept version of the file, or false if it was dropped or never put
+func (metadata FileMetadata) FindVersion(version int) (FileVersion, bool) {
+	for _, fileVersion := range metadata.Versions {
+		if fileVersion.Version == version {
+			return fileVersion, true
+		}
+	}
+
+	return FileVersion{}, false
+}
+
+// Returns the version the next put of a file gets, after the newest version and every put of the
+// file that is not stored yet
+func (queues *RequestQueues) nextVersion(fileName string) int {
+	version := 1
+	if current := queues.Files[fileName]; current != nil {
+		version = current.Version + 1
+	}
+	for _, upload := range queues.Uploads {
+		if upload.FileName == fileName && upload.Version >= version {
+			version = upload.Version + 1
+		}
+	}
+
+	return version
+}
+
+// Returns a copy of the uploads with the given one added
+func (queues *RequestQueues) addUpload(uploadID string, upload *FileUpload) map[string]*FileUpload {
+	next := map[string]*FileUpload{uploadID: upload}
+	for id, fileUpload := range queues.Uploads {
+		next[id] = fileUpload
+	}
+
+	return next
+}
+
+// Returns a copy of the uploads without the puts of a file up to the given version. They can not
+// be added anymore once a newer version is, so puts that were given up on are dropped with them
+func (queues *RequestQueues) dropUploads(fileName string, version int) map[string]*FileUpload {
+	next := map[string]*FileUpload{}
+	for id, upload := range queues.Uploads {
+		if upload.FileName != fileName || upload.Version > version {
+			next[id] = upload
+		}
+	}
+
+	return next
+}
+
+// Returns a copy of the uploads with a put of a file marked as given up, so it does not hold the
+// file anymore. The put keeps its version, so no later put gets the same one
+func (queues *RequestQueues) abortUpload(fileName string, version int) map[string]*FileUpload {
+	next := map[string]*FileUpload{}
+	for id, upload := range queues.Uploads {
+		if upload.FileName == fileName && upload.Version == version && !upload.Aborted {
+			aborted := *upload
+			aborted.Aborted = true
+			upload = &aborted
+		}
+		next[id] = upload
+	}
+
+	return next
+}
+
+// Returns a copy of the uploads with the lease of a put of a file renewed at the given time, if
+// the put still holds the file
+func (queues *RequestQueues) renewUpload(fileName string, version int, now time.Time) map[string]*FileUpload {
+	next := map[string]*FileUpload{}
+	for id, upload := range queues.Uploads {
+		if upload.FileName == fileName && upload.Version == version && upload.holds(now) && now.After(upload.Started) {
+			renewed := *upload
+			renewed.Started = now
+			upload = &renewed
+		}
+		next[id] = upload
+	}
+
+	return next
+}
+
+// Returns the put that reserved a version of the file, or nil if there is none
+func (queues *RequestQueues) findUpload(fileName string, version int) *FileUpload {
+	for _, upload := range queues.Uploads {
+		if upload.FileName == fileName && upload.Version == version {
+			return upload
+		}
+	}
+
+	return nil
+}
+
+// Returns if a version of the file was reserved by a put that may still be committed
+func (queues *RequestQueues) hasUpload(fileName string, version int) bool {
+	return queues.findUpload(fileName, version) != nil
+}
+
+// Returns if a put of the file holds it at the given time
+func (queues *RequestQueues) isWriting(fileName string, now time.Time) bool {
+	for _, upload := range queues.Uploads {
+		if upload.FileName == fileName && upload.holds(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns if the put was not given up and its lease has not run out at the given time
+func (upload *FileUpload) holds(now time.Time) bool {
+	return !upload.Aborted && now.Sub(upload.Started) < PUT_LEASE_TIMEOUT
+}
+
+// Returns the metadata of a file as of the last command this node applied, or false if the file
+// is not in the sdfs
+func (node *Node) FileMetadata(fileName string) (FileMetadata, bool) {
+	metadata := node.Queues().Files[fileName]
+	if metadata == nil {
+		return FileMetadata{}, false
+	}
+
+	return *metadata, true
+}
+
+// Returns the replicas that are in the membership list
+func (node *Node) aliveReplicas(replicas []string) []string {
+	alive := []string{}
+	for _, member := range replicas {
+		if node.Membership.Contains(member) {
+			alive = append(alive, member)
+		}
+	}
+
+	return alive
+}
+
+// Returns the number of replicas out of count that have to answer, which is all of them if
+// there are fewer than the quorum
+func Quorum(size int, count int) int {
+	if count < size {
+		return count
+	}
+
+	return size
+}
+
+// Sends a version of a file to every replica at once. Fails if fewer than WRITE_QUORUM of them
+// stored it, otherwise returns the replicas that did
+func StoreReplicas(hostList []string, fileName string, version int, send func(hostname string) bool) ([]string, error) {
+	storedList := []string{}
+	var storedMutex sync.Mutex
+	var waitGroup sync.WaitGroup
+	for _, hostname := range hostList {
+		waitGroup.Add(1)
+		go func(hostname string) {
+			defer waitGroup.Done()
+			if send(hostname) {
+				storedMutex.Lock()
+				storedList = append(storedList, hostname)
+				storedMutex.Unlock()
+			}
+		}(hostname)
+	}
+	waitGroup.Wait()
+
+	if len(storedList) < Quorum(WRITE_QUORUM, len(hostList)) {
+		log.Infof("Version %d of file %s was only stored on %d of %d replicas", version, fileName, len(storedList), len(hostList))
+		return nil, ErrNoQuorum
+	}
+	log.Infof("Version %d of file %s was stored on %d of %d replicas", version, fileName, len(storedList), len(hostList))
+
+	return storedList, nil
+}
+
+// Gives up a put through the first of the servers that answers, so the next put of the file can
+// start right away. A put that could not give it up holds the file until PUT_LEASE_TIMEOUT passed
+func AbortPut(servers []string, metadata *FileMetadata) {
+	request := &CommitPutArgs{File: &FileMetadata{Name: metadata.Name, Version: metadata.Version}}
+	for _, hostname := range servers {
+		if _, success := CallAbortPutRPC(hostname, request); success {
+			return
+		}
+	}
+}
+
+// Returns the replicas in a random order, since some of them may have failed
+func RandomOrder(hostList []string) []string {
+	shuffled := append([]string{}, hostList...)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	return shuffled
+}
+
+// Returns the files in the sdfs that are in the given directory or any of its subdirectories
+func (node *Node) findDirectory(dirName string) []string {
+	fileList, _, _ := node.ListDirectory(dirName, true)
+	return fileList
+}
+
+// Hands out the version the next put of a file is stored as. The reservation is made under
+// uploadID, which is the same every time the client tries, so it is only made once. A client that
+// did not pick an ID gets a new one
+func (node *Node) reserveVersion(fileName string, uploadID string) (int, error) {
+	if uploadID == "" {
+		uploadID = node.nextRequestID()
+	}
+
+	deadline := time.Now().Add(PUT_WAIT_TIMEOUT)
+	for {
+		// A reservation made by an earlier try of the same put is handed out again, and one that
+		// was given up is never made again
+		queues := node.Queues()
+		if upload := queues.Uploads[uploadID]; upload != nil && !upload.Aborted {
+			return upload.Version, nil
+		}
+		if queues.isFinished(uploadID) {
+			log.Infof("The reservation of file %s was already given up", fileName)
+			return 0, ErrNotApplied
+		}
+
+		// Another put of the file holds it, so this one waits until it is committed or given up
+		if queues.isWriting(fileName, time.Now()) {
+			if node.isStopped() || time.Now().After(deadline) {
+				log.Infof("File %s is still held by another put", fileName)
+				return 0, ErrFileBusy
+			}
+			node.waitForChange(node.Log.Changed(), nil, RAFT_HEARTBEAT_INTERVAL)
+			continue
+		}
+
+		err := node.proposeCommand(RaftCommand{Type: RAFT_RESERVE_VERSION, ID: uploadID, File: &FileMetadata{Name: fileName}})
+		if err != nil {
+			log.Infof("Could not reserve a version of file %s! %s", fileName, err)
+			return 0, err
+		}
+		if node.Queues().Uploads[uploadID] == nil && time.Now().After(deadline) {
+			return 0, ErrFileBusy
+		}
+	}
+}
+
+// Renews the lease of the put of a version while its chunks are still arriving, so a put of a
+// large file does not lose the file to the next put. The lease is renewed once a third of it
+// passed, and not again while the renewal is still being proposed
+func (node *Node) renewUpload(fileName string, version int) {
+	upload := node.Queues().findUpload(fileName, version)
+	if upload == nil || !upload.holds(time.Now()) || time.Since(upload.Started) < PUT_LEASE_TIMEOUT/3 {
+		return
+	}
+
+	key := fileName + ":" + strconv.Itoa(version)
+	node.renewMutex.Lock()
+	if node.renewingUploads[key] {
+		node.renewMutex.Unlock()
+		return
+	}
+	node.renewingUploads[key] = true
+	node.renewMutex.Unlock()
+
+	go func() {
+		err := node.proposeCommand(RaftCommand{Type: RAFT_RENEW_UPLOAD, File: &FileMetadata{Name: fileName, Version: version}})
+		if err != nil {
+			log.Infof("Could not renew the lease of version %d of file %s! %s", version, fileName, err)
+		}
+
+		node.renewMutex.Lock()
+		delete(node.renewingUploads, key)
+		node.renewMutex.Unlock()
+	}()
+}
+
+// Gives up a put, so the next put of the file does not have to wait for it
+func (node *Node) abortPut(metadata *FileMetadata) error {
+	err := node.proposeCommand(RaftCommand{Type: RAFT_ABORT_PUT, File: metadata})
+	if err != nil {
+		log.Infof("Could not give up version %d of file %s! %s", metadata.Version, metadata.Name, err)
+	}
+
+	return err
+}
+
+// Adds a new version of a file and its blocks to the metadata directory once they are stored on
+// their replicas. Returns ErrStaleVersion if a newer version was added first
+func (node *Node) commitFile(metadata *FileMetadata, blocks []*FileMetadata) error {
+	err := node.proposeCommand(RaftCommand{Type: RAFT_PUT_FILE, ID: node.nextRequestID(), File: metadata, Blocks: blocks})
+	if err != nil {
+		log.Infof("Could not add file %s to the metadata directory! %s", metadata.Name, err)
+		return err
+	}
+
+	if err := node.Queues().checkFilePath(metadata.Name); err != nil {
+		log.Infof("Version %d of file %s can not be added! %s", metadata.Version, metadata.Name, err)
+		return err
+	}
+
+	current, _ := node.FileMetadata(metadata.Name)
+	if fileVersion, kept := current.FindVersion(metadata.Version); !kept || fileVersion.Checksum != metadata.Checksum {
+		log.Infof("Version %d of file %s was replaced by version %d!", metadata.Version, metadata.Name, current.Version)
+		return ErrStaleVersion
+	}
+
+	return nil
+}
+
+// Removes a file and its blocks from the metadata directory and tells their replicas to drop their
+// copies. Replicas that miss the delete drop the file once it is an orphan
+func (node *Node) deleteFile(metadata FileMetadata, blocks []FileMetadata) error {
+	command := RaftCommand{Type: RAFT_DELETE_FILE, ID: node.nextRequestID(), File: &metadata}
+	err := node.proposeCommand(command)
+	if err != nil {
+		log.Infof("Could not remove file %s from the metadata directory! %s", metadata.Name, err)
+		return err
+	}
+
+	// The delete had no effect if the version it removed is still the newest one
+	if current := node.Queues().Files[metadata.Name]; current != nil && current.Version <= metadata.Version {
+		log.Infof("File %s was not removed from the metadata directory!", metadata.Name)
+		return ErrNotApplied
+	}
+
+	for _, file := range append([]FileMetadata{metadata}, blocks...) {
+		deleteArgs := &ServerRequestArgs{FileName: file.Name}
+		for _, member := range file.Replicas {
+			CallServerCommunicationRPC(member, "ServerCommunication.DeleteFile", deleteArgs)
+		}
+	}
+
+	return nil
+}
+
+// Records that versions of a file were moved to new replicas. Version is the newest version of the
+// file when they were moved
+func (node *Node) updateReplicas(fileName string, version int, versions []int, replicas []string) {
+	metadata := &FileMetadata{Name: fileName, Version: version, Replicas: replicas}
+	for _, movedVersion := range versions {
+		metadata.Versions = append(metadata.Versions, FileVersion{Version: movedVersion})
+	}
+	err := node.proposeCommand(RaftCommand{Type: RAFT_UPDATE_REPLICAS, File: metadata})
+	if err != nil {
+		log.Infof("Could not update the replicas of file %s! %s", fileName, err)
+	}
+}
+
+// Drops the versions stored on this node that are not kept in the metadata directory. Versions
+// newer than the newest one may belong to a put that is not committed yet, so they are only
+// dropped once they are orphans, and never while their put still holds the file
+func (node *Node) dropOrphanFiles() {
+	// A node that does not know of a leader may be behind on the directory
+	if node.Log.Leader() == "" {
+		return
+	}
+
+	for fileName := range node.LocalFiles.Files() {
+		metadata, committed := node.FileMetadata(fileName)
+		for _, version := range node.LocalFiles.Versions(fileName) {
+			if _, kept := metadata.FindVersion(version); kept {
+				continue
+			}
+			if upload := node.Queues().findUpload(fileName, version); upload != nil && upload.holds(time.Now()) {
+				continue
+			}
+
+			storedAt, _ := node.LocalFiles.StoredAt(fileName, version)
+			if (committed && version < metadata.Version) || time.Since(storedAt) > ORPHAN_FILE_TIMEOUT {
+				log.Infof("Version %d of file %s is not kept in the metadata directory, dropping it", version, fileName)
+				node.deleteLocalVersion(fileName, version)
+			}
+		}
+	}
+}
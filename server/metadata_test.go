@@ -0,0 +1,139 @@
+package server
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Helper that applies a committed put of a version of a file stored on the given replicas
+func putVersion(queues *RequestQueues, fileName string, version int, replicas []string) *RequestQueues {
+	file := &FileMetadata{Name: fileName, Version: version, Replicas: replicas, Checksum: FileChecksum([]byte{byte(version)})}
+	return queues.apply(RaftCommand{Type: RAFT_PUT_FILE, Time: time.Now(), File: file})
+}
+
+// Every version keeps the replicas it was put on, also after newer versions are put elsewhere
+func TestVersionReplicas(t *testing.T) {
+	queues := putVersion(&RequestQueues{}, "a.txt", 1, []string{"n1", "n2", "n3"})
+	queues = putVersion(queues, "a.txt", 2, []string{"n2", "n3", "n4"})
+
+	metadata := queues.Files["a.txt"]
+	if !reflect.DeepEqual(metadata.Replicas, []string{"n2", "n3", "n4"}) {
+		t.Fatalf("File is stored on %v, expected the replicas of version 2", metadata.Replicas)
+	}
+	first, _ := metadata.FindVersion(1)
+	if !reflect.DeepEqual(first.Replicas, []string{"n1", "n2", "n3"}) {
+		t.Fatalf("Version 1 is stored on %v, expected the replicas it was put on", first.Replicas)
+	}
+}
+
+// Versions that were copied to new replicas are stored on them, the others only stay on their
+// replicas that are among them. The file keeps the replicas of a version put in the meantime
+func TestUpdateReplicas(t *testing.T) {
+	queues := putVersion(&RequestQueues{}, "a.txt", 1, []string{"n1", "n2", "n3"})
+	queues = putVersion(queues, "a.txt", 2, []string{"n1", "n2", "n3"})
+
+	moved := &FileMetadata{Name: "a.txt", Version: 2, Replicas: []string{"n2", "n3", "n4"}, Versions: []FileVersion{{Version: 2}}}
+	next := queues.apply(RaftCommand{Type: RAFT_UPDATE_REPLICAS, File: moved})
+	metadata := next.Files["a.txt"]
+	if !reflect.DeepEqual(metadata.Replicas, moved.Replicas) {
+		t.Fatalf("File is stored on %v, expected %v", metadata.Replicas, moved.Replicas)
+	}
+	if second, _ := metadata.FindVersion(2); !reflect.DeepEqual(second.Replicas, moved.Replicas) {
+		t.Fatalf("Version 2 is stored on %v, expected %v", second.Replicas, moved.Replicas)
+	}
+	if first, _ := metadata.FindVersion(1); !reflect.DeepEqual(first.Replicas, []string{"n2", "n3"}) {
+		t.Fatalf("Version 1 is stored on %v, expected the replicas that kept it", first.Replicas)
+	}
+	if first, _ := queues.Files["a.txt"].FindVersion(1); len(first.Replicas) != 3 {
+		t.Fatal("Updating the replicas changed the queues it was applied to")
+	}
+
+	queues = putVersion(queues, "a.txt", 3, []string{"n1", "n5", "n6"})
+	next = queues.apply(RaftCommand{Type: RAFT_UPDATE_REPLICAS, File: moved})
+	metadata = next.Files["a.txt"]
+	if !reflect.DeepEqual(metadata.Replicas, []string{"n1", "n5", "n6"}) {
+		t.Fatalf("File is stored on %v, expected the replicas of version 3", metadata.Replicas)
+	}
+	if second, _ := metadata.FindVersion(2); !reflect.DeepEqual(second.Replicas, moved.Replicas) {
+		t.Fatalf("Version 2 is stored on %v, expected %v", second.Replicas, moved.Replicas)
+	}
+}
+
+// Only the newest NUM_VERSIONS versions of a file are kept, newest first
+func TestVersionRetention(t *testing.T) {
+	queues := &RequestQueues{}
+	for version := 1; version <= NUM_VERSIONS+2; version++ {
+		queues = putVersion(queues, "a.txt", version, []string{"n1", "n2", "n3"})
+	}
+
+	metadata := queues.Files["a.txt"]
+	versions := []int{}
+	for _, fileVersion := range metadata.Versions {
+		versions = append(versions, fileVersion.Version)
+	}
+	expected := []int{}
+	for version := NUM_VERSIONS + 2; version > 2; version-- {
+		expected = append(expected, version)
+	}
+	if !reflect.DeepEqual(versions, expected) {
+		t.Fatalf("Kept versions %v, expected %v", versions, expected)
+	}
+	if _, found := metadata.FindVersion(2); found {
+		t.Fatal("Version past NUM_VERSIONS was kept")
+	}
+	if newest, _ := metadata.FindVersion(metadata.Version); newest.Checksum != metadata.Checksum {
+		t.Fatal("Newest version does not match the file")
+	}
+
+	// A put that is not committed yet still counts for the next version
+	queues = queues.apply(RaftCommand{Type: RAFT_RESERVE_VERSION, ID: "upload[1]", Time: time.Now(), File: &FileMetadata{Name: "a.txt"}})
+	if next := queues.nextVersion("a.txt"); next != NUM_VERSIONS+4 {
+		t.Fatalf("Next version is %d, expected %d", next, NUM_VERSIONS+4)
+	}
+}
+
+// Dropping the newest version makes the next kept version the newest one of the file
+func TestKeepVersions(t *testing.T) {
+	queues := &RequestQueues{}
+	for version := 1; version <= 3; version++ {
+		queues = putVersion(queues, "a.txt", version, []string{"n1", "n2", "n3"})
+	}
+	metadata := queues.Files["a.txt"]
+
+	if kept := metadata.keepVersions(func(version int) bool { return true }); kept != metadata {
+		t.Fatal("Keeping every version changed the metadata")
+	}
+	kept := metadata.keepVersions(func(version int) bool { return version != 3 })
+	if kept.Version != 2 || len(kept.Versions) != 2 || kept.Checksum != FileChecksum([]byte{2}) {
+		t.Fatalf("Kept %+v, expected version 2 to be the newest", kept)
+	}
+	if metadata.Version != 3 {
+		t.Fatal("Dropping versions changed the metadata it was dropped from")
+	}
+	if metadata.keepVersions(func(version int) bool { return false }) != nil {
+		t.Fatal("File without any kept version was not removed")
+	}
+}
+
+// A put succeeds once WRITE_QUORUM replicas stored it, or every replica if there are fewer
+func TestStoreReplicasQuorum(t *testing.T) {
+	replicas := []string{"n1", "n2", "n3", "n4"}
+	storeOn := func(stored ...string) ([]string, error) {
+		return StoreReplicas(replicas, "a.txt", 1, func(hostname string) bool { return containsMember(stored, hostname) })
+	}
+
+	storedList, err := storeOn("n1", "n3", "n4")
+	sort.Strings(storedList)
+	if err != nil || !reflect.DeepEqual(storedList, []string{"n1", "n3", "n4"}) {
+		t.Fatalf("Put stored on %v returned %v %v", []string{"n1", "n3", "n4"}, storedList, err)
+	}
+	if _, err := storeOn("n1", "n2"); err != ErrNoQuorum {
+		t.Fatalf("Put stored on 2 of 4 replicas returned %v, expected no quorum", err)
+	}
+
+	if Quorum(WRITE_QUORUM, 2) != 2 || Quorum(READ_QUORUM, 1) != 1 || Quorum(WRITE_QUORUM, 5) != WRITE_QUORUM {
+		t.Fatal("Quorum of fewer replicas than the quorum is not all of them")
+	}
+}
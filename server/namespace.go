@@ -0,0 +1,452 @@
+package server
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net/rpc"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Separates the directories of a path in the sdfs. The root directory is the empty path
+var PATH_SEPARATOR string = "/"
+
+var ErrInvalidName = errors.New("names have to be paths that do not contain " + BLOCK_DELIMITER)
+var ErrPathNotFound = errors.New("path not found in the sdfs")
+var ErrNotDirectory = errors.New("a parent of the path is a file")
+var ErrIsDirectory = errors.New("the path is a directory")
+var ErrFileExists = errors.New("the path already exists")
+var ErrDirectoryNotEmpty = errors.New("the directory is not empty")
+var ErrMoveConflict = errors.New("the files were changed while they were moved")
+
+// A file that is moved to a new path. Version is the newest version when the move was prepared,
+// and Replicas are the servers that store the file and its blocks under their new names. A move
+// that replaces a file replaces version Replaced of it, and the versions of the moved file are
+// numbered Shift higher, so they are all newer than the versions of the file they replace
+type FileMove struct {
+	From     string
+	To       string
+	Version  int
+	Replaced int
+	Shift    int
+	Replicas map[string][]string
+}
+
+// Request to move a file or a directory. Replace allows a file to be moved onto another file
+type MoveArgs struct {
+	From    string
+	To      string
+	Replace bool
+}
+
+// Returns the path without a leading separator, repeated separators or . and .. elements, so
+// every file and directory has one name
+func CleanPath(name string) string {
+	return strings.TrimPrefix(path.Clean(PATH_SEPARATOR+name), PATH_SEPARATOR)
+}
+
+// Returns if a file can be put under the name. Names have to be clean paths that are not blocks
+func ValidFileName(name string) bool {
+	return name != "" && name == CleanPath(name) && !IsBlockName(name)
+}
+
+// Returns the directory a path is in
+func parentDir(name string) string {
+	index := strings.LastIndex(name, PATH_SEPARATOR)
+	if index == -1 {
+		return ""
+	}
+
+	return name[:index]
+}
+
+// Returns if a path is in the directory or any of its subdirectories
+func isUnder(name string, dirName string) bool {
+	return dirName == "" || strings.HasPrefix(name, dirName+PATH_SEPARATOR)
+}
+
+// Returns the path a path under from has once from is moved to to
+func movedPath(name string, from string, to string) string {
+	return to + strings.TrimPrefix(name, from)
+}
+
+// Returns nil if a file can be stored at the path, which is neither a directory nor under a file
+func (queues *RequestQueues) checkFilePath(name string) error {
+	if queues.Dirs[name] {
+		return ErrIsDirectory
+	}
+
+	return queues.checkParents(name)
+}
+
+// Returns nil if a directory can be made at the path, which is neither a file nor under a file
+func (queues *RequestQueues) checkDirPath(dirName string) error {
+	if queues.Files[dirName] != nil {
+		return ErrFileExists
+	}
+
+	return queues.checkParents(dirName)
+}
+
+func (queues *RequestQueues) checkParents(name string) error {
+	for dirName := parentDir(name); dirName != ""; dirName = parentDir(dirName) {
+		if queues.Files[dirName] != nil {
+			return ErrNotDirectory
+		}
+	}
+
+	return nil
+}
+
+// Returns a copy of the directories with a directory and its parents added
+func (queues *RequestQueues) addDirs(dirName string) map[string]bool {
+	next := map[string]bool{}
+	for name := range queues.Dirs {
+		next[name] = true
+	}
+	for ; dirName != ""; dirName = parentDir(dirName) {
+		next[dirName] = true
+	}
+
+	return next
+}
+
+// Returns the files and the directories in a directory, or in any of its subdirectories if
+// recursive is set. Returns false if the directory does not exist
+func (queues *RequestQueues) listDirectory(dirName string, recursive bool) ([]string, []string, bool) {
+	if dirName != "" && !queues.Dirs[dirName] {
+		return nil, nil, false
+	}
+
+	inDirectory := func(name string) bool {
+		return isUnder(name, dirName) && (recursive || parentDir(name) == dirName)
+	}
+
+	files := []string{}
+	for fileName := range queues.Files {
+		if !IsBlockName(fileName) && inDirectory(fileName) {
+			files = append(files, fileName)
+		}
+	}
+	dirs := []string{}
+	for name := range queues.Dirs {
+		if inDirectory(name) {
+			dirs = append(dirs, name)
+		}
+	}
+	sort.Strings(files)
+	sort.Strings(dirs)
+
+	return files, dirs, true
+}
+
+// Returns the metadata directory and the directories after a file or a directory is moved. The
+// files that are moved have to be the files of the moves, at the versions the moves were prepared
+// for, since only those are stored under their new names. A file that is replaced has to be at the
+// version the move was prepared for as well. Returns false if the move is not valid
+func (queues *RequestQueues) movePath(from string, to string, moves []FileMove) (map[string]*FileMetadata, map[string]bool, bool) {
+	isDir := queues.Dirs[from]
+	if (!isDir && queues.Files[from] == nil) || queues.Dirs[to] || isUnder(to, from) || queues.checkParents(to) != nil {
+		return nil, nil, false
+	}
+	if replaced := queues.Files[to]; replaced != nil && (isDir || len(moves) != 1 || moves[0].Replaced != replaced.Version) {
+		return nil, nil, false
+	}
+
+	moved := map[string]FileMove{}
+	for _, move := range moves {
+		if move.Shift < queues.nextVersion(move.To)-1 {
+			return nil, nil, false
+		}
+		moved[move.From] = move
+	}
+	for fileName, metadata := range queues.Files {
+		if IsBlockName(fileName) || (fileName != from && !isUnder(fileName, from)) {
+			continue
+		}
+		if move, contains := moved[fileName]; !contains || move.Version != metadata.Version {
+			return nil, nil, false
+		}
+		delete(moved, fileName)
+	}
+	if len(moved) != 0 {
+		return nil, nil, false
+	}
+
+	files := queues.removeFile(to)
+	for _, move := range moves {
+		fileNames := []string{move.From}
+		for name := range queues.Files {
+			if strings.HasPrefix(name, move.From+BLOCK_DELIMITER) {
+				fileNames = append(fileNames, name)
+			}
+		}
+
+		for _, name := range fileNames {
+			newName := movedPath(name, move.From, move.To)
+			replicas, contains := move.Replicas[newName]
+			if !contains {
+				return nil, nil, false
+			}
+
+			delete(files, name)
+			files[newName] = queues.Files[name].renamed(move.From, move.To, move.Shift, replicas)
+		}
+	}
+
+	dirs := queues.addDirs(parentDir(to))
+	if isDir {
+		for name := range queues.Dirs {
+			if name == from || isUnder(name, from) {
+				delete(dirs, name)
+				dirs[movedPath(name, from, to)] = true
+			}
+		}
+	}
+
+	return files, dirs, true
+}
+
+// Returns a copy of the metadata of a file or one of its blocks with the file moved from one path
+// to another, stored on the given replicas with its versions numbered shift higher
+func (metadata *FileMetadata) renamed(from string, to string, shift int, replicas []string) *FileMetadata {
+	renameBlocks := func(blocks []string) []string {
+		if blocks == nil {
+			return nil
+		}
+
+		renamed := []string{}
+		for _, blockName := range blocks {
+			renamed = append(renamed, movedPath(blockName, from, to))
+		}
+		return renamed
+	}
+
+	next := *metadata
+	next.Name = movedPath(metadata.Name, from, to)
+	next.Version += shift
+	next.Replicas = replicas
+	next.Blocks = renameBlocks(metadata.Blocks)
+	next.Versions = []FileVersion{}
+	for _, fileVersion := range metadata.Versions {
+		fileVersion.Version += shift
+		fileVersion.Blocks = renameBlocks(fileVersion.Blocks)
+		if len(fileVersion.Blocks) == 0 {
+			fileVersion.Replicas = commonMembers(fileVersion.Replicas, replicas)
+		}
+		next.Versions = append(next.Versions, fileVersion)
+	}
+
+	return &next
+}
+
+// Returns the files and the directories in a directory as of the last command this node applied
+func (node *Node) ListDirectory(dirName string, recursive bool) ([]string, []string, bool) {
+	return node.Queues().listDirectory(CleanPath(dirName), recursive)
+}
+
+// Makes a directory and its parents
+func (node *Node) makeDir(dirName string) error {
+	if err := node.Queues().checkDirPath(dirName); err != nil {
+		return err
+	}
+
+	err := node.proposeCommand(RaftCommand{Type: RAFT_MAKE_DIR, File: &FileMetadata{Name: dirName}})
+	if err != nil {
+		log.Infof("Could not make directory %s! %s", dirName, err)
+		return err
+	}
+
+	if queues := node.Queues(); !queues.Dirs[dirName] {
+		return queues.checkDirPath(dirName)
+	}
+
+	return nil
+}
+
+// Removes an empty directory
+func (node *Node) removeDir(dirName string) error {
+	files, dirs, found := node.Queues().listDirectory(dirName, false)
+	if !found || dirName == "" {
+		return ErrPathNotFound
+	}
+	if len(files) != 0 || len(dirs) != 0 {
+		return ErrDirectoryNotEmpty
+	}
+
+	err := node.proposeCommand(RaftCommand{Type: RAFT_REMOVE_DIR, File: &FileMetadata{Name: dirName}})
+	if err != nil {
+		log.Infof("Could not remove directory %s! %s", dirName, err)
+		return err
+	}
+
+	if node.Queues().Dirs[dirName] {
+		return ErrDirectoryNotEmpty
+	}
+
+	return nil
+}
+
+// Moves a file or a directory. A path that is moved onto a directory is moved into it, and a file
+// that is moved onto a file replaces it if replace is set. The versions of every file are linked
+// under their new names on their replicas first, then the move is added to the replicated log as
+// one command, so readers either see every file under its old path or every file under its new
+// one. The copies under the old names, and of a file that was replaced, are dropped afterwards
+func (node *Node) movePath(from string, to string, replace bool) error {
+	queues := node.Queues()
+	if queues.Dirs[to] {
+		to = strings.TrimPrefix(to+PATH_SEPARATOR+path.Base(from), PATH_SEPARATOR)
+	}
+
+	if from == "" || to == "" || isUnder(to, from) {
+		return ErrInvalidName
+	}
+	if from == to {
+		return nil
+	}
+	if !queues.Dirs[from] && queues.Files[from] == nil {
+		return ErrPathNotFound
+	}
+	if queues.Dirs[to] || (queues.Files[to] != nil && (!replace || queues.Dirs[from])) {
+		return ErrFileExists
+	}
+
+	replaced := 0
+	if current := queues.Files[to]; current != nil {
+		replaced = current.Version
+	}
+	if err := queues.checkParents(to); err != nil {
+		return err
+	}
+
+	fileNames := []string{from}
+	if queues.Dirs[from] {
+		fileNames, _, _ = queues.listDirectory(from, true)
+	}
+
+	moves := []FileMove{}
+	linked := map[string][]string{}
+	for _, fileName := range fileNames {
+		metadata := queues.Files[fileName]
+		movedName := movedPath(fileName, from, to)
+
+		// The versions of a moved file are numbered after the versions of a file it replaces and
+		// of puts under its new name that are still running, so they never share a version
+		move := FileMove{From: fileName, To: movedName, Version: metadata.Version, Replaced: replaced, Shift: queues.nextVersion(movedName) - 1, Replicas: map[string][]string{}}
+		moves = append(moves, move)
+
+		for _, file := range append([]FileMetadata{*metadata}, queues.fileBlocks(metadata)...) {
+			newName := movedPath(file.Name, move.From, move.To)
+			replicas, success := node.linkFile(file, newName, move.Shift)
+
+			// Links under a name that has versions of its own can not be dropped as a whole, they
+			// are left for the replicas to drop once they are orphans
+			if move.Shift == 0 {
+				linked[newName] = replicas
+			}
+			if !success {
+				node.dropLinks(linked)
+				return ErrNoQuorum
+			}
+			move.Replicas[newName] = replicas
+		}
+	}
+
+	command := RaftCommand{Type: RAFT_MOVE_PATH, ID: node.nextRequestID(), File: &FileMetadata{Name: from}, Target: to, Moves: moves}
+	err := node.proposeCommand(command)
+	if err != nil {
+		log.Infof("Could not move %s to %s! %s", from, to, err)
+		node.dropLinks(linked)
+		return err
+	}
+
+	if !node.Queues().isFinished(command.ID) {
+		log.Infof("Files under %s were changed while they were moved to %s", from, to)
+		node.dropLinks(linked)
+		return ErrMoveConflict
+	}
+
+	// The old names are not in the metadata directory anymore, replicas that miss this drop them
+	// once they are orphans
+	for _, fileName := range fileNames {
+		metadata := queues.Files[fileName]
+		for _, file := range append([]FileMetadata{*metadata}, queues.fileBlocks(metadata)...) {
+			deleteArgs := &ServerRequestArgs{FileName: file.Name}
+			for _, member := range file.Replicas {
+				CallServerCommunicationRPC(member, "ServerCommunication.DeleteFile", deleteArgs)
+			}
+		}
+	}
+
+	log.Infof("Moved %s to %s", from, to)
+	return nil
+}
+
+// Links the versions of a file stored on its replicas under a new name, numbered shift higher.
+// Returns the replicas that linked it, and false if they are fewer than a write quorum
+func (node *Node) linkFile(metadata FileMetadata, newName string, shift int) ([]string, bool) {
+	linkArgs := &ServerRequestArgs{FileName: metadata.Name, NewName: newName, VersionShift: shift, HostList: metadata.Replicas}
+
+	linked := []string{}
+	var linkedMutex sync.Mutex
+	var waitGroup sync.WaitGroup
+	for _, member := range metadata.Replicas {
+		waitGroup.Add(1)
+		go func(member string) {
+			defer waitGroup.Done()
+			if CallLinkFileRPC(member, linkArgs) {
+				linkedMutex.Lock()
+				linked = append(linked, member)
+				linkedMutex.Unlock()
+			}
+		}(member)
+	}
+	waitGroup.Wait()
+
+	if len(linked) < Quorum(WRITE_QUORUM, len(metadata.Replicas)) {
+		log.Infof("File %s was only linked as %s on %d of %d replicas", metadata.Name, newName, len(linked), len(metadata.Replicas))
+		return linked, false
+	}
+
+	// Replicas that did not link the file are left out of the fileGroup of the new name
+	if len(linked) != len(metadata.Replicas) {
+		updateFileGroupArgs := &ServerRequestArgs{FileName: newName, HostList: linked}
+		for _, member := range linked {
+			CallServerCommunicationRPC(member, "ServerCommunication.UpdateFileGroup", updateFileGroupArgs)
+		}
+	}
+
+	return linked, true
+}
+
+// Drops the links of a move that did not happen
+func (node *Node) dropLinks(linked map[string][]string) {
+	for newName, replicas := range linked {
+		deleteArgs := &ServerRequestArgs{FileName: newName}
+		for _, member := range replicas {
+			CallServerCommunicationRPC(member, "ServerCommunication.DeleteFile", deleteArgs)
+		}
+	}
+}
+
+// Moves a file or a directory through a server
+func CallMoveRPC(hostname string, request *MoveArgs) (response ClientResponseArgs, success bool) {
+	log.Infof("Moving %s to %s through %s", request.From, request.To, hostname)
+
+	client, err := rpc.DialHTTP("tcp", rpcAddr(hostname, CLIENT_RPC_PORT))
+	if err != nil {
+		log.Infof("Could not dial server for move: %s", err)
+		return response, false
+	}
+	defer client.Close()
+
+	err = client.Call("ClientRequest.Move", request, &response)
+	if err != nil {
+		log.Infof("Error in request: %s", err)
+		return response, false
+	}
+
+	return response, true
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Helper that applies a command that makes a directory
+func makeDir(queues *RequestQueues, dirName string) *RequestQueues {
+	return queues.apply(RaftCommand{Type: RAFT_MAKE_DIR, File: &FileMetadata{Name: dirName}})
+}
+
+// Helper that returns the move of a file stored on the same replicas under its new name
+func fileMove(queues *RequestQueues, from string, to string) FileMove {
+	metadata := queues.Files[from]
+	return FileMove{From: from, To: to, Version: metadata.Version, Replicas: map[string][]string{to: metadata.Replicas}}
+}
+
+func TestCleanPath(t *testing.T) {
+	for name, expected := range map[string]string{"/a//b/": "a/b", "a/./b/../c": "a/c", "../a": "a", "/": ""} {
+		if cleaned := CleanPath(name); cleaned != expected {
+			t.Fatalf("Cleaned %q to %q, expected %q", name, cleaned, expected)
+		}
+	}
+	if ValidFileName("a//b") || ValidFileName("") || ValidFileName("a"+BLOCK_DELIMITER+"1") || !ValidFileName("a/b") {
+		t.Fatal("Only clean paths that are not blocks are valid file names")
+	}
+}
+
+// Making a directory makes its parents, and files and directories never share a path
+func TestMakeDir(t *testing.T) {
+	queues := makeDir(&RequestQueues{}, "a/b")
+	if !queues.Dirs["a"] || !queues.Dirs["a/b"] {
+		t.Fatalf("Made directories %v, expected a and a/b", queues.Dirs)
+	}
+
+	queues = putVersion(queues, "a/c/d.txt", 1, []string{"n1"})
+	if !queues.Dirs["a/c"] {
+		t.Fatal("Directory of a file that was put was not made")
+	}
+	if err := queues.checkDirPath("a/c/d.txt"); err != ErrFileExists {
+		t.Fatalf("Directory at the path of a file returned %v", err)
+	}
+	if err := queues.checkDirPath("a/c/d.txt/e"); err != ErrNotDirectory {
+		t.Fatalf("Directory under a file returned %v", err)
+	}
+	if err := queues.checkFilePath("a/b"); err != ErrIsDirectory {
+		t.Fatalf("File at the path of a directory returned %v", err)
+	}
+	if next := makeDir(queues, "a/c/d.txt/e"); next != queues {
+		t.Fatal("Directory under a file was made")
+	}
+	if next := putVersion(queues, "a/b", 1, []string{"n1"}); next.Files["a/b"] != nil {
+		t.Fatal("File was put at the path of a directory")
+	}
+
+	files, dirs, found := queues.listDirectory("a", false)
+	if !found || len(files) != 0 || !reflect.DeepEqual(dirs, []string{"a/b", "a/c"}) {
+		t.Fatalf("Listed files %v and directories %v in a", files, dirs)
+	}
+	files, dirs, _ = queues.listDirectory("a", true)
+	if !reflect.DeepEqual(files, []string{"a/c/d.txt"}) || len(dirs) != 2 {
+		t.Fatalf("Listed files %v and directories %v under a", files, dirs)
+	}
+	if _, _, found := queues.listDirectory("a/c/d.txt", false); found {
+		t.Fatal("File was listed as a directory")
+	}
+}
+
+// Only empty directories are removed, and their parents are kept
+func TestRemoveDir(t *testing.T) {
+	queues := makeDir(&RequestQueues{}, "a/b")
+	queues = putVersion(queues, "a/c.txt", 1, []string{"n1"})
+	removeDir := func(queues *RequestQueues, dirName string) *RequestQueues {
+		return queues.apply(RaftCommand{Type: RAFT_REMOVE_DIR, File: &FileMetadata{Name: dirName}})
+	}
+
+	if next := removeDir(queues, "a"); !next.Dirs["a"] {
+		t.Fatal("Directory with files and directories in it was removed")
+	}
+	next := removeDir(queues, "a/b")
+	if next.Dirs["a/b"] || !next.Dirs["a"] {
+		t.Fatalf("Removing a/b left directories %v", next.Dirs)
+	}
+	if !queues.Dirs["a/b"] {
+		t.Fatal("Removing a directory changed the queues it was applied to")
+	}
+
+	next = next.apply(RaftCommand{Type: RAFT_DELETE_FILE, ID: "delete", File: &FileMetadata{Name: "a/c.txt"}})
+	if next = removeDir(next, "a"); len(next.Dirs) != 0 {
+		t.Fatalf("Empty directory was not removed, directories %v", next.Dirs)
+	}
+}
+
+// A directory is moved with every file and directory under it, but not into itself, onto a
+// directory or file, or without every file under it
+func TestMoveDirectory(t *testing.T) {
+	queues := makeDir(&RequestQueues{}, "a/empty")
+	queues = putVersion(queues, "a/x.txt", 1, []string{"n1", "n2"})
+	queues = putVersion(queues, "a/b/y.txt", 1, []string{"n2", "n3"})
+	queues = makeDir(queues, "other")
+	queues = putVersion(queues, "file.txt", 1, []string{"n1"})
+	moves := []FileMove{fileMove(queues, "a/x.txt", "c/x.txt"), fileMove(queues, "a/b/y.txt", "c/b/y.txt")}
+
+	invalid := map[string][]FileMove{
+		"a/b/c":        {fileMove(queues, "a/x.txt", "a/b/c/x.txt"), fileMove(queues, "a/b/y.txt", "a/b/c/b/y.txt")},
+		"other":        {fileMove(queues, "a/x.txt", "other/x.txt"), fileMove(queues, "a/b/y.txt", "other/b/y.txt")},
+		"file.txt":     {fileMove(queues, "a/x.txt", "file.txt/x.txt"), fileMove(queues, "a/b/y.txt", "file.txt/b/y.txt")},
+		"file.txt/sub": {fileMove(queues, "a/x.txt", "file.txt/sub/x.txt"), fileMove(queues, "a/b/y.txt", "file.txt/sub/b/y.txt")},
+		"c":            moves[:1],
+	}
+	for to, invalidMoves := range invalid {
+		if _, _, valid := queues.movePath("a", to, invalidMoves); valid {
+			t.Fatalf("Moving a to %s was valid", to)
+		}
+	}
+	if _, _, valid := queues.movePath("missing", "c", nil); valid {
+		t.Fatal("Moving a path that does not exist was valid")
+	}
+
+	files, dirs, valid := queues.movePath("a", "c", moves)
+	if !valid {
+		t.Fatal("Move of a directory was not valid")
+	}
+	if files["a/x.txt"] != nil || files["c/x.txt"] == nil || files["c/b/y.txt"].Name != "c/b/y.txt" {
+		t.Fatalf("Moved files to %v", files)
+	}
+	if dirs["a"] || dirs["a/b"] || !dirs["c"] || !dirs["c/b"] || !dirs["c/empty"] || !dirs["other"] {
+		t.Fatalf("Moved directories to %v", dirs)
+	}
+
+	// The files have to be at the versions the move was prepared for
+	changed := putVersion(queues, "a/x.txt", 2, []string{"n1", "n2"})
+	if _, _, valid := changed.movePath("a", "c", moves); valid {
+		t.Fatal("Move of a file that was put again was valid")
+	}
+	added := putVersion(queues, "a/z.txt", 1, []string{"n1"})
+	if _, _, valid := added.movePath("a", "c", moves); valid {
+		t.Fatal("Move of a directory a file was added to was valid")
+	}
+}
+
+// A file that is moved onto another file replaces it, with its versions numbered after the
+// versions of the replaced file. The move is only applied once, and not after the replaced file
+// was put again
+func TestMoveReplacesFile(t *testing.T) {
+	queues := putVersion(&RequestQueues{}, "a.txt", 1, []string{"n1", "n2"})
+	queues = putVersion(queues, "a.txt", 2, []string{"n1", "n2"})
+	queues = putVersion(queues, "b.txt", 1, []string{"n2", "n3"})
+	queues = putVersion(queues, "b.txt", 2, []string{"n2", "n3"})
+	queues = putVersion(queues, "b.txt", 3, []string{"n2", "n3"})
+
+	move := fileMove(queues, "a.txt", "b.txt")
+	move.Replaced = 3
+	move.Shift = queues.nextVersion("b.txt") - 1
+	command := RaftCommand{Type: RAFT_MOVE_PATH, ID: "move", File: &FileMetadata{Name: "a.txt"}, Target: "b.txt", Moves: []FileMove{move}}
+
+	if stale := putVersion(queues, "b.txt", 4, []string{"n2", "n3"}).apply(command); stale.Files["a.txt"] == nil || stale.isFinished("move") {
+		t.Fatal("Move onto a file that was put again was applied")
+	}
+
+	moved := queues.apply(command)
+	metadata := moved.Files["b.txt"]
+	if moved.Files["a.txt"] != nil || metadata == nil || !moved.isFinished("move") {
+		t.Fatal("File was not moved")
+	}
+	if metadata.Version != 5 || metadata.Checksum != FileChecksum([]byte{2}) || len(metadata.Versions) != 2 {
+		t.Fatalf("Moved file has version %d with %d versions, expected versions 4 and 5", metadata.Version, len(metadata.Versions))
+	}
+	if first, _ := metadata.FindVersion(4); !reflect.DeepEqual(first.Replicas, []string{"n1", "n2"}) {
+		t.Fatalf("Version 4 is stored on %v, expected the replicas of version 1", first.Replicas)
+	}
+
+	if again := moved.apply(command); again != moved {
+		t.Fatal("Move was applied again")
+	}
+}
+
+// The blocks of a file are moved along with it
+func TestMoveBlocks(t *testing.T) {
+	blocks := []*FileMetadata{
+		{Name: BlockName("a.txt", 0), Version: 1, Replicas: []string{"n1"}},
+		{Name: BlockName("a.txt", 1), Version: 1, Replicas: []string{"n2"}},
+	}
+	file := &FileMetadata{Name: "a.txt", Version: 1, Replicas: []string{"n1"}, Blocks: []string{blocks[0].Name, blocks[1].Name}}
+	queues := (&RequestQueues{}).apply(RaftCommand{Type: RAFT_PUT_FILE, Time: time.Now(), File: file, Blocks: blocks})
+
+	move := fileMove(queues, "a.txt", "d/b.txt")
+	move.Replicas[BlockName("d/b.txt", 0)] = []string{"n1"}
+	move.Replicas[BlockName("d/b.txt", 1)] = []string{"n2"}
+	moved := queues.apply(RaftCommand{Type: RAFT_MOVE_PATH, ID: "move", File: &FileMetadata{Name: "a.txt"}, Target: "d/b.txt", Moves: []FileMove{move}})
+
+	metadata, blockEntries, found := (&Node{queues: moved}).FileBlocks("d/b.txt")
+	if !found || !reflect.DeepEqual(metadata.Blocks, []string{BlockName("d/b.txt", 0), BlockName("d/b.txt", 1)}) || len(blockEntries) != 2 {
+		t.Fatalf("Moved file has blocks %v", metadata.Blocks)
+	}
+	for name := range moved.Files {
+		if IsBlockName(name) && parentDir(name) != "d" {
+			t.Fatalf("Block %s was not moved", name)
+		}
+	}
+	if !moved.Dirs["d"] {
+		t.Fatal("Directory of the new path was not made")
+	}
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a manager waits before asking again after a failed RPC or when there was no work for it.
+// Managers are woken earlier whenever the replicated log or the membership list changes
+var MANAGER_RETRY_INTERVAL time.Duration = 500 * time.Millisecond
+
+// All of the state of one server. Every manager goroutine and RPC service works on its Node
+// instead of package globals, so several servers can run inside the same process.
+type Node struct {
+	ID       string
+	DataDir  string
+	BindAddr string
+
+	Membership *MembershipList
+
+	// The metadata directory of the sdfs and the MapleJuice jobs, kept in the replicated log. The queues are
+	// replaced whenever a command is applied, so they are read through Queues
+	Log         *ReplicatedLog
+	queues      *RequestQueues
+	queuesMutex sync.RWMutex
+
+	LocalFiles  *LocalFileSystem
+	Replication *ReplicationQueue
+
+	// Transfers this node is receiving, and the ones it finished receiving, so a chunk that is sent
+	// again is not written twice
+	transferMutex      sync.Mutex
+	transfers          map[string]*incomingTransfer
+	completedTransfers map[string]time.Time
+
+	// Puts whose lease this node is renewing, so chunks that arrive meanwhile do not renew it again
+	renewMutex      sync.Mutex
+	renewingUploads map[string]bool
+
+	// Keeps track of how many requests have been created by this node since it started. The boot
+	// ID is picked at random on every start, so IDs are never reused after a restart
+	bootID       string
+	requestCount int64
+
+	// Progress of the node as a worker. The progress as a master is checkpointed in the queues
+	worker           *WorkerProgress
+	workerMutex      sync.Mutex
+	ProcessFileMutex sync.Mutex
+	JuiceMutex       sync.Mutex
+	mapleOutputMutex sync.Mutex
+
+	// State of the SWIM failure detector
+	swimMutex  sync.Mutex
+	swimSeq    uint64
+	ackWaiters map[uint64]chan struct{}
+	broadcasts []*swimBroadcast
+	probeOrder []string
+
+	// Subscribers to the changes of the membership list
+	subscriberMutex sync.Mutex
+	subscribers     []*membershipSubscription
+
+	udpConn       *net.UDPConn
+	listeners     []net.Listener
+	listenerMutex sync.Mutex
+	stop          chan struct{}
+	stopOnce      sync.Once
+	paused        int32
+}
+
+// Creates a node with the given identity, data directory and bind address. Empty arguments fall
+// back to the node's entry in the cluster config, then to the hostname and the working directory.
+func NewNode(nodeID string, dataDir string, bindAddr string) (*Node, error) {
+	if nodeID == "" {
+		hostname, _ := os.Hostname()
+		nodeID = hostname
+	}
+	nodeID = NormalizeNodeID(nodeID)
+
+	nodeConfig := Config.Node(nodeID)
+	if dataDir == "" {
+		dataDir = nodeConfig.DataDir
+	}
+	if dataDir == "" {
+		dataDir = "."
+	}
+	if bindAddr == "" {
+		bindAddr = nodeConfig.BindAddr
+	}
+
+	node := &Node{
+		ID:           nodeID,
+		DataDir:      dataDir,
+		BindAddr:     bindAddr,
+		Membership:   newMembershipList(nodeID),
+		queues:       &RequestQueues{},
+		Replication:  newReplicationQueue(),
+		bootID:       newTransferID()[:16],
+		requestCount: 1000,
+		ackWaiters:   map[uint64]chan struct{}{},
+		stop:         make(chan struct{}),
+
+		transfers:          map[string]*incomingTransfer{},
+		completedTransfers: map[string]time.Time{},
+		renewingUploads:    map[string]bool{},
+	}
+
+	folders := []string{SERVER_FOLDER_NAME, LOCAL_FOLDER_NAME, MAPLE_EXE_FOLDER_NAME, MAPLE_TEMP_FOLDER_NAME, MAPLE_TASKS_FOLDER_NAME, TRANSFER_FOLDER_NAME}
+	for _, folder := range folders {
+		err := os.MkdirAll(node.dataPath(folder), 0777)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The files stored before a restart are known again before any request is served
+	localFiles, err := openLocalFileSystem(node.dataPath(LOCAL_METADATA_FOLDER_NAME), node.dataPath(SERVER_FOLDER_NAME))
+	if err != nil {
+		return nil, err
+	}
+	node.LocalFiles = localFiles
+
+	replicatedLog, err := newReplicatedLog(node)
+	if err != nil {
+		return nil, err
+	}
+	node.Log = replicatedLog
+
+	return node, nil
+}
+
+// Starts the heartbeat, replicated log, file system, replication, scrub and Maple/Juice managers of
+// the node. Fails without starting any of them if the UDP port of the node can not be bound
+func (node *Node) Start() error {
+	socketUDP, err := node.openUDPConn()
+	if err != nil {
+		return err
+	}
+
+	go node.HeartbeatManager(socketUDP)
+	go node.ReplicatedLogManager()
+	go node.FileSystemManager()
+	go node.ReplicationManager()
+	go node.ScrubManager()
+	go node.MapleWorkerManager()
+	go node.JuiceWorkerManager()
+	go node.MapleMasterManager()
+	go node.JuiceMasterManager()
+	return nil
+}
+
+// Stops every manager of the node and closes its sockets, as if the process had crashed
+func (node *Node) Kill() {
+	node.stopOnce.Do(func() {
+		close(node.stop)
+
+		node.listenerMutex.Lock()
+		if node.udpConn != nil {
+			node.udpConn.Close()
+		}
+		for _, listener := range node.listeners {
+			listener.Close()
+		}
+		node.listenerMutex.Unlock()
+	})
+}
+
+// A paused node stops sending and recieving heartbeats and stops working on Maple/Juice tasks,
+// so the rest of the cluster sees it as failed until it is resumed
+func (node *Node) Pause() {
+	atomic.StoreInt32(&node.paused, 1)
+}
+
+func (node *Node) Resume() {
+	atomic.StoreInt32(&node.paused, 0)
+}
+
+func (node *Node) isPaused() bool {
+	return atomic.LoadInt32(&node.paused) == 1
+}
+
+// Checks if the node has been killed. Manager loops return once this is true
+func (node *Node) isStopped() bool {
+	select {
+	case <-node.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns the queues as of the last command this node applied. They are never changed in place, so
+// the caller can keep reading them while newer commands are applied
+func (node *Node) Queues() *RequestQueues {
+	node.queuesMutex.RLock()
+	defer node.queuesMutex.RUnlock()
+
+	return node.queues
+}
+
+func (node *Node) setQueues(queues *RequestQueues) {
+	node.queuesMutex.Lock()
+	defer node.queuesMutex.Unlock()
+
+	node.queues = queues
+}
+
+// Blocks until changed is closed, a membership event arrives, retry passed or the node is killed.
+// A nil channel is never ready and a retry of 0 waits without a timeout
+func (node *Node) waitForChange(changed <-chan struct{}, events <-chan MembershipEvent, retry time.Duration) {
+	var timeout <-chan time.Time
+	if retry > 0 {
+		timer := time.NewTimer(retry)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-changed:
+	case <-events:
+	case <-timeout:
+	case <-node.stop:
+	}
+}
+
+// Keeps track of a listener so it is closed when the node is killed
+func (node *Node) addListener(listener net.Listener) {
+	node.listenerMutex.Lock()
+	defer node.listenerMutex.Unlock()
+
+	if node.isStopped() {
+		listener.Close()
+		return
+	}
+
+	node.listeners = append(node.listeners, listener)
+}
+
+// Returns the path of a file or folder inside the node's data directory
+func (node *Node) dataPath(elem ...string) string {
+	return filepath.Join(append([]string{node.DataDir}, elem...)...)
+}
+
+// Helper that returns the address the listener for a service of this node binds to
+func (node *Node) listenAddr(servicePort string) string {
+	_, port, _ := net.SplitHostPort(rpcAddr(node.ID, servicePort))
+	return net.JoinHostPort(node.BindAddr, port)
+}
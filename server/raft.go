@@ -0,0 +1,1012 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math/rand"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+)
+
+var RAFT_RPC_PORT string = "9000"
+var RAFT_FOLDER_NAME string = "raft"
+var RAFT_META_FILE_NAME string = "meta.json"
+var RAFT_SNAPSHOT_FILE_NAME string = "snapshot.json"
+var RAFT_LOG_FILE_NAME string = "log.jsonl"
+
+// The leader sends entries or an empty append every RAFT_HEARTBEAT_INTERVAL. A voter that hears
+// nothing from a leader for a random time between RAFT_ELECTION_TIMEOUT and twice that starts an election
+var RAFT_HEARTBEAT_INTERVAL time.Duration = 100 * time.Millisecond
+var RAFT_ELECTION_TIMEOUT time.Duration = 1000 * time.Millisecond
+var RAFT_RPC_TIMEOUT time.Duration = 500 * time.Millisecond
+var RAFT_PROPOSE_TIMEOUT time.Duration = 10 * time.Second
+
+// Applied entries are compacted into a snapshot once there are RAFT_SNAPSHOT_ENTRIES of them, and
+// an append sends at most RAFT_MAX_APPEND_ENTRIES entries
+var RAFT_SNAPSHOT_ENTRIES int = 500
+var RAFT_MAX_APPEND_ENTRIES int = 100
+
+type raftRole int
+
+const (
+	RAFT_FOLLOWER raftRole = iota
+	RAFT_CANDIDATE
+	RAFT_LEADER
+)
+
+var ErrNotLeader = errors.New("node is not the leader of the replicated log")
+var ErrNoLeader = errors.New("could not reach the leader of the replicated log")
+var ErrProposalLost = errors.New("proposal was replaced by the log of a newer leader")
+var ErrNodePaused = errors.New("node is paused")
+var ErrNodeStopped = errors.New("node was killed")
+var ErrNotApplied = errors.New("the command was appended to the replicated log but had no effect")
+
+type RaftEntry struct {
+	Index   uint64
+	Term    uint64
+	Command RaftCommand
+}
+
+// Term and vote, written to disk before the node answers any RPC that changed them
+type raftMeta struct {
+	Term     uint64
+	VotedFor string
+}
+
+type raftSnapshot struct {
+	Index uint64
+	Term  uint64
+	State *RequestQueues
+}
+
+// A proposal waiting for its entry to be applied. It succeeded if the applied entry has its term
+type raftWaiter struct {
+	term uint64
+	done chan bool
+}
+
+// Replicated log of the request queues, kept consistent with the Raft consensus algorithm. The
+// voters elect a leader that appends every command, and a command is applied once a majority of
+// the voters stored it. Every other member of the cluster follows the log without voting.
+type ReplicatedLog struct {
+	node    *Node
+	mutex   sync.Mutex
+	voters  []string
+	isVoter bool
+
+	// Persisted in the raft folder of the data directory
+	term          uint64
+	votedFor      string
+	entries       []RaftEntry
+	snapshotIndex uint64
+	snapshotTerm  uint64
+	snapshotState *RequestQueues
+	logFile       *os.File
+
+	role            raftRole
+	leader          string
+	commitIndex     uint64
+	lastApplied     uint64
+	lastContact     time.Time
+	electionTimeout time.Duration
+
+	// State of the leader
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	replicators map[string]chan struct{}
+	waiters     map[uint64]*raftWaiter
+
+	// Closed and replaced every time entries are applied or the leader changes
+	changed chan struct{}
+
+	clients     map[string]*rpc.Client
+	clientMutex sync.Mutex
+}
+
+// Creates the replicated log of a node and loads the term, snapshot and entries it persisted
+func newReplicatedLog(node *Node) (*ReplicatedLog, error) {
+	replicatedLog := &ReplicatedLog{
+		node:          node,
+		voters:        Config.RaftPeerIDs(),
+		snapshotState: node.Queues(),
+		lastContact:   time.Now(),
+		nextIndex:     map[string]uint64{},
+		matchIndex:    map[string]uint64{},
+		replicators:   map[string]chan struct{}{},
+		waiters:       map[uint64]*raftWaiter{},
+		changed:       make(chan struct{}),
+		clients:       map[string]*rpc.Client{},
+	}
+	for _, voter := range replicatedLog.voters {
+		if voter == node.ID {
+			replicatedLog.isVoter = true
+		}
+	}
+	replicatedLog.resetElectionTimeout()
+
+	err := os.MkdirAll(node.dataPath(RAFT_FOLDER_NAME), 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	err = replicatedLog.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return replicatedLog, nil
+}
+
+// Goroutine that serves the raft RPCs, sends heartbeats while this node leads and starts an
+// election when a voter stops hearing from the leader
+func (node *Node) ReplicatedLogManager() {
+	go node.rpcListener(&Raft{node: node}, RAFT_RPC_PORT)
+
+	ticker := time.NewTicker(RAFT_HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
+	defer node.Log.close()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-node.stop:
+			return
+		}
+
+		if !node.isPaused() {
+			node.Log.tick()
+		}
+	}
+}
+
+func (r *ReplicatedLog) tick() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.role == RAFT_LEADER {
+		r.startReplicators()
+		r.signalReplicators()
+		return
+	}
+
+	if r.isVoter && time.Since(r.lastContact) > r.electionTimeout {
+		r.startElection()
+	}
+}
+
+// Appends a command if this node is the leader and waits until it is applied. Returns the index
+// of the entry, ErrNotLeader on other nodes and ErrProposalLost if a new leader replaced it.
+func (r *ReplicatedLog) Propose(command RaftCommand) (uint64, error) {
+	r.mutex.Lock()
+	if r.role != RAFT_LEADER {
+		r.mutex.Unlock()
+		return 0, ErrNotLeader
+	}
+
+	// The waiter is registered first, a single voter commits the entry as soon as it is appended
+	index := r.lastIndex() + 1
+	if oldWaiter, waiting := r.waiters[index]; waiting {
+		oldWaiter.done <- false
+	}
+	waiter := &raftWaiter{term: r.term, done: make(chan bool, 1)}
+	r.waiters[index] = waiter
+	r.appendLocal(command)
+	r.signalReplicators()
+	r.mutex.Unlock()
+
+	select {
+	case success := <-waiter.done:
+		if !success {
+			return 0, ErrProposalLost
+		}
+		return index, nil
+
+	case <-time.After(RAFT_PROPOSE_TIMEOUT):
+	case <-r.node.stop:
+	}
+
+	r.mutex.Lock()
+	if r.waiters[index] == waiter {
+		delete(r.waiters, index)
+	}
+	r.mutex.Unlock()
+
+	return 0, ErrNoLeader
+}
+
+// Waits until this node has applied the entry at index. Returns false if the timeout passed first
+func (r *ReplicatedLog) WaitApplied(index uint64, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		r.mutex.Lock()
+		isApplied := r.lastApplied >= index
+		changed := r.changed
+		r.mutex.Unlock()
+
+		if isApplied {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		case <-r.node.stop:
+			return false
+		}
+	}
+}
+
+// Returns a channel that is closed the next time entries are applied or the leader changes. Get
+// the channel before looking at the state, so no change in between is missed
+func (r *ReplicatedLog) Changed() <-chan struct{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.changed
+}
+
+// Returns the leader this node last heard from, or an empty string if it does not know one
+func (r *ReplicatedLog) Leader() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.leader
+}
+
+// Returns the newest term this node has seen
+func (r *ReplicatedLog) Term() uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.term
+}
+
+// Returns the current term and whether this node is its leader. The leader is also the
+// MapleJuice master, and its term is the fencing token that lets workers reject stale masters
+func (r *ReplicatedLog) LeaderTerm() (uint64, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.term, r.role == RAFT_LEADER
+}
+
+// Checks if this node still leads the given term
+func (r *ReplicatedLog) IsLeader(term uint64) bool {
+	currentTerm, isLeader := r.LeaderTerm()
+	return isLeader && currentTerm == term
+}
+
+// Starts a new term and asks the other voters for their votes. The caller must hold the mutex
+func (r *ReplicatedLog) startElection() {
+	r.term++
+	r.setLeader(RAFT_CANDIDATE, "")
+	r.votedFor = r.node.ID
+	r.lastContact = time.Now()
+	r.resetElectionTimeout()
+	r.persistMeta()
+	log.Infof("Starting election for term %d of the replicated log", r.term)
+
+	args := &RequestVoteArgs{
+		Term:         r.term,
+		Candidate:    r.node.ID,
+		LastLogIndex: r.lastIndex(),
+		LastLogTerm:  r.lastTerm(),
+	}
+
+	votes := 1
+	if votes > len(r.voters)/2 {
+		r.becomeLeader()
+		return
+	}
+
+	for _, voter := range r.voters {
+		if voter == r.node.ID {
+			continue
+		}
+
+		go func(voter string) {
+			reply := &RequestVoteReply{}
+			if !r.call(voter, "Raft.RequestVote", args, reply) {
+				return
+			}
+
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+
+			if reply.Term > r.term {
+				r.stepDown(reply.Term)
+				return
+			}
+			if r.role != RAFT_CANDIDATE || r.term != args.Term || !reply.VoteGranted {
+				return
+			}
+
+			votes++
+			if votes > len(r.voters)/2 {
+				r.becomeLeader()
+			}
+		}(voter)
+	}
+}
+
+// Takes over as leader. An empty entry of the new term is appended, since entries of earlier
+// terms are only committed together with one of the current term. The caller must hold the mutex
+func (r *ReplicatedLog) becomeLeader() {
+	log.Infof("Node became the leader of the replicated log for term %d", r.term)
+	r.setLeader(RAFT_LEADER, r.node.ID)
+	r.nextIndex = map[string]uint64{}
+	r.matchIndex = map[string]uint64{}
+	r.replicators = map[string]chan struct{}{}
+
+	r.appendLocal(RaftCommand{Type: RAFT_NOOP})
+	r.startReplicators()
+	r.signalReplicators()
+}
+
+// Moves to a newer term, or back to follower. The caller must hold the mutex
+func (r *ReplicatedLog) stepDown(term uint64) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+		r.persistMeta()
+	}
+
+	if r.role == RAFT_LEADER {
+		log.Infof("Node is no longer the leader of the replicated log")
+	}
+	r.setLeader(RAFT_FOLLOWER, r.leader)
+}
+
+// Changes the role of this node and the leader it knows of, and wakes the waiters on the log if
+// either changed. The caller must hold the mutex
+func (r *ReplicatedLog) setLeader(role raftRole, leader string) {
+	if r.role == role && r.leader == leader {
+		return
+	}
+
+	r.role = role
+	r.leader = leader
+	r.notifyChanged()
+}
+
+// Wakes everyone waiting on the changed channel. The caller must hold the mutex
+func (r *ReplicatedLog) notifyChanged() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+func (r *ReplicatedLog) resetElectionTimeout() {
+	r.electionTimeout = RAFT_ELECTION_TIMEOUT + time.Duration(rand.Int63n(int64(RAFT_ELECTION_TIMEOUT)))
+}
+
+// Appends an entry of the current term to the leader's log. The caller must hold the mutex
+func (r *ReplicatedLog) appendLocal(command RaftCommand) {
+	entry := RaftEntry{Index: r.lastIndex() + 1, Term: r.term, Command: command}
+	r.entries = append(r.entries, entry)
+	r.persistEntries([]RaftEntry{entry})
+	r.advanceCommit()
+}
+
+// Nodes the leader sends the log to, every voter and every member of the cluster
+func (r *ReplicatedLog) isTarget(peer string) bool {
+	for _, target := range r.targets() {
+		if target == peer {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *ReplicatedLog) targets() []string {
+	targets := []string{}
+	seen := map[string]bool{r.node.ID: true}
+	for _, peer := range append(append([]string{}, r.voters...), r.node.Membership.List()...) {
+		if !seen[peer] {
+			seen[peer] = true
+			targets = append(targets, peer)
+		}
+	}
+
+	return targets
+}
+
+// Starts a replicator for every target that does not have one yet. The caller must hold the mutex
+func (r *ReplicatedLog) startReplicators() {
+	for _, peer := range r.targets() {
+		if _, running := r.replicators[peer]; running {
+			continue
+		}
+
+		signal := make(chan struct{}, 1)
+		r.replicators[peer] = signal
+		if _, known := r.nextIndex[peer]; !known {
+			r.nextIndex[peer] = r.lastIndex() + 1
+		}
+
+		go r.replicate(peer, r.term, signal)
+	}
+}
+
+// Wakes every replicator up. The caller must hold the mutex
+func (r *ReplicatedLog) signalReplicators() {
+	for _, signal := range r.replicators {
+		wakeReplicator(signal)
+	}
+}
+
+func wakeReplicator(signal chan struct{}) {
+	select {
+	case signal <- struct{}{}:
+	default:
+	}
+}
+
+// Goroutine that sends the log to one peer for as long as this node leads the given term. Each
+// time it is woken up it sends the next entries, or the snapshot if the peer is too far behind.
+func (r *ReplicatedLog) replicate(peer string, term uint64, signal chan struct{}) {
+	defer func() {
+		r.mutex.Lock()
+		if r.replicators[peer] == signal {
+			delete(r.replicators, peer)
+		}
+		r.mutex.Unlock()
+	}()
+
+	for {
+		select {
+		case <-signal:
+		case <-r.node.stop:
+			return
+		}
+
+		if r.node.isPaused() {
+			continue
+		}
+
+		r.mutex.Lock()
+		if r.role != RAFT_LEADER || r.term != term || !r.isTarget(peer) {
+			r.mutex.Unlock()
+			return
+		}
+
+		if r.nextIndex[peer] <= r.snapshotIndex {
+			args := &InstallSnapshotArgs{
+				Term:         term,
+				Leader:       r.node.ID,
+				Index:        r.snapshotIndex,
+				SnapshotTerm: r.snapshotTerm,
+				State:        r.snapshotState,
+			}
+			r.mutex.Unlock()
+
+			reply := &InstallSnapshotReply{}
+			if !r.call(peer, "Raft.InstallSnapshot", args, reply) {
+				continue
+			}
+
+			r.mutex.Lock()
+			if reply.Term > r.term {
+				r.stepDown(reply.Term)
+			} else if r.role == RAFT_LEADER && r.term == term {
+				if args.Index > r.matchIndex[peer] {
+					r.matchIndex[peer] = args.Index
+				}
+				r.nextIndex[peer] = args.Index + 1
+				wakeReplicator(signal)
+			}
+			r.mutex.Unlock()
+			continue
+		}
+
+		prevIndex := r.nextIndex[peer] - 1
+		prevTerm, _ := r.termAt(prevIndex)
+		lastIndex := r.lastIndex()
+		if lastIndex-prevIndex > uint64(RAFT_MAX_APPEND_ENTRIES) {
+			lastIndex = prevIndex + uint64(RAFT_MAX_APPEND_ENTRIES)
+		}
+		args := &AppendEntriesArgs{
+			Term:         term,
+			Leader:       r.node.ID,
+			PrevLogIndex: prevIndex,
+			PrevLogTerm:  prevTerm,
+			Entries:      append([]RaftEntry{}, r.entries[prevIndex-r.snapshotIndex:lastIndex-r.snapshotIndex]...),
+			LeaderCommit: r.commitIndex,
+		}
+		r.mutex.Unlock()
+
+		reply := &AppendEntriesReply{}
+		if !r.call(peer, "Raft.AppendEntries", args, reply) {
+			continue
+		}
+
+		r.mutex.Lock()
+		if reply.Term > r.term {
+			r.stepDown(reply.Term)
+			r.mutex.Unlock()
+			return
+		}
+		if r.role != RAFT_LEADER || r.term != term {
+			r.mutex.Unlock()
+			return
+		}
+
+		if reply.Success {
+			matchIndex := prevIndex + uint64(len(args.Entries))
+			if matchIndex > r.matchIndex[peer] {
+				r.matchIndex[peer] = matchIndex
+			}
+			r.nextIndex[peer] = matchIndex + 1
+			r.advanceCommit()
+		} else {
+			// Skip back past the conflicting entries the peer reported in one step
+			nextIndex := reply.ConflictIndex
+			if nextIndex > prevIndex {
+				nextIndex = prevIndex
+			}
+			if nextIndex < 1 {
+				nextIndex = 1
+			}
+			r.nextIndex[peer] = nextIndex
+		}
+
+		if r.nextIndex[peer] <= r.lastIndex() {
+			wakeReplicator(signal)
+		}
+		r.mutex.Unlock()
+	}
+}
+
+// Commits the newest entry of the current term that a majority of the voters stored. The caller
+// must hold the mutex
+func (r *ReplicatedLog) advanceCommit() {
+	for index := r.lastIndex(); index > r.commitIndex; index-- {
+		if term, _ := r.termAt(index); term != r.term {
+			return
+		}
+
+		count := 0
+		for _, voter := range r.voters {
+			if voter == r.node.ID || r.matchIndex[voter] >= index {
+				count++
+			}
+		}
+
+		if count > len(r.voters)/2 {
+			r.commitIndex = index
+			r.applyCommitted()
+			return
+		}
+	}
+}
+
+// Applies the committed entries to the request queues and answers the proposals waiting on them.
+// The caller must hold the mutex
+func (r *ReplicatedLog) applyCommitted() {
+	if r.lastApplied >= r.commitIndex {
+		return
+	}
+
+	for r.lastApplied < r.commitIndex {
+		index := r.lastApplied + 1
+		entry := r.entries[index-r.snapshotIndex-1]
+		r.node.setQueues(r.node.Queues().apply(entry.Command))
+		r.lastApplied = index
+
+		if waiter, waiting := r.waiters[index]; waiting {
+			waiter.done <- entry.Term == waiter.term
+			delete(r.waiters, index)
+		}
+	}
+
+	r.notifyChanged()
+	r.compact()
+}
+
+// Replaces the applied entries with a snapshot of the queues once there are enough of them.
+// The caller must hold the mutex
+func (r *ReplicatedLog) compact() {
+	if r.lastApplied-r.snapshotIndex < uint64(RAFT_SNAPSHOT_ENTRIES) {
+		return
+	}
+
+	r.snapshotTerm, _ = r.termAt(r.lastApplied)
+	r.entries = append([]RaftEntry{}, r.entries[r.lastApplied-r.snapshotIndex:]...)
+	r.snapshotIndex = r.lastApplied
+	r.snapshotState = r.node.Queues()
+
+	r.persistSnapshot()
+	r.rewriteLog()
+}
+
+// Called by the RequestVote RPC. A vote is granted once per term, to a candidate whose log is
+// at least as up to date as this node's
+func (r *ReplicatedLog) handleRequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if args.Term > r.term {
+		r.stepDown(args.Term)
+	}
+	reply.Term = r.term
+	if args.Term < r.term || !r.isVoter {
+		return
+	}
+
+	lastTerm := r.lastTerm()
+	upToDate := args.LastLogTerm > lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex >= r.lastIndex())
+	if (r.votedFor == "" || r.votedFor == args.Candidate) && upToDate {
+		r.votedFor = args.Candidate
+		r.persistMeta()
+		r.lastContact = time.Now()
+		reply.VoteGranted = true
+	}
+}
+
+// Called by the AppendEntries RPC. Appends the entries if the log matches the leader's log at the
+// entry before them, dropping any entries of this node that conflict with them
+func (r *ReplicatedLog) handleAppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if args.Term > r.term {
+		r.stepDown(args.Term)
+	}
+	reply.Term = r.term
+	if args.Term < r.term {
+		return
+	}
+
+	r.setLeader(RAFT_FOLLOWER, args.Leader)
+	r.lastContact = time.Now()
+
+	prevIndex := args.PrevLogIndex
+	entries := args.Entries
+	if prevIndex < r.snapshotIndex {
+		// Entries up to the snapshot are committed and match the leader's
+		skip := r.snapshotIndex - prevIndex
+		if uint64(len(entries)) <= skip {
+			entries = nil
+		} else {
+			entries = entries[skip:]
+		}
+		prevIndex = r.snapshotIndex
+
+	} else if prevIndex > r.lastIndex() {
+		reply.ConflictIndex = r.lastIndex() + 1
+		return
+
+	} else if prevTerm, _ := r.termAt(prevIndex); prevTerm != args.PrevLogTerm {
+		// Report the first entry of the conflicting term so the leader skips all of them
+		conflictIndex := prevIndex
+		for conflictIndex > r.snapshotIndex+1 {
+			if term, _ := r.termAt(conflictIndex - 1); term != prevTerm {
+				break
+			}
+			conflictIndex--
+		}
+		reply.ConflictIndex = conflictIndex
+		return
+	}
+
+	for i, entry := range entries {
+		if entry.Index <= r.lastIndex() {
+			if term, _ := r.termAt(entry.Index); term == entry.Term {
+				continue
+			}
+
+			r.entries = append([]RaftEntry{}, r.entries[:entry.Index-r.snapshotIndex-1]...)
+			r.entries = append(r.entries, entries[i:]...)
+			r.rewriteLog()
+			break
+		}
+
+		r.entries = append(r.entries, entries[i:]...)
+		r.persistEntries(entries[i:])
+		break
+	}
+
+	lastNewIndex := prevIndex + uint64(len(entries))
+	if args.LeaderCommit > r.commitIndex {
+		r.commitIndex = args.LeaderCommit
+		if lastNewIndex < r.commitIndex {
+			r.commitIndex = lastNewIndex
+		}
+		r.applyCommitted()
+	}
+
+	reply.Success = true
+}
+
+// Called by the InstallSnapshot RPC when this node is missing entries the leader compacted
+func (r *ReplicatedLog) handleInstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if args.Term > r.term {
+		r.stepDown(args.Term)
+	}
+	reply.Term = r.term
+	if args.Term < r.term {
+		return
+	}
+
+	r.setLeader(RAFT_FOLLOWER, args.Leader)
+	r.lastContact = time.Now()
+	if args.Index <= r.lastApplied {
+		return
+	}
+
+	// Keep the entries after the snapshot if they match the leader's log
+	if term, known := r.termAt(args.Index); known && term == args.SnapshotTerm {
+		r.entries = append([]RaftEntry{}, r.entries[args.Index-r.snapshotIndex:]...)
+	} else {
+		r.entries = nil
+	}
+
+	log.Infof("Installing snapshot of the replicated log at index %d", args.Index)
+	r.snapshotIndex = args.Index
+	r.snapshotTerm = args.SnapshotTerm
+	r.snapshotState = args.State
+	r.node.setQueues(args.State)
+	r.lastApplied = args.Index
+	if r.commitIndex < args.Index {
+		r.commitIndex = args.Index
+	}
+
+	// Proposals of this node up to the snapshot can not be matched to their entries anymore
+	for index, waiter := range r.waiters {
+		if index <= args.Index {
+			waiter.done <- false
+			delete(r.waiters, index)
+		}
+	}
+
+	r.persistSnapshot()
+	r.rewriteLog()
+	r.notifyChanged()
+	r.applyCommitted()
+}
+
+// Helpers that translate log indexes. Index 0 is the empty log and entries start at index 1
+func (r *ReplicatedLog) lastIndex() uint64 {
+	return r.snapshotIndex + uint64(len(r.entries))
+}
+
+func (r *ReplicatedLog) lastTerm() uint64 {
+	term, _ := r.termAt(r.lastIndex())
+	return term
+}
+
+// Returns the term of the entry at index, if it is the last snapshotted entry or still in the log
+func (r *ReplicatedLog) termAt(index uint64) (uint64, bool) {
+	if index == r.snapshotIndex {
+		return r.snapshotTerm, true
+	}
+	if index < r.snapshotIndex || index > r.lastIndex() {
+		return 0, false
+	}
+
+	return r.entries[index-r.snapshotIndex-1].Term, true
+}
+
+// Calls a raft RPC on a peer, giving up after RAFT_RPC_TIMEOUT. Connections to the peers are kept
+// open between calls since the leader calls every peer each heartbeat
+func (r *ReplicatedLog) call(peer string, method string, args interface{}, reply interface{}) bool {
+	r.clientMutex.Lock()
+	client, connected := r.clients[peer]
+	r.clientMutex.Unlock()
+
+	if !connected {
+		var err error
+		client, err = dialRPC(peer, RAFT_RPC_PORT, RAFT_RPC_TIMEOUT)
+		if err != nil {
+			return false
+		}
+
+		r.clientMutex.Lock()
+		if r.node.isStopped() {
+			r.clientMutex.Unlock()
+			client.Close()
+			return false
+		}
+		if oldClient, raced := r.clients[peer]; raced {
+			client.Close()
+			client = oldClient
+		} else {
+			r.clients[peer] = client
+		}
+		r.clientMutex.Unlock()
+	}
+
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error == nil {
+			return true
+		}
+	case <-time.After(RAFT_RPC_TIMEOUT):
+	case <-r.node.stop:
+		return false
+	}
+
+	r.clientMutex.Lock()
+	if r.clients[peer] == client {
+		delete(r.clients, peer)
+		client.Close()
+	}
+	r.clientMutex.Unlock()
+
+	return false
+}
+
+// Closes the connections to the peers and the log file once the node is killed
+func (r *ReplicatedLog) close() {
+	r.clientMutex.Lock()
+	for peer, client := range r.clients {
+		client.Close()
+		delete(r.clients, peer)
+	}
+	r.clientMutex.Unlock()
+
+	r.mutex.Lock()
+	if r.logFile != nil {
+		r.logFile.Close()
+		r.logFile = nil
+	}
+	r.mutex.Unlock()
+}
+
+// Reads the persisted term, snapshot and entries. A log line that was only partly written
+// before a crash ends the log
+func (r *ReplicatedLog) load() error {
+	metaContents, err := ioutil.ReadFile(r.path(RAFT_META_FILE_NAME))
+	if err == nil {
+		meta := raftMeta{}
+		err = json.Unmarshal(metaContents, &meta)
+		if err != nil {
+			return err
+		}
+		r.term = meta.Term
+		r.votedFor = meta.VotedFor
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	snapshotContents, err := ioutil.ReadFile(r.path(RAFT_SNAPSHOT_FILE_NAME))
+	if err == nil {
+		snapshot := raftSnapshot{}
+		err = json.Unmarshal(snapshotContents, &snapshot)
+		if err != nil {
+			return err
+		}
+		r.snapshotIndex = snapshot.Index
+		r.snapshotTerm = snapshot.Term
+		if snapshot.State == nil {
+			snapshot.State = &RequestQueues{}
+		}
+		r.snapshotState = snapshot.State
+		r.node.setQueues(snapshot.State)
+		r.commitIndex = snapshot.Index
+		r.lastApplied = snapshot.Index
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	logFile, err := os.Open(r.path(RAFT_LOG_FILE_NAME))
+	if err == nil {
+		scanner := bufio.NewScanner(logFile)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for scanner.Scan() {
+			entry := RaftEntry{}
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil || entry.Index > r.lastIndex()+1 {
+				break
+			}
+			if entry.Index <= r.snapshotIndex {
+				continue
+			}
+
+			r.entries = append(r.entries[:entry.Index-r.snapshotIndex-1], entry)
+		}
+		logFile.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if r.lastIndex() > 0 {
+		log.Infof("Recovered replicated log up to index %d in term %d", r.lastIndex(), r.term)
+	}
+
+	return r.rewriteLog()
+}
+
+// Helpers that write the raft state to disk. A node that can not persist keeps running, but logs
+// the error since it may forget votes and entries when it restarts
+func (r *ReplicatedLog) persistMeta() {
+	metaContents, _ := json.Marshal(raftMeta{Term: r.term, VotedFor: r.votedFor})
+	err := writeFileAtomic(r.path(RAFT_META_FILE_NAME), metaContents)
+	if err != nil {
+		log.Infof("Could not persist the term of the replicated log! %s", err)
+	}
+}
+
+func (r *ReplicatedLog) persistSnapshot() {
+	snapshotContents, _ := json.Marshal(raftSnapshot{Index: r.snapshotIndex, Term: r.snapshotTerm, State: r.snapshotState})
+	err := writeFileAtomic(r.path(RAFT_SNAPSHOT_FILE_NAME), snapshotContents)
+	if err != nil {
+		log.Infof("Could not persist the snapshot of the replicated log! %s", err)
+	}
+}
+
+func (r *ReplicatedLog) persistEntries(entries []RaftEntry) {
+	if r.logFile == nil {
+		return
+	}
+
+	logContents := []byte{}
+	for _, entry := range entries {
+		entryContents, _ := json.Marshal(entry)
+		logContents = append(append(logContents, entryContents...), '\n')
+	}
+
+	_, err := r.logFile.Write(logContents)
+	if err == nil {
+		err = r.logFile.Sync()
+	}
+	if err != nil {
+		log.Infof("Could not persist entries of the replicated log! %s", err)
+	}
+}
+
+// Writes the whole log again, used after entries were dropped
+func (r *ReplicatedLog) rewriteLog() error {
+	if r.logFile != nil {
+		r.logFile.Close()
+		r.logFile = nil
+	}
+
+	logContents := []byte{}
+	for _, entry := range r.entries {
+		entryContents, _ := json.Marshal(entry)
+		logContents = append(append(logContents, entryContents...), '\n')
+	}
+
+	err := writeFileAtomic(r.path(RAFT_LOG_FILE_NAME), logContents)
+	if err == nil {
+		r.logFile, err = os.OpenFile(r.path(RAFT_LOG_FILE_NAME), os.O_APPEND|os.O_WRONLY, 0666)
+	}
+	if err != nil {
+		log.Infof("Could not persist the replicated log! %s", err)
+	}
+
+	return err
+}
+
+func (r *ReplicatedLog) path(fileName string) string {
+	return r.node.dataPath(RAFT_FOLDER_NAME, fileName)
+}
+
+// Writes a file through a temporary file, so a crash leaves either the old or the new contents
+func writeFileAtomic(filePath string, contents []byte) error {
+	tempFile, err := os.Create(filePath + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tempFile.Write(contents)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	tempFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(filePath+".tmp", filePath)
+}
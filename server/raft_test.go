@@ -0,0 +1,195 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+)
+
+// Helper that returns the replicated log of a node that only talks to its test through the
+// handlers of the raft RPCs
+func newTestLog(t *testing.T, nodeID string, dataDir string, voters ...string) *ReplicatedLog {
+	node := &Node{ID: nodeID, DataDir: dataDir, Membership: newMembershipList(nodeID), queues: &RequestQueues{}, stop: make(chan struct{})}
+	replicatedLog, err := newReplicatedLog(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.Log = replicatedLog
+	t.Cleanup(replicatedLog.close)
+
+	replicatedLog.voters = voters
+	replicatedLog.isVoter = false
+	for _, voter := range voters {
+		replicatedLog.isVoter = replicatedLog.isVoter || voter == nodeID
+	}
+
+	return replicatedLog
+}
+
+// Helper that makes the log of a single voter its leader and proposes a put of every file
+func proposePuts(t *testing.T, leader *ReplicatedLog, fileNames ...string) {
+	leader.mutex.Lock()
+	if leader.role != RAFT_LEADER {
+		leader.startElection()
+	}
+	leader.mutex.Unlock()
+
+	for _, fileName := range fileNames {
+		_, err := leader.Propose(RaftCommand{Type: RAFT_PUT_FILE, File: &FileMetadata{Name: fileName, Version: 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Helper that sends the entries of the leader after index to a follower
+func appendFrom(leader *ReplicatedLog, follower *ReplicatedLog, index uint64) *AppendEntriesReply {
+	prevTerm, _ := leader.termAt(index)
+	args := &AppendEntriesArgs{
+		Term:         leader.term,
+		Leader:       leader.node.ID,
+		PrevLogIndex: index,
+		PrevLogTerm:  prevTerm,
+		Entries:      leader.entries[index-leader.snapshotIndex:],
+		LeaderCommit: leader.commitIndex,
+	}
+	reply := &AppendEntriesReply{}
+	follower.handleAppendEntries(args, reply)
+
+	return reply
+}
+
+// A single voter elects itself and commits its proposals without any other node
+func TestElectSingleVoter(t *testing.T) {
+	leader := newTestLog(t, "n1", t.TempDir(), "n1")
+	proposePuts(t, leader, "a.txt", "b.txt")
+
+	if term, isLeader := leader.LeaderTerm(); !isLeader || term != 1 {
+		t.Fatalf("Node leads term %d %t, expected to lead term 1", term, isLeader)
+	}
+	if leader.commitIndex != 3 || len(leader.node.Queues().Files) != 2 {
+		t.Fatalf("Committed up to %d with files %v, expected the empty entry and both puts", leader.commitIndex, leader.node.Queues().Files)
+	}
+}
+
+// A vote is granted once per term, and only to candidates whose log is at least as up to date
+func TestRequestVote(t *testing.T) {
+	leader := newTestLog(t, "n1", t.TempDir(), "n1")
+	proposePuts(t, leader, "a.txt")
+	voter := newTestLog(t, "n2", t.TempDir(), "n1", "n2", "n3")
+	appendFrom(leader, voter, 0)
+
+	requestVote := func(candidate string, term uint64, lastIndex uint64, lastTerm uint64) bool {
+		reply := &RequestVoteReply{}
+		voter.handleRequestVote(&RequestVoteArgs{Term: term, Candidate: candidate, LastLogIndex: lastIndex, LastLogTerm: lastTerm}, reply)
+		return reply.VoteGranted
+	}
+
+	if requestVote("n3", 2, 1, 1) {
+		t.Fatal("Vote was granted to a candidate with a shorter log")
+	}
+	if voter.Term() != 2 {
+		t.Fatalf("Voter is in term %d, expected the term of the candidate", voter.Term())
+	}
+	if !requestVote("n1", 2, 2, 1) {
+		t.Fatal("Vote was not granted to a candidate with an up to date log")
+	}
+	if requestVote("n3", 2, 5, 2) {
+		t.Fatal("Vote was granted twice in the same term")
+	}
+	if !requestVote("n3", 3, 5, 2) {
+		t.Fatal("Vote was not granted in a newer term")
+	}
+}
+
+// An entry is committed once a majority of the voters stored it, and entries of earlier terms only
+// along with an entry of the current term
+func TestCommitMajority(t *testing.T) {
+	leader := newTestLog(t, "n1", t.TempDir(), "n1", "n2", "n3")
+	leader.entries = []RaftEntry{{Index: 1, Term: 1, Command: RaftCommand{Type: RAFT_NOOP}}}
+	leader.term = 2
+	leader.role = RAFT_LEADER
+
+	leader.matchIndex["n2"] = 1
+	leader.advanceCommit()
+	if leader.commitIndex != 0 {
+		t.Fatal("Entry of an earlier term was committed on its own")
+	}
+
+	leader.appendLocal(RaftCommand{Type: RAFT_PUT_FILE, File: &FileMetadata{Name: "a.txt", Version: 1}})
+	if leader.commitIndex != 0 {
+		t.Fatal("Entry was committed before another voter stored it")
+	}
+	leader.matchIndex["n3"] = 2
+	leader.advanceCommit()
+	if leader.commitIndex != 2 || leader.node.Queues().Files["a.txt"] == nil {
+		t.Fatalf("Committed up to %d, expected both entries", leader.commitIndex)
+	}
+}
+
+// Followers append the leader's entries, apply what the leader committed and drop the entries
+// of an old leader that conflict with the new one
+func TestReplicateEntries(t *testing.T) {
+	leader := newTestLog(t, "n1", t.TempDir(), "n1")
+	proposePuts(t, leader, "a.txt", "b.txt")
+	follower := newTestLog(t, "n2", t.TempDir(), "n1")
+
+	if reply := appendFrom(leader, follower, 2); reply.Success || reply.ConflictIndex != 1 {
+		t.Fatalf("Entries after a gap were answered with %+v, expected a conflict at 1", reply)
+	}
+	if reply := appendFrom(leader, follower, 0); !reply.Success {
+		t.Fatal("Entries were not appended")
+	}
+	if follower.Leader() != "n1" || follower.lastApplied != 3 || len(follower.node.Queues().Files) != 2 {
+		t.Fatalf("Follower applied up to %d, expected every entry of the leader", follower.lastApplied)
+	}
+
+	// An entry the follower got from the old leader is replaced by the entry of the new leader
+	follower.entries = append(follower.entries, RaftEntry{Index: 4, Term: 1, Command: RaftCommand{Type: RAFT_PUT_FILE, File: &FileMetadata{Name: "lost.txt", Version: 1}}})
+	leader.term = 2
+	proposePuts(t, leader, "c.txt")
+	if reply := appendFrom(leader, follower, 3); !reply.Success {
+		t.Fatal("Entries of the new leader were not appended")
+	}
+	files := follower.node.Queues().Files
+	if files["lost.txt"] != nil || files["c.txt"] == nil || follower.lastIndex() != 4 {
+		t.Fatalf("Follower has files %v, expected the conflicting entry to be replaced", files)
+	}
+}
+
+// A follower that is missing compacted entries installs the leader's snapshot and continues with
+// the entries after it. The snapshot and the entries are recovered after a restart
+func TestInstallSnapshot(t *testing.T) {
+	defer func(snapshotEntries int) { RAFT_SNAPSHOT_ENTRIES = snapshotEntries }(RAFT_SNAPSHOT_ENTRIES)
+	RAFT_SNAPSHOT_ENTRIES = 4
+
+	leader := newTestLog(t, "n1", t.TempDir(), "n1")
+	fileNames := []string{}
+	for i := 0; i < 6; i++ {
+		fileNames = append(fileNames, strconv.Itoa(i)+".txt")
+	}
+	proposePuts(t, leader, fileNames...)
+	if leader.snapshotIndex != 4 || len(leader.entries) != 3 {
+		t.Fatalf("Leader compacted up to %d, expected 4", leader.snapshotIndex)
+	}
+
+	dataDir := t.TempDir()
+	follower := newTestLog(t, "n2", dataDir, "n1")
+	if reply := appendFrom(leader, follower, leader.snapshotIndex); reply.Success {
+		t.Fatal("Entries after the snapshot were appended to an empty log")
+	}
+
+	args := &InstallSnapshotArgs{Term: leader.term, Leader: "n1", Index: leader.snapshotIndex, SnapshotTerm: leader.snapshotTerm, State: leader.snapshotState}
+	follower.handleInstallSnapshot(args, &InstallSnapshotReply{})
+	if follower.lastApplied != 4 || len(follower.node.Queues().Files) != 3 {
+		t.Fatalf("Follower applied up to %d after the snapshot, expected 4", follower.lastApplied)
+	}
+	if reply := appendFrom(leader, follower, leader.snapshotIndex); !reply.Success || len(follower.node.Queues().Files) != 6 {
+		t.Fatal("Entries after the snapshot were not applied")
+	}
+
+	follower.close()
+	restarted := newTestLog(t, "n2", dataDir, "n1")
+	if restarted.snapshotIndex != 4 || restarted.lastIndex() != 7 || len(restarted.node.Queues().Files) != 3 {
+		t.Fatalf("Restarted follower recovered the log up to %d with a snapshot at %d", restarted.lastIndex(), restarted.snapshotIndex)
+	}
+}
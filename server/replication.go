@@ -0,0 +1,381 @@
+package server
+
+import (
+	"container/heap"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of files that are copied to new replicas at the same time
+var REPLICATION_WORKER_COUNT int = 4
+
+// How long a file waits before it is tried again after a copy failed
+var REPLICATION_RETRY_INTERVAL time.Duration = time.Second
+
+// How often the fileMaster checks all of its files, in case a change of the membership list was
+// missed or a fileGroup was changed by another node
+var REPLICATION_SCAN_INTERVAL time.Duration = 10 * time.Second
+
+// Files that are not on their replicas this long after they were queued are reported as late
+var REPLICATION_DEADLINE time.Duration = 30 * time.Second
+
+// A file that has to be moved to the replicas the hash ring places it on. Files with fewer live
+// replicas are copied first, since they are the closest to being lost
+type replicationTask struct {
+	FileName string
+	Replicas int
+	QueuedAt time.Time
+	index    int
+}
+
+// Progress of the re-replication on this node. Pending files wait in the queue, Copying files are
+// being copied, and Restored and Failed count the finished and failed copies since the node started.
+// Late is the number of queued files that have waited longer than REPLICATION_DEADLINE
+type ReplicationStatus struct {
+	Pending  int
+	Copying  int
+	Restored int
+	Failed   int
+	Late     int
+	Oldest   time.Duration
+}
+
+// Priority queue of the files this node is the fileMaster of that are not on their replicas. A
+// file is in the queue at most once, and a file that is queued again while it is copied is put
+// back once the copy is done, so the newest fileGroup is always checked
+type ReplicationQueue struct {
+	mutex    sync.Mutex
+	tasks    replicationHeap
+	queued   map[string]*replicationTask
+	copying  map[string]bool
+	requeue  map[string]bool
+	wake     chan struct{}
+	restored int
+	failed   int
+}
+
+func newReplicationQueue() *ReplicationQueue {
+	return &ReplicationQueue{
+		queued:  map[string]*replicationTask{},
+		copying: map[string]bool{},
+		requeue: map[string]bool{},
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Queues a file, or raises its priority if it is already queued with more replicas
+func (queue *ReplicationQueue) push(fileName string, replicas int) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.copying[fileName] {
+		queue.requeue[fileName] = true
+		return
+	}
+
+	if task, contains := queue.queued[fileName]; contains {
+		if replicas < task.Replicas {
+			task.Replicas = replicas
+			heap.Fix(&queue.tasks, task.index)
+		}
+		return
+	}
+
+	task := &replicationTask{FileName: fileName, Replicas: replicas, QueuedAt: time.Now()}
+	queue.queued[fileName] = task
+	heap.Push(&queue.tasks, task)
+
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Takes the file with the fewest replicas out of the queue, or returns nil if the queue is empty
+func (queue *ReplicationQueue) pop() *replicationTask {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if len(queue.tasks) == 0 {
+		return nil
+	}
+
+	task := heap.Pop(&queue.tasks).(*replicationTask)
+	delete(queue.queued, task.FileName)
+	queue.copying[task.FileName] = true
+
+	// Let the next worker take the next file
+	if len(queue.tasks) != 0 {
+		select {
+		case queue.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return task
+}
+
+// Marks the copy of a file as done. Returns if the file was queued again while it was copied
+func (queue *ReplicationQueue) finish(task *replicationTask, success bool) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	delete(queue.copying, task.FileName)
+	if success {
+		queue.restored++
+	} else {
+		queue.failed++
+	}
+
+	requeue := queue.requeue[task.FileName]
+	delete(queue.requeue, task.FileName)
+	return requeue
+}
+
+// Returns the progress of the re-replication
+func (queue *ReplicationQueue) Status() ReplicationStatus {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	status := ReplicationStatus{
+		Pending:  len(queue.tasks),
+		Copying:  len(queue.copying),
+		Restored: queue.restored,
+		Failed:   queue.failed,
+	}
+	for _, task := range queue.tasks {
+		waited := time.Since(task.QueuedAt)
+		if waited > status.Oldest {
+			status.Oldest = waited
+		}
+		if waited > REPLICATION_DEADLINE {
+			status.Late++
+		}
+	}
+
+	return status
+}
+
+// Heap of the queued files ordered by their number of replicas, then by the time they were queued
+type replicationHeap []*replicationTask
+
+func (tasks replicationHeap) Len() int { return len(tasks) }
+
+func (tasks replicationHeap) Less(i, j int) bool {
+	if tasks[i].Replicas != tasks[j].Replicas {
+		return tasks[i].Replicas < tasks[j].Replicas
+	}
+	return tasks[i].QueuedAt.Before(tasks[j].QueuedAt)
+}
+
+func (tasks replicationHeap) Swap(i, j int) {
+	tasks[i], tasks[j] = tasks[j], tasks[i]
+	tasks[i].index = i
+	tasks[j].index = j
+}
+
+func (tasks *replicationHeap) Push(task interface{}) {
+	task.(*replicationTask).index = len(*tasks)
+	*tasks = append(*tasks, task.(*replicationTask))
+}
+
+func (tasks *replicationHeap) Pop() interface{} {
+	old := *tasks
+	task := old[len(old)-1]
+	*tasks = old[:len(old)-1]
+	return task
+}
+
+// Goroutine that starts the replication workers and checks every file of this node each
+// REPLICATION_SCAN_INTERVAL. Changes of the membership list queue the files right away through
+// the FileSystemManager. The files a restarted node recovered are reconciled first
+func (node *Node) ReplicationManager() {
+	for i := 0; i < REPLICATION_WORKER_COUNT; i++ {
+		go node.replicationWorker()
+	}
+	go node.reconcileLocalFiles()
+
+	ticker := time.NewTicker(REPLICATION_SCAN_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-node.stop:
+			return
+		}
+
+		node.dropOrphanFiles()
+		node.dropStaleTransfers()
+		node.placeFiles()
+		status := node.Replication.Status()
+		if status.Late != 0 {
+			log.Infof("%d files are still not on all of their replicas after %s! %d pending, %d copying",
+				status.Late, REPLICATION_DEADLINE, status.Pending, status.Copying)
+		}
+	}
+}
+
+// Goroutine that copies the queued files to their replicas, one at a time
+func (node *Node) replicationWorker() {
+	for !node.isStopped() {
+		task := node.Replication.pop()
+		if task == nil {
+			select {
+			case <-node.Replication.wake:
+			case <-node.stop:
+			}
+			continue
+		}
+
+		success := node.replicateFile(task.FileName)
+		requeue := node.Replication.finish(task, success)
+
+		status := node.Replication.Status()
+		if success {
+			log.Infof("File %s is on its replicas after %s. %d pending, %d copying, %d restored",
+				task.FileName, time.Since(task.QueuedAt).Round(time.Millisecond), status.Pending, status.Copying, status.Restored)
+		} else {
+			log.Infof("Could not copy file %s to all of its replicas, trying again in %s", task.FileName, REPLICATION_RETRY_INTERVAL)
+		}
+
+		if requeue {
+			node.queueFile(task.FileName)
+		} else if !success {
+			fileName := task.FileName
+			time.AfterFunc(REPLICATION_RETRY_INTERVAL, func() { node.queueFile(fileName) })
+		}
+	}
+}
+
+// Finds the files this node is the fileMaster of that are not stored on the members the hash ring
+// places them on, and queues them to be moved there. This restores the replicas of files on
+// failed nodes, and moves files to new members when they join
+func (node *Node) placeFiles() {
+	for fileName := range node.LocalFiles.Files() {
+		node.queueFile(fileName)
+	}
+}
+
+// Queues the file if this node is its fileMaster and its fileGroup differs from its replicas
+func (node *Node) queueFile(fileName string) {
+	fileGroup, contains := node.LocalFiles.FileGroup(fileName)
+	if !contains || len(fileGroup) == 0 || fileGroup[0] != node.ID {
+		return
+	}
+
+	replicaSet := node.Membership.ReplicaSet(fileName, NUM_REPLICAS)
+	if strings.Join(replicaSet, ",") != strings.Join(fileGroup, ",") {
+		node.Replication.push(fileName, len(fileGroup))
+	}
+}
+
+// Moves a file to the members the hash ring places it on. Returns false if it could not be copied
+// to all of them, in which case the members that do not have it stay out of its fileGroup. Files
+// that are not in the metadata directory are not moved, since they were deleted or their put was
+// not committed yet
+func (node *Node) replicateFile(fileName string) bool {
+	fileGroup, contains := node.LocalFiles.FileGroup(fileName)
+	if !contains || len(fileGroup) == 0 || fileGroup[0] != node.ID {
+		return true
+	}
+
+	metadata, committed := node.FileMetadata(fileName)
+	if !committed {
+		return true
+	}
+
+	replicaSet := node.Membership.ReplicaSet(fileName, NUM_REPLICAS)
+	if strings.Join(replicaSet, ",") == strings.Join(fileGroup, ",") {
+		return true
+	}
+
+	log.Infof("Resharding file %s from %v to %v", fileName, fileGroup, replicaSet)
+	success, storedGroup, versions := node.reshardFiles(metadata, fileGroup, replicaSet)
+	node.updateReplicas(fileName, metadata.Version, versions, storedGroup)
+	return success
+}
+
+// Sends the kept versions of the file to the members of the new fileGroup that do not have it
+// yet, then tells every member of the old and the new fileGroup about the change. Old members that
+// are not in the new fileGroup drop their copy, unless a copy failed, so the file never has fewer
+// replicas than before. Returns the members that store the file afterwards and the versions that
+// were copied to them
+func (node *Node) reshardFiles(metadata FileMetadata, fileGroup []string, newFileGroup []string) (bool, []string, []int) {
+	fileName := metadata.Name
+	versions := []int{}
+	for _, version := range node.LocalFiles.Versions(fileName) {
+		if _, kept := metadata.FindVersion(version); kept {
+			versions = append(versions, version)
+		}
+	}
+	if len(versions) == 0 {
+		log.Infof("No kept version of file %s is stored on this node to reshard it!", fileName)
+		return false, fileGroup, versions
+	}
+
+	oldMembers := map[string]bool{}
+	for _, member := range fileGroup {
+		oldMembers[member] = true
+	}
+
+	// Send every version and the new group over to the new members of the fileGroup
+	storedGroup := []string{}
+	for _, member := range newFileGroup {
+		if oldMembers[member] || node.sendVersions(member, metadata, newFileGroup, versions) {
+			storedGroup = append(storedGroup, member)
+		}
+	}
+
+	// The old members stay first if a copy failed, so this node stays the fileMaster and retries
+	success := len(storedGroup) == len(newFileGroup)
+	if !success {
+		for _, member := range storedGroup {
+			if !containsMember(fileGroup, member) {
+				fileGroup = append(fileGroup, member)
+			}
+		}
+		storedGroup = fileGroup
+	}
+
+	// Update the fileGroup for the original and the new owners of the file
+	updateFileGroupArgs := &ServerRequestArgs{
+		FileName: fileName,
+		HostList: storedGroup,
+	}
+	for _, member := range storedGroup {
+		CallServerCommunicationRPC(member, "ServerCommunication.UpdateFileGroup", updateFileGroupArgs)
+	}
+	for member := range oldMembers {
+		if !containsMember(storedGroup, member) {
+			CallServerCommunicationRPC(member, "ServerCommunication.UpdateFileGroup", updateFileGroupArgs)
+		}
+	}
+
+	return success, storedGroup, versions
+}
+
+// Streams the versions of a file to a member and returns if it stored all of them. The member
+// checks every version against its checksum, so a corrupt copy is not spread
+func (node *Node) sendVersions(member string, metadata FileMetadata, fileGroup []string, versions []int) bool {
+	for _, version := range versions {
+		fileVersion, _ := metadata.FindVersion(version)
+		if !StreamVersion(member, node.versionPath(metadata.Name, version), metadata.Name, version, fileVersion.Checksum, fileGroup) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsMember(members []string, member string) bool {
+	for _, listMember := range members {
+		if listMember == member {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,423 @@
+package server
+
+import (
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Commands that can be appended to the replicated log
+const (
+	RAFT_NOOP            = "Noop"
+	RAFT_RESERVE_VERSION = "ReserveVersion"
+	RAFT_PUT_FILE        = "PutFile"
+	RAFT_APPEND_FILE     = "AppendFile"
+	RAFT_ABORT_PUT       = "AbortPut"
+	RAFT_RENEW_UPLOAD    = "RenewUpload"
+	RAFT_DELETE_FILE     = "DeleteFile"
+	RAFT_UPDATE_REPLICAS = "UpdateReplicas"
+	RAFT_MAKE_DIR        = "MakeDir"
+	RAFT_REMOVE_DIR      = "RemoveDir"
+	RAFT_MOVE_PATH       = "MovePath"
+	RAFT_SUBMIT_JOB      = "SubmitJob"
+	RAFT_COMPLETE_JOB    = "CompleteJob"
+	RAFT_PLAN_JOB        = "PlanJob"
+	RAFT_ASSIGN_TASKS    = "AssignTasks"
+	RAFT_RELEASE_TASKS   = "ReleaseTasks"
+	RAFT_COMPLETE_TASKS  = "CompleteTasks"
+)
+
+// Number of finished request and job IDs remembered, so a proposal that is retried after it
+// was already applied does not change a file or add a job again
+var FINISHED_ID_HISTORY int = 1000
+
+// An entry of the replicated log. ID is the request that changes a file, or the job a complete
+// refers to. Blocks are the blocks of a put that was split, and an append is written on top of
+// version Base. A move of the path of File to Target moves the files in Moves. The task commands
+// checkpoint the progress of job ID made by Worker. Time is when the command was proposed, so every
+// node applies it with the same time
+type RaftCommand struct {
+	Type    string
+	ID      string
+	Time    time.Time
+	File    *FileMetadata
+	Blocks  []*FileMetadata
+	Base    int
+	Target  string
+	Moves   []FileMove
+	Job     *MapleJuiceRequest
+	Worker  string
+	Tasks   []string
+	Outputs map[string]TaskOutput
+}
+
+// The metadata of the sdfs files and the MapleJuice job queue. Every node applies the commands of
+// the replicated log in the same order, so they all end up with the same queues. Applying a command
+// builds new slices and maps, so callers that are reading the old queues are not affected.
+// Dirs holds every directory of the namespace, files are in the directory their path starts with
+type RequestQueues struct {
+	Files    map[string]*FileMetadata
+	Dirs     map[string]bool
+	Uploads  map[string]*FileUpload
+	MJQueue  []*MapleJuiceRequest
+	Finished []string
+	Progress map[string]*JobProgress
+}
+
+// Checkpoint of a running MapleJuice job, so a new master continues where the old one stopped.
+// The tasks are the input files of a maple job and the intermediate key files of a juice job.
+// Outputs holds where the reducer output of every completed juice task is stored until the job is
+// written out.
+type JobProgress struct {
+	Tasks     []string
+	Assigned  map[string]string
+	Completed map[string]bool
+	Outputs   map[string]TaskOutput
+}
+
+// Reducer output of a juice task. The worker puts it in the sdfs, so only the name and the
+// checksum of the file are in the replicated log. A task without output has no file
+type TaskOutput struct {
+	FileName string
+	Checksum string
+}
+
+// Returns the queues after the command is applied
+func (queues *RequestQueues) apply(command RaftCommand) *RequestQueues {
+	next := &RequestQueues{Files: queues.Files, Dirs: queues.Dirs, Uploads: queues.Uploads, MJQueue: queues.MJQueue, Finished: queues.Finished, Progress: queues.Progress}
+
+	switch command.Type {
+	case RAFT_RESERVE_VERSION:
+		// Every put of a file gets its own version before it is stored, so puts at the same time
+		// never write over each other. A file is only reserved by one put at a time, and a put only
+		// reserves it once, since a reservation that was retried may be appended twice
+		if command.File == nil || queues.Uploads[command.ID] != nil || queues.isFinished(command.ID) || queues.isWriting(command.File.Name, command.Time) {
+			return queues
+		}
+		upload := &FileUpload{FileName: command.File.Name, Version: queues.nextVersion(command.File.Name), Started: command.Time}
+		next.Uploads = queues.addUpload(command.ID, upload)
+		next.Finished = queues.finish(command.ID)
+
+	case RAFT_ABORT_PUT:
+		if command.File == nil {
+			return queues
+		}
+		next.Uploads = queues.abortUpload(command.File.Name, command.File.Version)
+
+	case RAFT_RENEW_UPLOAD:
+		// A put renews its lease while its chunks arrive. A lease that already ran out is not
+		// renewed, since another put may hold the file by now
+		if command.File == nil {
+			return queues
+		}
+		next.Uploads = queues.renewUpload(command.File.Name, command.File.Version, command.Time)
+
+	case RAFT_PUT_FILE, RAFT_APPEND_FILE:
+		// A version is only added if it is newer than the newest one, since a put that finished
+		// later than a newer put would otherwise replace it. An append is only added on top of the
+		// version it was written on, and only once. The directories of the file are made if they
+		// do not exist yet. A put that is not added gives up its reservation of the file
+		if command.File == nil {
+			return queues
+		}
+		next.Uploads = queues.abortUpload(command.File.Name, command.File.Version)
+		if queues.checkFilePath(command.File.Name) != nil {
+			return next
+		}
+		current := queues.Files[command.File.Name]
+		if current != nil && current.Version >= command.File.Version {
+			return next
+		}
+		if command.Type == RAFT_APPEND_FILE {
+			if queues.isFinished(command.ID) || (current == nil && command.Base != 0) || (current != nil && current.Version != command.Base) {
+				return next
+			}
+			next.Finished = queues.finish(command.ID)
+		}
+		file := *command.File
+		file.Updated = command.Time
+		metadata := current.addVersion(&file)
+		next.Files = queues.updateFileBlocks(metadata, command.Blocks)
+		next.Dirs = queues.addDirs(parentDir(metadata.Name))
+		next.Uploads = queues.dropUploads(command.File.Name, command.File.Version)
+
+	case RAFT_DELETE_FILE:
+		if command.File == nil || queues.Files[command.File.Name] == nil || queues.isFinished(command.ID) {
+			return queues
+		}
+		next.Files = queues.removeFile(command.File.Name)
+		next.Uploads = queues.dropUploads(command.File.Name, queues.nextVersion(command.File.Name))
+		next.Finished = queues.finish(command.ID)
+
+	case RAFT_UPDATE_REPLICAS:
+		// The versions that were copied are stored on the new replicas. A new version may have
+		// been put while the old ones were copied, then the replicas of the file stay those of
+		// the new version
+		if command.File == nil || queues.Files[command.File.Name] == nil {
+			return queues
+		}
+		current := queues.Files[command.File.Name]
+		versions := []int{}
+		for _, fileVersion := range command.File.Versions {
+			versions = append(versions, fileVersion.Version)
+		}
+		metadata := current.moveVersions(versions, command.File.Replicas)
+		if current.Version == command.File.Version {
+			metadata.Replicas = command.File.Replicas
+		}
+		next.Files = queues.updateFiles(metadata.Name, metadata)
+
+	case RAFT_MAKE_DIR:
+		if command.File == nil || command.File.Name == "" || queues.checkDirPath(command.File.Name) != nil {
+			return queues
+		}
+		next.Dirs = queues.addDirs(command.File.Name)
+
+	case RAFT_REMOVE_DIR:
+		// Only empty directories are removed
+		if command.File == nil || !queues.Dirs[command.File.Name] {
+			return queues
+		}
+		if files, dirs, _ := queues.listDirectory(command.File.Name, false); len(files) != 0 || len(dirs) != 0 {
+			return queues
+		}
+		next.Dirs = queues.addDirs("")
+		delete(next.Dirs, command.File.Name)
+
+	case RAFT_MOVE_PATH:
+		if command.File == nil || queues.isFinished(command.ID) {
+			return queues
+		}
+		files, dirs, valid := queues.movePath(command.File.Name, command.Target, command.Moves)
+		if !valid {
+			return queues
+		}
+		next.Files = files
+		next.Dirs = dirs
+		next.Finished = queues.finish(command.ID)
+
+	case RAFT_SUBMIT_JOB:
+		if command.Job == nil || queues.hasJob(command.Job.ID) || queues.isFinished(command.Job.ID) {
+			return queues
+		}
+		next.MJQueue = append(append([]*MapleJuiceRequest{}, queues.MJQueue...), command.Job)
+
+	case RAFT_COMPLETE_JOB:
+		if !queues.hasJob(command.ID) {
+			return queues
+		}
+		next.MJQueue = []*MapleJuiceRequest{}
+		for _, job := range queues.MJQueue {
+			if job.ID != command.ID {
+				next.MJQueue = append(next.MJQueue, job)
+			}
+		}
+		next.Finished = queues.finish(command.ID)
+		next.Progress = queues.updateProgress(command.ID, nil)
+
+	case RAFT_PLAN_JOB:
+		if !queues.hasJob(command.ID) || queues.Progress[command.ID] != nil {
+			return queues
+		}
+		progress := &JobProgress{
+			Tasks:     command.Tasks,
+			Assigned:  map[string]string{},
+			Completed: map[string]bool{},
+			Outputs:   map[string]TaskOutput{},
+		}
+		next.Progress = queues.updateProgress(command.ID, progress)
+
+	case RAFT_ASSIGN_TASKS:
+		progress := queues.Progress[command.ID].copy()
+		if progress == nil {
+			return queues
+		}
+		for _, task := range command.Tasks {
+			if !progress.Completed[task] {
+				progress.Assigned[task] = command.Worker
+			}
+		}
+		next.Progress = queues.updateProgress(command.ID, progress)
+
+	case RAFT_RELEASE_TASKS:
+		progress := queues.Progress[command.ID].copy()
+		if progress == nil {
+			return queues
+		}
+		for task, worker := range progress.Assigned {
+			if worker == command.Worker && !progress.Completed[task] {
+				delete(progress.Assigned, task)
+			}
+		}
+		next.Progress = queues.updateProgress(command.ID, progress)
+
+	case RAFT_COMPLETE_TASKS:
+		// Only the worker a task is assigned to can complete it, so a task that was handed to
+		// another worker after a failure is counted and its output is kept only once
+		progress := queues.Progress[command.ID].copy()
+		if progress == nil {
+			return queues
+		}
+		for _, task := range command.Tasks {
+			if progress.Assigned[task] == command.Worker && !progress.Completed[task] {
+				progress.Completed[task] = true
+				if output, contains := command.Outputs[task]; contains {
+					progress.Outputs[task] = output
+				}
+			}
+		}
+		next.Progress = queues.updateProgress(command.ID, progress)
+
+	default:
+		return queues
+	}
+
+	return next
+}
+
+func (queues *RequestQueues) hasJob(jobID string) bool {
+	for _, job := range queues.MJQueue {
+		if job.ID == jobID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (queues *RequestQueues) isFinished(id string) bool {
+	for _, finishedID := range queues.Finished {
+		if finishedID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns a copy of the progress map with the progress of a job replaced, or removed if nil
+func (queues *RequestQueues) updateProgress(jobID string, progress *JobProgress) map[string]*JobProgress {
+	next := map[string]*JobProgress{}
+	for id, jobProgress := range queues.Progress {
+		next[id] = jobProgress
+	}
+
+	if progress == nil {
+		delete(next, jobID)
+	} else {
+		next[jobID] = progress
+	}
+
+	return next
+}
+
+// Returns a copy of the progress that can be changed, or nil if there is none
+func (progress *JobProgress) copy() *JobProgress {
+	if progress == nil {
+		return nil
+	}
+
+	next := &JobProgress{
+		Tasks:     progress.Tasks,
+		Assigned:  map[string]string{},
+		Completed: map[string]bool{},
+		Outputs:   map[string]TaskOutput{},
+	}
+	for task, worker := range progress.Assigned {
+		next.Assigned[task] = worker
+	}
+	for task := range progress.Completed {
+		next.Completed[task] = true
+	}
+	for task, output := range progress.Outputs {
+		next.Outputs[task] = output
+	}
+
+	return next
+}
+
+// Returns the tasks that are not completed and not assigned to any worker
+func (progress *JobProgress) unassignedTasks() []string {
+	tasks := []string{}
+	for _, task := range progress.Tasks {
+		if _, assigned := progress.Assigned[task]; !assigned && !progress.Completed[task] {
+			tasks = append(tasks, task)
+		}
+	}
+
+	return tasks
+}
+
+// Returns the tasks assigned to a worker that it has not completed yet
+func (progress *JobProgress) workerTasks(worker string) []string {
+	tasks := []string{}
+	for _, task := range progress.Tasks {
+		if progress.Assigned[task] == worker && !progress.Completed[task] {
+			tasks = append(tasks, task)
+		}
+	}
+
+	return tasks
+}
+
+// Checks if every task of the job was completed
+func (progress *JobProgress) isDone() bool {
+	for _, task := range progress.Tasks {
+		if !progress.Completed[task] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the finished IDs with the given ID added, dropping the oldest past FINISHED_ID_HISTORY
+func (queues *RequestQueues) finish(id string) []string {
+	finished := append(append([]string{}, queues.Finished...), id)
+	if len(finished) > FINISHED_ID_HISTORY {
+		finished = finished[len(finished)-FINISHED_ID_HISTORY:]
+	}
+
+	return finished
+}
+
+// Creates a unique ID with the node ID, the boot ID and a counter of how many requests this node
+// created since it started. The finished IDs are kept in the replicated log, so an ID that was used
+// before a restart would make a new command look like it was already applied
+func (node *Node) nextRequestID() string {
+	requestCount := atomic.AddInt64(&node.requestCount, 1) - 1
+	return node.ID + "[" + node.bootID + ":" + strconv.FormatInt(requestCount, 10) + "]"
+}
+
+// Appends a command to the replicated log and waits until this node has applied it. Commands
+// proposed on a follower are forwarded to the leader. Retries until RAFT_PROPOSE_TIMEOUT passes, so
+// a command may be appended more than once, and it may still be applied after ErrNoLeader was
+// returned. Commands that must not be applied twice carry an ID that apply checks against the
+// finished IDs, and callers that retry a failed command reuse its ID
+func (node *Node) proposeCommand(command RaftCommand) error {
+	if command.Time.IsZero() {
+		command.Time = time.Now()
+	}
+	deadline := time.Now().Add(RAFT_PROPOSE_TIMEOUT)
+	for !node.isStopped() && time.Now().Before(deadline) {
+		index, err := node.Log.Propose(command)
+		if err == ErrNotLeader {
+			if leader := node.Log.Leader(); leader != "" && leader != node.ID {
+				index, err = CallProposeRPC(leader, command)
+			}
+		}
+
+		if err == nil && node.Log.WaitApplied(index, time.Until(deadline)) {
+			return nil
+		}
+		if err != nil && err != ErrNotLeader {
+			log.Infof("Could not append %s to the replicated log! %s", command.Type, err)
+		}
+
+		// Try again once a leader is known or after a heartbeat
+		node.waitForChange(node.Log.Changed(), nil, RAFT_HEARTBEAT_INTERVAL)
+	}
+
+	return ErrNoLeader
+}
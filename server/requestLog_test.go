@@ -0,0 +1,96 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// A reservation that is appended to the log twice, even after its put was committed, is only made once
+func TestReserveVersionOnce(t *testing.T) {
+	now := time.Now()
+	reserve := RaftCommand{Type: RAFT_RESERVE_VERSION, ID: "upload[1]", Time: now, File: &FileMetadata{Name: "a.txt"}}
+
+	queues := (&RequestQueues{}).apply(reserve)
+	upload := queues.Uploads["upload[1]"]
+	if upload == nil || upload.Version != 1 {
+		t.Fatalf("Reserved %+v, expected version 1", upload)
+	}
+
+	if again := queues.apply(reserve); len(again.Uploads) != 1 || again.Uploads["upload[1]"] != upload {
+		t.Fatalf("Reserving again changed the uploads to %+v", again.Uploads)
+	}
+
+	put := RaftCommand{Type: RAFT_PUT_FILE, Time: now, File: &FileMetadata{Name: "a.txt", Version: 1}}
+	queues = queues.apply(put)
+	if len(queues.Uploads) != 0 || queues.Files["a.txt"] == nil {
+		t.Fatalf("Put did not commit version 1, uploads %+v", queues.Uploads)
+	}
+
+	queues = queues.apply(reserve)
+	if len(queues.Uploads) != 0 {
+		t.Fatalf("Reservation was made again after its put was committed, uploads %+v", queues.Uploads)
+	}
+	if queues.isWriting("a.txt", now) {
+		t.Fatal("File is held by a reservation that was already committed")
+	}
+
+	// Another put still reserves the next version
+	queues = queues.apply(RaftCommand{Type: RAFT_RESERVE_VERSION, ID: "upload[2]", Time: now, File: &FileMetadata{Name: "a.txt"}})
+	if upload := queues.Uploads["upload[2]"]; upload == nil || upload.Version != 2 {
+		t.Fatalf("Reserved %+v, expected version 2", upload)
+	}
+}
+
+// A put renews its lease while it holds the file, but not once the lease ran out or it was given up
+func TestRenewUpload(t *testing.T) {
+	start := time.Now()
+	queues := (&RequestQueues{}).apply(RaftCommand{Type: RAFT_RESERVE_VERSION, ID: "upload[1]", Time: start, File: &FileMetadata{Name: "a.txt"}})
+	renew := func(queues *RequestQueues, at time.Time) *RequestQueues {
+		return queues.apply(RaftCommand{Type: RAFT_RENEW_UPLOAD, Time: at, File: &FileMetadata{Name: "a.txt", Version: 1}})
+	}
+
+	renewedAt := start.Add(PUT_LEASE_TIMEOUT / 2)
+	renewed := renew(queues, renewedAt)
+	if !renewed.isWriting("a.txt", start.Add(PUT_LEASE_TIMEOUT)) {
+		t.Fatal("Renewed lease ran out when the first one would have")
+	}
+	if renewed.isWriting("a.txt", renewedAt.Add(PUT_LEASE_TIMEOUT)) {
+		t.Fatal("Renewed lease did not run out")
+	}
+	if queues.Uploads["upload[1]"].Started != start {
+		t.Fatal("Renewing changed the queues it was applied to")
+	}
+
+	if expired := renew(queues, start.Add(PUT_LEASE_TIMEOUT)); expired.isWriting("a.txt", start.Add(PUT_LEASE_TIMEOUT)) {
+		t.Fatal("Lease that ran out was renewed")
+	}
+
+	aborted := queues.apply(RaftCommand{Type: RAFT_ABORT_PUT, File: &FileMetadata{Name: "a.txt", Version: 1}})
+	if renew(aborted, renewedAt).isWriting("a.txt", renewedAt) {
+		t.Fatal("Put that was given up was renewed")
+	}
+}
+
+// Only the worker a task is assigned to completes it, and only where its output is stored is kept
+func TestCompleteTasks(t *testing.T) {
+	queues := (&RequestQueues{}).apply(RaftCommand{Type: RAFT_SUBMIT_JOB, ID: "job", Job: &MapleJuiceRequest{ID: "job", Command: "Juice"}})
+	queues = queues.apply(RaftCommand{Type: RAFT_PLAN_JOB, ID: "job", Tasks: []string{"pre_a", "pre_b"}})
+	queues = queues.apply(RaftCommand{Type: RAFT_ASSIGN_TASKS, ID: "job", Worker: "n1", Tasks: []string{"pre_a", "pre_b"}})
+	queues = queues.apply(RaftCommand{Type: RAFT_RELEASE_TASKS, ID: "job", Worker: "n1"})
+	queues = queues.apply(RaftCommand{Type: RAFT_ASSIGN_TASKS, ID: "job", Worker: "n2", Tasks: []string{"pre_a"}})
+
+	outputs := map[string]TaskOutput{
+		"pre_a": {FileName: JUICE_OUTPUT_FOLDER_NAME + "/job/1", Checksum: "a"},
+		"pre_b": {FileName: JUICE_OUTPUT_FOLDER_NAME + "/job/2", Checksum: "b"},
+	}
+	queues = queues.apply(RaftCommand{Type: RAFT_COMPLETE_TASKS, ID: "job", Worker: "n1", Tasks: []string{"pre_a", "pre_b"}, Outputs: outputs})
+	if progress := queues.Progress["job"]; len(progress.Completed) != 0 || len(progress.Outputs) != 0 {
+		t.Fatalf("Worker the tasks were taken from completed %v", progress.Completed)
+	}
+
+	queues = queues.apply(RaftCommand{Type: RAFT_COMPLETE_TASKS, ID: "job", Worker: "n2", Tasks: []string{"pre_a"}, Outputs: outputs})
+	progress := queues.Progress["job"]
+	if !progress.Completed["pre_a"] || progress.Outputs["pre_a"] != outputs["pre_a"] || len(progress.Outputs) != 1 {
+		t.Fatalf("Completed %v with outputs %v, expected only pre_a", progress.Completed, progress.Outputs)
+	}
+}
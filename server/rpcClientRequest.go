@@ -1,13 +1,9 @@
 package server
 
 import (
+	"errors"
 	log "github.com/sirupsen/logrus"
-	"math/rand"
 	"net/rpc"
-	"os"
-	"runtime"
-	"sort"
-	"strconv"
 	"time"
 )
 
@@ -19,82 +15,228 @@ type MapleJuiceRequestArgs struct {
 	DeleteInput   bool
 }
 
+// Blocks are the entries of the blocks of the kept versions of File that are split into blocks.
+// Entries are the paths in a directory, with a separator after the directories. Base is the
+// version an append is written on top of. Age is how long ago File was updated and Recent is set if
+// that was less than CONFLICT_WINDOW ago, both by the clock of the server, so the client does not
+// compare its own clock with the one of the server that committed the file. Error is set if the
+// request was refused
 type ClientResponseArgs struct {
 	Success  bool
 	HostList []string
+	File     *FileMetadata
+	Blocks   []FileMetadata
+	Base     FileVersion
+	Entries  []string
+	Age      time.Duration
+	Recent   bool
+	Error    string
 }
 
-// This RPC server will handle any requests made by the client to the server.
-// The server will process it and add the request to the request buffer to try to find the file
-// If the file is not found within a timeout, the server will respond with an empty list.
-type ClientRequest int
+// A put that is stored on its replicas. Blocks are the blocks of the new version if it was split.
+// An append is only committed on top of version Base, and only once for its ID
+type CommitPutArgs struct {
+	File   *FileMetadata
+	Blocks []*FileMetadata
+	Append bool
+	Base   int
+	ID     string
+}
 
-type Request struct {
-	ID       string
-	Type     string
-	SrcHost  string
+// Reserves a version of a file for a put or an append. ID is picked by the client and sent to every
+// server it tries, so a reservation that was made after its server stopped waiting for it is not
+// made a second time by the next server
+type ReserveArgs struct {
 	FileName string
+	ID       string
 }
 
-var CLIENT_RPC_PORT string = "5000"
+// Returns the error a server refused a request with
+func (response *ClientResponseArgs) Err() error {
+	if response.Error == "" {
+		return nil
+	}
 
-// Global that keeps track of how many requests have been created by this node
-var requestCount int = 1000
+	for _, err := range []error{ErrInvalidName, ErrNotDirectory, ErrIsDirectory, ErrFileExists,
+		ErrDirectoryNotEmpty, ErrMoveConflict, ErrNoQuorum, ErrPathNotFound, ErrFileBusy, ErrNotApplied} {
+		if response.Error == err.Error() {
+			return err
+		}
+	}
 
-func (t *ClientRequest) Put(requestFile string, response *ClientResponseArgs) error {
+	return errors.New(response.Error)
+}
+
+// This RPC server will handle any requests made by the client to the server.
+// The server looks the file up in its copy of the metadata directory, so a request is answered
+// without asking the other servers.
+type ClientRequest struct {
+	node *Node
+}
+
+var CLIENT_RPC_PORT string = "5000"
+
+func (t *ClientRequest) Put(request *ReserveArgs, response *ClientResponseArgs) error {
+	requestFile := request.FileName
 	log.Infof("Server recieved Put for file %s", requestFile)
-	success, hostList := handleClientRequest("Put", requestFile)
+	if !ValidFileName(requestFile) {
+		response.Error = ErrInvalidName.Error()
+		return nil
+	}
+	if err := t.node.Queues().checkFilePath(requestFile); err != nil {
+		response.Error = err.Error()
+		return nil
+	}
+	metadata, success := t.node.FileMetadata(requestFile)
+
+	// Every put is stored as a new version, so the old versions stay until it is committed
+	version, err := t.node.reserveVersion(requestFile, request.ID)
+	if err == ErrFileBusy || err == ErrNotApplied {
+		response.Error = err.Error()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
 	// We can change this to indicate if it was within the grace period
 	response.Success = success
+	response.File = &FileMetadata{Name: requestFile, Version: version}
+
+	response.HostList = t.node.placeFile(requestFile, metadata.Replicas)
+	return nil
+}
+
+// Called by the client to start an append. Replies with the version the append is stored as, the
+// newest version it is written on top of and the replicas that store that version
+func (t *ClientRequest) Append(request *ReserveArgs, response *ClientResponseArgs) error {
+	requestFile := request.FileName
+	log.Infof("Server recieved Append for file %s", requestFile)
+	if !ValidFileName(requestFile) {
+		response.Error = ErrInvalidName.Error()
+		return nil
+	}
+	if err := t.node.Queues().checkFilePath(requestFile); err != nil {
+		response.Error = err.Error()
+		return nil
+	}
+	version, err := t.node.reserveVersion(requestFile, request.ID)
+	if err == ErrFileBusy || err == ErrNotApplied {
+		response.Error = err.Error()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// The base is looked up once the file is reserved, so it is the newest version
+	metadata, blocks, success := t.node.FileBlocks(requestFile)
 
-	// If the file was not found, pick four random nodes to shard the file to
+	response.Success = success
+	response.File = &FileMetadata{Name: requestFile, Version: version, Replicas: metadata.Replicas}
+	response.Blocks = blocks
 	if !success {
-		randomHostList := []string{}
-
-		for {
-			rand.Seed(time.Now().UnixNano())
-			randIndex := rand.Intn(len(Membership.List))
-			nodeName := Membership.List[randIndex]
-
-			// If the current random pick matches one that was already picked, continue
-			duplicate := false
-			for i := 0; i < len(randomHostList); i++ {
-				if randomHostList[i] == nodeName {
-					duplicate = true
-					break
-				}
-			}
+		response.HostList = t.node.placeFile(requestFile, metadata.Replicas)
+		return nil
+	}
 
-			if duplicate {
-				continue
-			}
+	// Only the replicas that store the base can extend it. If too few of them are alive the append
+	// fails until the file was copied to other nodes, which then store the new version as well
+	response.Base, _ = metadata.FindVersion(metadata.Version)
+	response.HostList = t.node.aliveReplicas(metadata.Replicas)
+	return nil
+}
+
+// Called by the client for every block of a put that is split into blocks. Replies with the
+// servers the block is stored on
+func (t *ClientRequest) PlaceBlock(blockName string, response *ClientResponseArgs) error {
+	log.Infof("Server recieved placement for block %s", blockName)
+	metadata, success := t.node.FileMetadata(blockName)
+	response.Success = success
+	response.HostList = t.node.placeFile(blockName, metadata.Replicas)
+	return nil
+}
 
-			randomHostList = append(randomHostList, nodeName)
-			if len(randomHostList) == 4 || len(randomHostList) == len(Membership.List) {
-				sort.Strings(randomHostList)
-				response.HostList = randomHostList
-				return nil
+// A new version is stored on the same replicas as the old ones. If the file was not found, or too
+// few of its replicas are alive to reach a write quorum, it is also stored on the nodes the hash
+// ring places it on
+func (node *Node) placeFile(fileName string, replicas []string) []string {
+	hostList := node.aliveReplicas(replicas)
+	if len(hostList) < WRITE_QUORUM {
+		for _, member := range node.Membership.ReplicaSet(fileName, NUM_REPLICAS) {
+			if !containsMember(hostList, member) {
+				hostList = append(hostList, member)
 			}
 		}
 	}
 
-	response.HostList = hostList
+	return hostList
+}
+
+// Called by the client once a put is stored on its replicas, which makes it the newest version.
+// Fails if a newer version was committed first
+func (t *ClientRequest) CommitPut(request *CommitPutArgs, response *ClientResponseArgs) error {
+	log.Infof("Server recieved commit for version %d of file %s on %v", request.File.Version, request.File.Name, request.File.Replicas)
+	var err error
+	if request.Append {
+		err = t.node.commitAppend(request)
+	} else {
+		err = t.node.commitFile(request.File, request.Blocks)
+	}
+	if err == ErrIsDirectory || err == ErrNotDirectory {
+		response.Error = err.Error()
+		return nil
+	}
+	if err != nil && err != ErrStaleVersion {
+		return err
+	}
+
+	metadata, _ := t.node.FileMetadata(request.File.Name)
+	response.Success = err == nil
+	response.HostList = metadata.Replicas
+	response.File = &metadata
+
+	return nil
+}
+
+// Called by the client when a put fails after its version was reserved, so the next put of the
+// file does not have to wait for the reservation to run out
+func (t *ClientRequest) AbortPut(request *CommitPutArgs, response *ClientResponseArgs) error {
+	log.Infof("Server recieved abort for version %d of file %s", request.File.Version, request.File.Name)
+	response.Success = t.node.abortPut(request.File) == nil
 	return nil
 }
 
 func (t *ClientRequest) Get(requestFile string, response *ClientResponseArgs) error {
 	log.Infof("Server recieved Get for file %s", requestFile)
-	success, hostList := handleClientRequest("Get", requestFile)
+	metadata, blocks, success := t.node.FileBlocks(requestFile)
 	response.Success = success
-	response.HostList = hostList
+	response.HostList = metadata.Replicas
+	if success {
+		response.File = &metadata
+		response.Blocks = blocks
+	}
 
 	return nil
 }
 
 func (t *ClientRequest) Delete(requestFile string, response *ClientResponseArgs) error {
 	log.Infof("Server recieved Delete for file %s", requestFile)
-	success, _ := handleClientRequest("Delete", requestFile)
+	if IsBlockName(requestFile) {
+		response.Error = ErrInvalidName.Error()
+		return nil
+	}
+	if t.node.Queues().Dirs[requestFile] {
+		response.Error = ErrIsDirectory.Error()
+		return nil
+	}
+	metadata, blocks, success := t.node.FileBlocks(requestFile)
+	if success {
+		err := t.node.deleteFile(metadata, blocks)
+		if err != nil {
+			return err
+		}
+	}
 	response.Success = success
 	response.HostList = []string{}
 
@@ -103,15 +245,91 @@ func (t *ClientRequest) Delete(requestFile string, response *ClientResponseArgs)
 
 func (t *ClientRequest) List(requestFile string, response *ClientResponseArgs) error {
 	log.Infof("Server recieved Ls for file %s", requestFile)
-	success, hostList := handleClientRequest("List", requestFile)
+	metadata, blocks, success := t.node.FileBlocks(requestFile)
+	response.Success = success
+	response.HostList = metadata.Replicas
+	if success {
+		response.File = &metadata
+		response.Blocks = blocks
+		response.Age = time.Since(metadata.Updated)
+		response.Recent = response.Age < CONFLICT_WINDOW
+	}
+
+	return nil
+}
+
+// Replies with the paths in a directory and all of its subdirectories
+func (t *ClientRequest) ListDirectory(dirName string, response *ClientResponseArgs) error {
+	log.Infof("Server recieved Ls for directory %s", dirName)
+	files, dirs, success := t.node.ListDirectory(dirName, true)
 	response.Success = success
-	response.HostList = hostList
+	response.Entries = files
+	for _, name := range dirs {
+		response.Entries = append(response.Entries, name+PATH_SEPARATOR)
+	}
+
+	return nil
+}
+
+func (t *ClientRequest) MakeDir(dirName string, response *ClientResponseArgs) error {
+	log.Infof("Server recieved Mkdir for directory %s", dirName)
+	dirName = CleanPath(dirName)
+	if dirName == "" || IsBlockName(dirName) {
+		response.Error = ErrInvalidName.Error()
+		return nil
+	}
+
+	err := t.node.makeDir(dirName)
+	response.Success = err == nil
+	if err == ErrFileExists || err == ErrNotDirectory {
+		response.Error = err.Error()
+		return nil
+	}
+
+	return err
+}
+
+func (t *ClientRequest) RemoveDir(dirName string, response *ClientResponseArgs) error {
+	log.Infof("Server recieved Rmdir for directory %s", dirName)
+	err := t.node.removeDir(CleanPath(dirName))
+	response.Success = err == nil
+	if err == ErrPathNotFound {
+		return nil
+	}
+	if err == ErrDirectoryNotEmpty {
+		response.Error = err.Error()
+		return nil
+	}
+
+	return err
+}
+
+// Moves a file or a directory. Moves that are refused are reported in the response, so the client
+// does not try them on another server
+func (t *ClientRequest) Move(request *MoveArgs, response *ClientResponseArgs) error {
+	log.Infof("Server recieved Mv of %s to %s", request.From, request.To)
+	if IsBlockName(request.From) || IsBlockName(request.To) {
+		response.Error = ErrInvalidName.Error()
+		return nil
+	}
+
+	err := t.node.movePath(CleanPath(request.From), CleanPath(request.To), request.Replace)
+	response.Success = err == nil
+	if err != nil && err != ErrPathNotFound {
+		response.Error = err.Error()
+	}
 
 	return nil
 }
 
-func (t *ClientRequest) Maple(request *MapleJuiceRequestArgs, _ *ClientResponseArgs) error {
+func (t *ClientRequest) Maple(request *MapleJuiceRequestArgs, response *ClientResponseArgs) error {
+	if files, _, found := t.node.ListDirectory(request.FileDirectory, true); !found || len(files) == 0 {
+		response.Error = ErrPathNotFound.Error()
+		return nil
+	}
+
 	mapleJuiceRequest := &MapleJuiceRequest{
+		ID:            t.node.nextRequestID(),
 		Command:       "Maple",
 		ExeName:       request.ExeName,
 		ProcessCount:  request.ProcessCount,
@@ -120,124 +338,136 @@ func (t *ClientRequest) Maple(request *MapleJuiceRequestArgs, _ *ClientResponseA
 		DeleteInput:   false,
 	}
 
-	Membership.MJQueue = append(Membership.MJQueue, mapleJuiceRequest)
-	Membership.MapleJuiceUTime = time.Now().UnixNano() / int64(time.Millisecond)
-	
-	return nil
+	return t.node.submitJob(mapleJuiceRequest)
 }
 
-func (t *ClientRequest) Juice(request *MapleJuiceRequestArgs, _ *ClientResponseArgs) error {
+// The output of a juice job is appended to the sdfs file named by FileDirectory
+func (t *ClientRequest) Juice(request *MapleJuiceRequestArgs, response *ClientResponseArgs) error {
+	destFileName := CleanPath(request.FileDirectory)
+	if !ValidFileName(destFileName) {
+		response.Error = ErrInvalidName.Error()
+		return nil
+	}
+	if err := t.node.Queues().checkFilePath(destFileName); err != nil {
+		response.Error = err.Error()
+		return nil
+	}
+
 	mapleJuiceRequest := &MapleJuiceRequest{
+		ID:            t.node.nextRequestID(),
 		Command:       "Juice",
 		ExeName:       request.ExeName,
 		ProcessCount:  request.ProcessCount,
 		FilePrefix:    request.FilePrefix,
-		FileDirectory: request.FileDirectory,
+		FileDirectory: destFileName,
 		DeleteInput:   request.DeleteInput,
 	}
 
-	Membership.MJQueue = append(Membership.MJQueue, mapleJuiceRequest)
-	Membership.MapleJuiceUTime = time.Now().UnixNano() / int64(time.Millisecond)
-	
-	return nil
+	return t.node.submitJob(mapleJuiceRequest)
 }
 
-// Function that will handle adding the request to the request bus. Will wait for a response
-// Or will time out and will return the response of the server.
-func handleClientRequest(requestType string, requestFile string) (success bool, hostList []string) {
-	// Will create a unique ID name with the curent VM name and a counter for how many client
-	// Requests have been created from this node
-	hostname, _ := os.Hostname()
-	requestID := hostname + "[" + strconv.Itoa(requestCount) + "]"
-	requestCount++
-
-	request := &Request{
-		ID:       requestID,
-		Type:     requestType,
-		SrcHost:  hostname,
-		FileName: requestFile,
-	}
-	log.Infof("Adding %s request, ID: %s to pending bus", requestType, requestID)
-	Membership.Pending = append(Membership.Pending, request)
-	Membership.RequestUTime = time.Now().UnixNano() / int64(time.Millisecond)
-
-	// Will check if the node has recieved a response from another server
-	// Indicating that that node has the file
-	FileNotFoundCounts[requestID] = 0
-
-	for {
-		// If the leader recieved a response from a server that the file was found
-		if hostList, contains := FileFoundResponses[requestID]; contains {
-			delete(FileFoundResponses, requestID)
-			delete(FileNotFoundCounts, requestID)
-			removeRequest(requestID)
-
-			log.Infof("Found file %s in the sdfs", requestFile)
-			return true, hostList
-		}
+// Adds a job to the job queue. Fails if the job was not added, so the client does not wait for a
+// job that will never run
+func (node *Node) submitJob(job *MapleJuiceRequest) error {
+	log.Infof("Adding %s job, ID: %s to the job queue", job.Command, job.ID)
+	err := node.proposeCommand(RaftCommand{Type: RAFT_SUBMIT_JOB, Job: job})
+	if err != nil {
+		return err
+	}
 
-		// If all servers reply with not found, this will return
-		if counts, _ := FileNotFoundCounts[requestID]; counts >= len(Membership.List) {
-			delete(FileFoundResponses, requestID)
-			delete(FileNotFoundCounts, requestID)
-			removeRequest(requestID)
+	if queues := node.Queues(); !queues.hasJob(job.ID) && !queues.isFinished(job.ID) {
+		log.Infof("Job %s was not added to the job queue!", job.ID)
+		return ErrNotApplied
+	}
 
-			log.Infof("Could not find file %s in the sdfs!", requestFile)
-			break
-		}
+	return nil
+}
 
-		runtime.Gosched()
+// This will invoke the specified requestType RPC call in the clientRequest file
+func CallFileSystemRPC(hostname string, requestType string, fileName string) (response ClientResponseArgs, success bool) {
+	log.Infof("Making %s request to %s", requestType, hostname)
+
+	client, err := rpc.DialHTTP("tcp", rpcAddr(hostname, CLIENT_RPC_PORT))
+	if err != nil {
+		log.Infof("Could not dial server for %s: %s", requestType, err)
+		return response, false
+	}
+	defer client.Close()
+
+	err = client.Call(requestType, fileName, &response)
+	if err != nil {
+		log.Infof("Error in request: %s", err)
+		return response, false
 	}
 
-	return false, []string{}
+	return response, true
 }
 
-// Helper that will remove a pending request and update the RequestUTime
-func removeRequest(requestID string) {
-	for idx, request := range Membership.Pending {
-		if request.ID == requestID {
-			Membership.Pending = append(Membership.Pending[:idx], Membership.Pending[idx+1:]...)
-			Membership.RequestUTime = time.Now().UnixNano() / int64(time.Millisecond)
-			return
-		}
+// Asks a server to reserve a version of a file for a put or an append
+func CallReserveRPC(hostname string, requestType string, request *ReserveArgs) (response ClientResponseArgs, success bool) {
+	log.Infof("Making %s request to %s", requestType, hostname)
+
+	client, err := rpc.DialHTTP("tcp", rpcAddr(hostname, CLIENT_RPC_PORT))
+	if err != nil {
+		log.Infof("Could not dial server for %s: %s", requestType, err)
+		return response, false
+	}
+	defer client.Close()
+
+	err = client.Call(requestType, request, &response)
+	if err != nil {
+		log.Infof("Error in request: %s", err)
+		return response, false
 	}
+
+	return response, true
 }
 
-// This will invoke the specified requestType RPC call in the clientRequest file
-func CallFileSystemRPC(hostname string, requestType string, fileName string) (response ClientResponseArgs, success bool) {
-	callerHostname, _ := os.Hostname()
-	log.Infof("Making %s request from %s to %s", requestType, callerHostname, hostname)
+// Tells a server that a put is stored on its replicas
+func CallCommitPutRPC(hostname string, request *CommitPutArgs) (response ClientResponseArgs, success bool) {
+	log.Infof("Committing file %s to %s", request.File.Name, hostname)
+	return callPutRPC(hostname, "ClientRequest.CommitPut", request)
+}
 
-	client, err := rpc.DialHTTP("tcp", hostname+":"+CLIENT_RPC_PORT)
+// Tells a server that a put was given up
+func CallAbortPutRPC(hostname string, request *CommitPutArgs) (response ClientResponseArgs, success bool) {
+	log.Infof("Aborting version %d of file %s on %s", request.File.Version, request.File.Name, hostname)
+	return callPutRPC(hostname, "ClientRequest.AbortPut", request)
+}
+
+func callPutRPC(hostname string, requestType string, request *CommitPutArgs) (response ClientResponseArgs, success bool) {
+	client, err := rpc.DialHTTP("tcp", rpcAddr(hostname, CLIENT_RPC_PORT))
 	if err != nil {
-		log.Fatalf("Could not dial server for %s: ", requestType, err)
+		log.Infof("Could not dial server for %s: %s", requestType, err)
 		return response, false
 	}
 	defer client.Close()
 
-	err = client.Call(requestType, fileName, &response)
+	err = client.Call(requestType, request, &response)
 	if err != nil {
-		log.Fatalf("Error in request: ", err)
+		log.Infof("Error in request: %s", err)
 		return response, false
 	}
 
 	return response, true
 }
 
-// This will invoke the specified requestType MapleJuice RPC call 
-func CallMapleJuiceRPC(hostname string, requestType string, request *MapleJuiceRequest) {
-	callerHostname, _ := os.Hostname()
-	log.Infof("Making %s request from %s to %s", requestType, callerHostname, hostname)
+// This will invoke the specified requestType MapleJuice RPC call
+func CallMapleJuiceRPC(hostname string, requestType string, request *MapleJuiceRequest) (response ClientResponseArgs, success bool) {
+	log.Infof("Making %s request to %s", requestType, hostname)
 
-	client, err := rpc.DialHTTP("tcp", hostname+":"+CLIENT_RPC_PORT)
+	client, err := rpc.DialHTTP("tcp", rpcAddr(hostname, CLIENT_RPC_PORT))
 	if err != nil {
-		log.Fatalf("Could not dial server for %s: ", requestType, err)
-		return
+		log.Infof("Could not dial server for %s: %s", requestType, err)
+		return response, false
 	}
 	defer client.Close()
 
-	err = client.Call(requestType, &request, nil)
+	err = client.Call(requestType, &request, &response)
 	if err != nil {
-		log.Fatalf("Error in request: ", err)
+		log.Infof("Error in request: %s", err)
+		return response, false
 	}
-}
\ No newline at end of file
+
+	return response, true
+}
@@ -1,12 +1,17 @@
 package server
 
 import (
+	"errors"
 	log "github.com/sirupsen/logrus"
 	"net/rpc"
-	"os"
 )
 
+var ErrStaleMaster = errors.New("request from a MapleJuice master that was replaced")
+var ErrJobNotStarted = errors.New("the master has not started the MapleJuice job")
+var ErrWorkerNotMember = errors.New("the worker is not in the membership list of the master")
+
 type MapleJuiceRequest struct {
+	ID            string
 	Command       string
 	ExeName       string
 	ProcessCount  int
@@ -15,129 +20,282 @@ type MapleJuiceRequest struct {
 	DeleteInput   bool
 }
 
+// Every request a worker makes to the master carries the newest term the worker has seen. A master
+// that no longer leads that term refuses the request, and every reply carries the master's term
+// so the worker can drop replies from a master that was replaced while the call was in flight.
+// Tasks are the tasks the worker processed for the job, and Outputs where the juice output of each
+// is stored.
+type MasterRequestArgs struct {
+	Worker  string
+	Term    uint64
+	JobID   string
+	Tasks   []string
+	Outputs map[string]TaskOutput
+}
+
 type ProcessFileResponse struct {
-	FileName  string
-	Done      bool
+	FileName   string
+	Done       bool
+	MasterTerm uint64
+}
+
+type JuiceFilesResponse struct {
+	Files      []string
+	MasterTerm uint64
 }
 
-type ExecuteMapleJuice int
+type ExecuteMapleJuice struct {
+	node *Node
+}
 
 var MAPLEJUICE_RPC_PORT string = "8000"
+var MAPLEJUICE_OUTPUT_FILE_NAME string = "MJOut.txt"
 
-func (t *ExecuteMapleJuice) ProcessFile(workerHostname string, response *ProcessFileResponse) error {
-	ProcessFileMutex.Lock()
+func (t *ExecuteMapleJuice) ProcessFile(args *MasterRequestArgs, response *ProcessFileResponse) error {
+	node := t.node
+	node.ProcessFileMutex.Lock()
+	defer node.ProcessFileMutex.Unlock()
 
-	if len(MapleFileList) == 0 {
+	masterTerm, progress, err := node.checkMasterRequest(args)
+	if err != nil {
+		return err
+	}
+	response.MasterTerm = masterTerm
+
+	tasks, err := node.assignTasks(args, progress, 1)
+	if err != nil {
+		return err
+	}
+
+	if len(tasks) == 0 {
 		response.FileName = ""
 		response.Done = true
-		ProcessFileMutex.Unlock()
-		
 		return nil
 	}
 
-	log.Infof("Assigning file %s to worker %s be processed!", workerHostname, MapleFileList[0])
-	FileAssignmentMap[workerHostname] = append(FileAssignmentMap[workerHostname], MapleFileList[0])
-	response.FileName = MapleFileList[0]
+	log.Infof("Assigning file %s to worker %s be processed!", tasks[0], args.Worker)
+	response.FileName = tasks[0]
 	response.Done = false
-	MapleFileList = MapleFileList[1:]
-	ProcessFileMutex.Unlock()
-
 	return nil
 }
 
-func (t *ExecuteMapleJuice) ProcessedMapOutput(workerHostname string, _ *string) error {
-	WorkerResponses[workerHostname] = true
-	log.Info("Master recieved process success!")
-	return nil
+// Called by a worker once it sent out the aggregate map of the files in args.Tasks
+func (t *ExecuteMapleJuice) ProcessedMapOutput(args *MasterRequestArgs, _ *string) error {
+	return t.node.completeTasks(args)
 }
 
-// Each time this is requested, the master will allocate 250 keys for the process to map
-func (t *ExecuteMapleJuice) RequestJuiceFiles(workerHostname string, response *[]string) error {
-	JuiceMutex.Lock()
+// Each time this is requested, the master will allocate 20 keys for the process to reduce
+func (t *ExecuteMapleJuice) RequestJuiceFiles(args *MasterRequestArgs, response *JuiceFilesResponse) error {
+	node := t.node
+	node.JuiceMutex.Lock()
+	defer node.JuiceMutex.Unlock()
 
-	if len(JuiceFileList) < 20 {
-		log.Infof("Giving %s %d files to process", workerHostname, len(JuiceFileList))
-		*response = JuiceFileList
-		JuiceAssignmentMap[workerHostname] = JuiceFileList
-		JuiceFileList = []string{}
+	masterTerm, progress, err := node.checkMasterRequest(args)
+	if err != nil {
+		return err
+	}
+	response.MasterTerm = masterTerm
 
-	} else {
-		log.Infof("Giving %s 20 files to process", workerHostname)
-		*response = JuiceFileList[0:20]
-		JuiceAssignmentMap[workerHostname] = JuiceFileList[0:20]
-		JuiceFileList = JuiceFileList[20:]
+	response.Files, err = node.assignTasks(args, progress, 20)
+	if err != nil {
+		return err
 	}
 
-	log.Infof("Files left to process %d", len(JuiceFileList))
-	JuiceMutex.Unlock()
+	log.Infof("Giving %s %d files to process", args.Worker, len(response.Files))
 	return nil
 }
 
-func (t *ExecuteMapleJuice) AppendResult(data []byte, _ *string) error {
-	log.Info("Writing!")
-	JuiceMutex.Lock()
-	
-	fileDes, _ := os.OpenFile("MJOut.txt", os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
-	fileDes.Write(data)
-	fileDes.Close()
+// Called by a worker with the reducer output of the keys in args.Tasks. The outputs are kept in
+// the job checkpoint and appended to the destination file once every key was reduced
+func (t *ExecuteMapleJuice) AppendResult(args *MasterRequestArgs, _ *string) error {
+	return t.node.completeTasks(args)
+}
+
+// Fencing check of the master side. Only the leader of the newest term the worker has seen may
+// answer, and it returns its term for the worker to check. The request must be for the job at
+// the head of the queue, after the master checkpointed its tasks
+func (node *Node) checkMasterRequest(args *MasterRequestArgs) (uint64, *JobProgress, error) {
+	term, isLeader := node.Log.LeaderTerm()
+	if !isLeader || args.Term > term {
+		log.Infof("Rejecting request from worker %s, this node is not the master for term %d", args.Worker, args.Term)
+		return term, nil, ErrStaleMaster
+	}
 
-	JuiceMutex.Unlock()
+	queues := node.Queues()
+	progress := queues.Progress[args.JobID]
+	if len(queues.MJQueue) == 0 || queues.MJQueue[0].ID != args.JobID || progress == nil {
+		return term, nil, ErrJobNotStarted
+	}
 
-	return nil
+	return term, progress, nil
+}
+
+// Hands out up to count tasks to a worker and checkpoints the assignment. Tasks that are assigned
+// to the worker but missing from the ones it processed were lost with the reply to an earlier
+// request, or with a restart of the worker, so those are handed out again first
+func (node *Node) assignTasks(args *MasterRequestArgs, progress *JobProgress, count int) ([]string, error) {
+	processed := map[string]bool{}
+	for _, task := range args.Tasks {
+		processed[task] = true
+	}
+
+	tasks := []string{}
+	for _, task := range progress.workerTasks(args.Worker) {
+		if !processed[task] && len(tasks) < count {
+			tasks = append(tasks, task)
+		}
+	}
+	if len(tasks) != 0 {
+		return tasks, nil
+	}
+
+	for _, task := range progress.unassignedTasks() {
+		if len(tasks) < count {
+			tasks = append(tasks, task)
+		}
+	}
+	if len(tasks) == 0 {
+		return tasks, nil
+	}
+
+	// The master only hears of failures of members, so tasks of other workers would never be
+	// handed out again
+	if !node.MemberState(args.Worker).IsActive() {
+		return []string{}, ErrWorkerNotMember
+	}
+
+	err := node.proposeCommand(RaftCommand{Type: RAFT_ASSIGN_TASKS, ID: args.JobID, Worker: args.Worker, Tasks: tasks})
+	return tasks, err
+}
+
+// Checkpoints the tasks a worker finished. The worker keeps them until this returns without error
+func (node *Node) completeTasks(args *MasterRequestArgs) error {
+	if _, _, err := node.checkMasterRequest(args); err != nil {
+		return err
+	}
+
+	log.Infof("Master recieved %d processed files from %s!", len(args.Tasks), args.Worker)
+	return node.proposeCommand(RaftCommand{
+		Type:    RAFT_COMPLETE_TASKS,
+		ID:      args.JobID,
+		Worker:  args.Worker,
+		Tasks:   args.Tasks,
+		Outputs: args.Outputs,
+	})
+}
+
+// Fencing check of the worker side. A master whose term is older than the newest term this
+// node has seen was replaced, so its requests and replies are dropped
+func (node *Node) isStaleMaster(masterTerm uint64) bool {
+	if masterTerm < node.Log.Term() {
+		log.Infof("Rejecting stale master with term %d", masterTerm)
+		return true
+	}
+
+	return false
+}
+
+// Returns the master of the current job, the leader of the replicated log
+func (node *Node) getMaster() string {
+	return node.Log.Leader()
+}
+
+// Returns the workers of the current job, the first members of the list other than the master
+func (node *Node) getWorkers(master string) []string {
+	workerCount := node.GetWorkerCount()
+	workers := []string{}
+	for _, member := range node.Membership.List() {
+		if member != master && len(workers) < workerCount {
+			workers = append(workers, member)
+		}
+	}
+
+	return workers
+}
+
+// Checks if this node is one of the workers of the current job
+func (node *Node) isWorker(master string) bool {
+	for _, worker := range node.getWorkers(master) {
+		if worker == node.ID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Helper that builds the arguments of a request to the master about a job
+func (node *Node) masterRequestArgs(jobID string, tasks []string, outputs map[string]TaskOutput) *MasterRequestArgs {
+	return &MasterRequestArgs{Worker: node.ID, Term: node.Log.Term(), JobID: jobID, Tasks: tasks, Outputs: outputs}
 }
 
 // Function that will get the next file to process for the worker node.
-func CallProcessFileRPC(hostname string, workerHostname string) (ProcessFileResponse) {
-	client, err := rpc.DialHTTP("tcp", hostname+":"+MAPLEJUICE_RPC_PORT)
+func CallProcessFileRPC(hostname string, args *MasterRequestArgs) (ProcessFileResponse, bool) {
+	var response ProcessFileResponse
+	client, err := rpc.DialHTTP("tcp", rpcAddr(hostname, MAPLEJUICE_RPC_PORT))
 	if err != nil {
-		log.Fatalf("Error in dialing. %s", err)
+		log.Infof("Error in dialing. %s", err)
+		return response, false
 	}
+	defer client.Close()
 
-	var response ProcessFileResponse
-	err = client.Call("ExecuteMapleJuice.ProcessFile", workerHostname, &response)
+	err = client.Call("ExecuteMapleJuice.ProcessFile", args, &response)
 	if err != nil {
-		log.Fatalf("error in ExecuteMapleJuice.ProcessFile", err)
+		log.Infof("error in ExecuteMapleJuice.ProcessFile %s", err)
+		return response, false
 	}
 
-	return response
+	return response, true
 }
 
 // Function that will ping the master to tell it that the worker has finished sending out its aggregate map
-func CallProcessedMapOutputRPC(hostname string, workerHostname string) {
-	client, err := rpc.DialHTTP("tcp", hostname+":"+MAPLEJUICE_RPC_PORT)
+func CallProcessedMapOutputRPC(hostname string, args *MasterRequestArgs) bool {
+	client, err := rpc.DialHTTP("tcp", rpcAddr(hostname, MAPLEJUICE_RPC_PORT))
 	if err != nil {
-		log.Fatalf("Error in dialing. %s", err)
+		log.Infof("Error in dialing. %s", err)
+		return false
 	}
+	defer client.Close()
 
-	err = client.Call("ExecuteMapleJuice.ProcessedMapOutput", workerHostname, nil)
+	err = client.Call("ExecuteMapleJuice.ProcessedMapOutput", args, nil)
 	if err != nil {
-		log.Fatalf("error in ExecuteMapleJuice.ProcessedMapOutput", err)
+		log.Infof("error in ExecuteMapleJuice.ProcessedMapOutput %s", err)
+		return false
 	}
+
+	return true
 }
 
-func CallRequestJuiceFilesRPC(hostname string, workerHostname string) ([]string) {
-	client, err := rpc.DialHTTP("tcp", hostname+":"+MAPLEJUICE_RPC_PORT)
+func CallRequestJuiceFilesRPC(hostname string, args *MasterRequestArgs) JuiceFilesResponse {
+	var response JuiceFilesResponse
+	client, err := rpc.DialHTTP("tcp", rpcAddr(hostname, MAPLEJUICE_RPC_PORT))
 	if err != nil {
-		log.Fatalf("Error in dialing. %s", err)
+		log.Infof("Error in dialing. %s", err)
+		return response
 	}
+	defer client.Close()
 
-	var response []string
-	err = client.Call("ExecuteMapleJuice.RequestJuiceFiles", workerHostname, &response)
+	err = client.Call("ExecuteMapleJuice.RequestJuiceFiles", args, &response)
 	if err != nil {
-		log.Fatalf("error in ExecuteMapleJuice.RequestJuiceFiles", err)
+		log.Infof("error in ExecuteMapleJuice.RequestJuiceFiles %s", err)
 	}
 
 	return response
 }
 
-func CallAppendResultRPC(hostname string, data []byte) {
-	client, err := rpc.DialHTTP("tcp", hostname+":"+MAPLEJUICE_RPC_PORT)
+func CallAppendResultRPC(hostname string, args *MasterRequestArgs) bool {
+	client, err := rpc.DialHTTP("tcp", rpcAddr(hostname, MAPLEJUICE_RPC_PORT))
 	if err != nil {
-		log.Fatalf("Error in dialing. %s", err)
+		log.Infof("Error in dialing. %s", err)
+		return false
 	}
+	defer client.Close()
 
-	err = client.Call("ExecuteMapleJuice.AppendResult", data, nil)
+	err = client.Call("ExecuteMapleJuice.AppendResult", args, nil)
 	if err != nil {
-		log.Fatalf("error in ExecuteMapleJuice.AppendResult", err)
+		log.Infof("error in ExecuteMapleJuice.AppendResult %s", err)
+		return false
 	}
-}
\ No newline at end of file
+
+	return true
+}
@@ -2,80 +2,167 @@ package server
 
 import (
 	log "github.com/sirupsen/logrus"
-	"io/ioutil"
+	"io"
 	"net/rpc"
 	"os"
-	"time"
 )
 
 var FILE_RPC_PORT string = "7000"
 var SERVER_FOLDER_NAME string = "serverFiles"
 var LOCAL_FOLDER_NAME string = "localFiles"
 
+// Request for a file. Offset is where the next chunk of a download starts
 type FileTransferRequest struct {
-	FileName  string
-	FileGroup []string
-	Data      []byte
+	FileName string
+	Version  int
+	Offset   int64
 }
 
-type FileTransfer int
+type FileTransfer struct {
+	node *Node
+}
 
-// Caller will send the file to the server. Server saves the file
-func (t *FileTransfer) SendFile(request FileTransferRequest, _ *[]byte) error {
-	filePath := SERVER_FOLDER_NAME + "/" + request.FileName
-	fileDes, _ := os.OpenFile(filePath, os.O_TRUNC|os.O_CREATE|os.O_RDWR, 0666)
-	defer fileDes.Close()
+// Caller will send a version of the file to the server one chunk at a time. Server saves the file
+// next to its other versions once the last chunk arrived, so readers never see a version that is
+// only half written
+func (t *FileTransfer) SendChunk(chunk FileChunk, response *ChunkResponse) error {
+	chunkResponse, partPath, complete, err := t.node.receiveChunk(&chunk)
+	if err != nil {
+		log.Infof("Could not store chunk of file %s! %s", chunk.FileName, err)
+		return err
+	}
+	*response = chunkResponse
+	if !complete {
+		t.node.renewUpload(chunk.FileName, chunk.Version)
+		return nil
+	}
 
-	fileDes.Write(request.Data)
-	LocalFiles.Files[request.FileName] = request.FileGroup
-	LocalFiles.UpdateTimes[request.FileName] = time.Now().UnixNano() / int64(time.Millisecond)
-	log.Infof("Stored file %s to this server!", request.FileName)
+	err = os.Rename(partPath, t.node.versionPath(chunk.FileName, chunk.Version))
+	if err != nil {
+		log.Infof("Could not store file %s! %s", chunk.FileName, err)
+		return err
+	}
+
+	t.node.LocalFiles.StoreVersion(chunk.FileName, chunk.Version, chunk.FileGroup, t.node.mayBeAlive)
+	log.Infof("Stored version %d of file %s to this server!", chunk.Version, chunk.FileName)
 
 	return nil
 }
 
-// Caller will request a file from the server. Server replies with the file
-func (t *FileTransfer) GetFile(request FileTransferRequest, data *[]byte) error {
-	filePath := SERVER_FOLDER_NAME + "/" + request.FileName
-	fileContents, _ := ioutil.ReadFile(filePath)
-	*data = fileContents
-	log.Infof("Sending file %s to client!", request.FileName)
+// Caller will send the data of an append one chunk at a time. Once the last chunk arrived, the
+// server stores its copy of the base version with the data added as the new version, and replies
+// with the checksum of the new version
+func (t *FileTransfer) ExtendChunk(chunk FileChunk, response *ChunkResponse) error {
+	chunkResponse, partPath, complete, err := t.node.receiveChunk(&chunk)
+	if err != nil {
+		log.Infof("Could not store chunk of the append to file %s! %s", chunk.FileName, err)
+		return err
+	}
+	*response = chunkResponse
+	if !complete {
+		t.node.renewUpload(chunk.FileName, chunk.Version)
+		return nil
+	}
+	defer os.Remove(partPath)
+
+	checksum, err := t.node.extendVersion(chunk.FileName, chunk.Base, chunk.Version, chunk.FileGroup, partPath)
+	if err != nil {
+		log.Infof("Could not append to file %s! %s", chunk.FileName, err)
+		return err
+	}
+	response.Checksum = checksum
+	log.Infof("Stored version %d of file %s on top of version %d to this server!", chunk.Version, chunk.FileName, chunk.Base.Version)
 
 	return nil
 }
 
-// Function specific for processing maps from other workers. 
-func (t *FileTransfer) AppendData(request FileTransferRequest, _ *[]byte) error {
-	
-	// In this case, request.FileName will be the sourcehost name
-	filePath := request.FileName + "_tempMapOutput.txt" 
-	fileDes, _ := os.OpenFile(filePath, os.O_TRUNC|os.O_CREATE|os.O_RDWR, 0666)
-	fileDes.Write(request.Data)
-	fileDes.Close()
+// Caller will request a chunk of a version of a file from the server, or of the newest version
+// the server has if the version is 0. Server replies with up to CHUNK_SIZE bytes from the offset
+func (t *FileTransfer) GetChunk(request FileTransferRequest, chunk *FileChunk) error {
+	version := request.Version
+	if version == 0 {
+		if versions := t.node.LocalFiles.Versions(request.FileName); len(versions) != 0 {
+			version = versions[0]
+		}
+	}
+
+	file, err := os.Open(t.node.versionPath(request.FileName, version))
+	if err != nil {
+		log.Infof("Could not read file %s! %s", request.FileName, err)
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
 
-	log.Infof("Starting to process the aggregate map from %s", request.FileName)
-	ProcessAggregateMap(filePath)
-	log.Infof("Finished processing the aggregate map from %s", request.FileName)
-	os.Remove(filePath)
+	data := make([]byte, CHUNK_SIZE)
+	readCount, err := file.ReadAt(data, request.Offset)
+	if err != nil && err != io.EOF {
+		log.Infof("Could not read file %s! %s", request.FileName, err)
+		return err
+	}
+
+	*chunk = FileChunk{
+		FileName: request.FileName,
+		Version:  version,
+		Offset:   request.Offset,
+		Data:     data[:readCount],
+		Last:     request.Offset+int64(readCount) >= info.Size(),
+	}
+	if request.Offset == 0 {
+		log.Infof("Sending file %s to client!", request.FileName)
+	}
+
+	return nil
+}
 
+// Returns the versions of a file this server stores, newest first, so a reader can compare the
+// versions of the replicas
+func (t *FileTransfer) StoredVersions(request FileTransferRequest, response *[]int) error {
+	*response = t.node.LocalFiles.Versions(request.FileName)
 	return nil
 }
 
-// Helper that will invoke the tranfer data RPC as specified by requestType
-func CallFileTransferRPC(hostname string, requestType string, request *FileTransferRequest) ([]byte) {
-	client, err := rpc.DialHTTP("tcp", hostname+":"+FILE_RPC_PORT)
+// Asks a server which versions of a file it stores and returns if it answered
+func CallStoredVersionsRPC(hostname string, request *FileTransferRequest) ([]int, bool) {
+	client, err := rpc.DialHTTP("tcp", rpcAddr(hostname, FILE_RPC_PORT))
 	if err != nil {
-		log.Fatalf("Could not dial server for file transfer: ", err)
-		return []byte{}
+		log.Infof("Could not dial server for file transfer: %s", err)
+		return nil, false
 	}
 	defer client.Close()
 
-	var response []byte
-	err = client.Call(requestType, &request, &response)
+	var response []int
+	err = client.Call("FileTransfer.StoredVersions", &request, &response)
 	if err != nil {
-		log.Fatalf("Error in request", err)
-		return []byte{}
+		log.Infof("Error in request %s", err)
+		return nil, false
 	}
 
-	return response
-}
\ No newline at end of file
+	return response, true
+}
+
+// Function specific for processing maps from other workers. The aggregate map arrives one chunk
+// at a time and is processed once the last chunk is in
+func (t *FileTransfer) AppendChunk(chunk FileChunk, response *ChunkResponse) error {
+	chunkResponse, partPath, complete, err := t.node.receiveChunk(&chunk)
+	if err != nil {
+		log.Infof("Could not store chunk of the aggregate map from %s! %s", chunk.FileName, err)
+		return err
+	}
+	*response = chunkResponse
+	if !complete {
+		return nil
+	}
+
+	// In this case, chunk.FileName will be the sourcehost name
+	log.Infof("Starting to process the aggregate map from %s", chunk.FileName)
+	t.node.ProcessAggregateMap(partPath)
+	log.Infof("Finished processing the aggregate map from %s", chunk.FileName)
+	os.Remove(partPath)
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"time"
+)
+
+type RequestVoteArgs struct {
+	Term         uint64
+	Candidate    string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type RequestVoteReply struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+// An append with no entries is the leader's heartbeat. ConflictIndex is where the follower's
+// log stops matching when Success is false
+type AppendEntriesArgs struct {
+	Term         uint64
+	Leader       string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []RaftEntry
+	LeaderCommit uint64
+}
+
+type AppendEntriesReply struct {
+	Term          uint64
+	Success       bool
+	ConflictIndex uint64
+}
+
+type InstallSnapshotArgs struct {
+	Term         uint64
+	Leader       string
+	Index        uint64
+	SnapshotTerm uint64
+	State        *RequestQueues
+}
+
+type InstallSnapshotReply struct {
+	Term uint64
+}
+
+type ProposeReply struct {
+	Index uint64
+}
+
+// This RPC server handles the messages of the replicated log between the nodes, and the commands
+// followers forward to the leader. Connections the leader opened before a node was killed stay
+// open, so a killed node refuses them instead of answering with its old log
+type Raft struct {
+	node *Node
+}
+
+func (t *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	if t.node.isPaused() {
+		return ErrNodePaused
+	}
+	if t.node.isStopped() {
+		return ErrNodeStopped
+	}
+
+	t.node.Log.handleRequestVote(args, reply)
+	return nil
+}
+
+func (t *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	if t.node.isPaused() {
+		return ErrNodePaused
+	}
+	if t.node.isStopped() {
+		return ErrNodeStopped
+	}
+
+	t.node.Log.handleAppendEntries(args, reply)
+	return nil
+}
+
+func (t *Raft) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	if t.node.isPaused() {
+		return ErrNodePaused
+	}
+	if t.node.isStopped() {
+		return ErrNodeStopped
+	}
+
+	t.node.Log.handleInstallSnapshot(args, reply)
+	return nil
+}
+
+// Appends a command forwarded by a follower. Returns once the command is applied on this node
+func (t *Raft) Propose(command RaftCommand, reply *ProposeReply) error {
+	if t.node.isPaused() {
+		return ErrNodePaused
+	}
+	if t.node.isStopped() {
+		return ErrNodeStopped
+	}
+
+	index, err := t.node.Log.Propose(command)
+	reply.Index = index
+	return err
+}
+
+// Helper that forwards a command to the leader and returns the index it was applied at
+func CallProposeRPC(hostname string, command RaftCommand) (uint64, error) {
+	client, err := rpc.DialHTTP("tcp", rpcAddr(hostname, RAFT_RPC_PORT))
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	reply := &ProposeReply{}
+	err = client.Call("Raft.Propose", command, reply)
+	if err != nil {
+		return 0, err
+	}
+
+	return reply.Index, nil
+}
+
+// Same as rpc.DialHTTP, but gives up on nodes that do not accept the connection within the timeout
+func dialRPC(hostname string, servicePort string, timeout time.Duration) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("tcp", rpcAddr(hostname, servicePort), timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	response, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && response.Status != "200 Connected to Go RPC" {
+		err = errors.New("unexpected HTTP response: " + response.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return rpc.NewClient(conn), nil
+}
@@ -2,71 +2,77 @@ package server
 
 import (
 	log "github.com/sirupsen/logrus"
-	"net/rpc"
 	"io/ioutil"
+	"net/rpc"
 	"os"
-	"path"
-	"strings"
-	"time"
 )
 
 var SERVER_RPC_PORT string = "6000"
-var FILE_DELIMITER string = "~"
 
+// NewName is the name a file is linked as when it is moved, with its versions numbered
+// VersionShift higher
 type ServerRequestArgs struct {
-	ID       string
-	FileName string
-	HostList []string
+	FileName     string
+	NewName      string
+	VersionShift int
+	HostList     []string
 }
 
-type ServerCommunication int
-
-// When the file is found, it will call this RPC to the leader and send the fileGroup via golbal map
-func (t *ServerCommunication) FileFound(serverAck *ServerRequestArgs, _ *string) error {
-	FindFileResponseMutex.Lock()
-	FileFoundResponses[serverAck.ID] = serverAck.HostList
-	FindFileResponseMutex.Unlock()
-	return nil
+type ServerCommunication struct {
+	node *Node
 }
 
-// When the file is not found on a server, the server pings the master to inform it.
-func (t *ServerCommunication) FileNotFound(serverAck *ServerRequestArgs, _ *string) error {
-	FindFileResponseMutex.Lock()
-	FileNotFoundCounts[serverAck.ID]++
-	FindFileResponseMutex.Unlock()
+// This call will be used to update the fileGroup when files are resharded. A node that is not in
+// the new fileGroup anymore deletes its copy
+func (t *ServerCommunication) UpdateFileGroup(request ServerRequestArgs, _ *string) error {
+	for _, member := range request.HostList {
+		if member == t.node.ID {
+			t.node.LocalFiles.Store(request.FileName, request.HostList, t.node.mayBeAlive)
+			return nil
+		}
+	}
+
+	t.node.deleteLocalFile(request.FileName)
 	return nil
 }
 
-
-// This call will be used to update the fileGroup when files are resharded
-func (t *ServerCommunication) UpdateFileGroup(request ServerRequestArgs, _ *string) error {
-	LocalFiles.Files[request.FileName] = request.HostList
-	LocalFiles.UpdateTimes[request.FileName] = time.Now().UnixNano() / int64(time.Millisecond)
+// This call is made to the replicas of a file once it was removed from the metadata directory
+func (t *ServerCommunication) DeleteFile(request ServerRequestArgs, _ *string) error {
+	if _, contains := t.node.LocalFiles.FileGroup(request.FileName); contains {
+		t.node.deleteLocalFile(request.FileName)
+	}
 
 	return nil
 }
 
-// This call will look for any files that are in the specified directory
-func (t *ServerCommunication) FindDirectory(dirName string, files *[]string) error {
-	hostname, _ := os.Hostname()
-	dirFiles := []string{}
-
-	for file, fileGroup := range LocalFiles.Files {
-		folderName := strings.Split(file, FILE_DELIMITER)[0]
+// This call is made to the replicas of a file that is moved. The versions this node stores are
+// linked under the new name, so the move does not copy them. The new name has the given fileGroup
+func (t *ServerCommunication) LinkFile(request ServerRequestArgs, _ *string) error {
+	if _, contains := t.node.LocalFiles.FileGroup(request.FileName); !contains {
+		return ErrPathNotFound
+	}
 
-		if folderName == dirName && fileGroup[0] == hostname {
-			dirFiles = append(dirFiles, file)
+	for _, version := range t.node.LocalFiles.Versions(request.FileName) {
+		newVersion := version + request.VersionShift
+		newPath := t.node.versionPath(request.NewName, newVersion)
+		os.Remove(newPath)
+		err := os.Link(t.node.versionPath(request.FileName, version), newPath)
+		if err != nil {
+			log.Infof("Could not link version %d of file %s as %s! %s", version, request.FileName, request.NewName, err)
+			return err
 		}
+
+		t.node.LocalFiles.StoreVersion(request.NewName, newVersion, request.HostList, t.node.mayBeAlive)
 	}
 
-	*files = dirFiles
+	log.Infof("Linked file %s as %s", request.FileName, request.NewName)
 	return nil
 }
 
 // This is gross and I know it
 func (t *ServerCommunication) GrossFindDirectory(_ string, files *[]string) error {
 	fileList := []string{}
-	dirFiles, _ := ioutil.ReadDir(MAPLE_TEMP_FOLDER_NAME)
+	dirFiles, _ := ioutil.ReadDir(t.node.dataPath(MAPLE_TEMP_FOLDER_NAME))
 	for _, file := range dirFiles {
 		fileList = append(fileList, file.Name())
 	}
@@ -75,105 +81,90 @@ func (t *ServerCommunication) GrossFindDirectory(_ string, files *[]string) erro
 	return nil
 }
 
-// This call will get the list of all files processed at the worker
-func (t *ServerCommunication) GetProcessedFiles(_ string, files *[]string) error {
-	*files = ProcessedFiles
-	return nil
-}
-
-// This call will be called for every node to delete the tempMapleOutput folder
-func (t *ServerCommunication) DeleteFolder(_ string, _ *string) error {
-	names, err := ioutil.ReadDir("mapleTempOutputs")
-	if err != nil {
-		return err
+// This call will be called for every node to delete the tempMapleOutput folder, along with the
+// marks of the files whose output was in it. Refused if the master was replaced by a newer one
+func (t *ServerCommunication) DeleteFolder(masterTerm uint64, _ *string) error {
+	if t.node.isStaleMaster(masterTerm) {
+		return ErrStaleMaster
 	}
-	for _, entery := range names {
-		os.RemoveAll(path.Join([]string{"mapleTempOutputs", entery.Name()}...))
+
+	t.node.mapleOutputMutex.Lock()
+	defer t.node.mapleOutputMutex.Unlock()
+
+	for _, folder := range []string{MAPLE_TEMP_FOLDER_NAME, MAPLE_TASKS_FOLDER_NAME} {
+		names, err := ioutil.ReadDir(t.node.dataPath(folder))
+		if err != nil {
+			return err
+		}
+		for _, entery := range names {
+			os.RemoveAll(t.node.dataPath(folder, entery.Name()))
+		}
 	}
 	return nil
 }
 
 // Helper that will invoke the tranfer data RPC as specified by requestType
 func CallServerCommunicationRPC(hostname string, requestType string, request *ServerRequestArgs) {
-	client, err := rpc.DialHTTP("tcp", hostname+":"+SERVER_RPC_PORT)
+	client, err := rpc.DialHTTP("tcp", rpcAddr(hostname, SERVER_RPC_PORT))
 	if err != nil {
-		log.Fatalf("Could not dial server for server communication: ", err)
+		log.Infof("Could not dial server for server communication: %s", err)
 		return
 	}
 	defer client.Close()
 
 	err = client.Call(requestType, &request, nil)
 	if err != nil {
-		log.Fatalf("Error in request", err)
+		log.Infof("Error in request %s", err)
 	}
 }
 
-// Helper that will invoke the FindDirectory RPC which will get all files in the specified directory
-func CallFindDirectoryRPC(hostname string, dirName string) ([]string) {
-	client, err := rpc.DialHTTP("tcp", hostname+":"+SERVER_RPC_PORT)
+// Asks a replica of a file to link it under a new name and returns if it did
+func CallLinkFileRPC(hostname string, request *ServerRequestArgs) bool {
+	client, err := rpc.DialHTTP("tcp", rpcAddr(hostname, SERVER_RPC_PORT))
 	if err != nil {
-		log.Fatalf("Could not dial server for finding files in %s: ", dirName, err)
-		return []string{}
+		log.Infof("Could not dial server for server communication: %s", err)
+		return false
 	}
 	defer client.Close()
 
-	var response []string
-	err = client.Call("ServerCommunication.FindDirectory", dirName, &response)
+	err = client.Call("ServerCommunication.LinkFile", request, nil)
 	if err != nil {
-		log.Fatalf("Error in find directory", err)
-		return []string{}
+		log.Infof("Error in request %s", err)
+		return false
 	}
 
-	return response
+	return true
 }
 
 // Gross function cause fml
-func CallGrossFindDir(hostname string) ([]string) {
-	client, err := rpc.DialHTTP("tcp", hostname+":"+SERVER_RPC_PORT)
+func CallGrossFindDir(hostname string) ([]string, bool) {
+	client, err := rpc.DialHTTP("tcp", rpcAddr(hostname, SERVER_RPC_PORT))
 	if err != nil {
-		return []string{}
+		return []string{}, false
 	}
 	defer client.Close()
 
 	var response []string
 	err = client.Call("ServerCommunication.GrossFindDirectory", "", &response)
 	if err != nil {
-		log.Fatalf("Error in find directory", err)
-		return []string{}
+		log.Infof("Error in find directory %s", err)
+		return []string{}, false
 	}
 
-	return response
-}
-
-// Helper that will call the getProcessedFiles RPC
-func CallGetProcessedFilesRPC(hostname string) ([]string) {
-	client, err := rpc.DialHTTP("tcp", hostname+":"+SERVER_RPC_PORT)
-	if err != nil {
-		log.Fatalf("Could not dial server for finding processed files %s", err)
-		return []string{}
-	}
-	defer client.Close()
-
-	var response []string
-	err = client.Call("ServerCommunication.GetProcessedFiles", "", &response)
-	if err != nil {
-		log.Fatalf("Error in find processed files", err)
-		return []string{}
-	}
-
-	return response
+	return response, true
 }
 
 // Helper that will call the delete folder RPC
-func CallDeleteFolder(hostname string) {
-	client, err := rpc.DialHTTP("tcp", hostname+":"+SERVER_RPC_PORT)
+func CallDeleteFolder(hostname string, masterTerm uint64) {
+	client, err := rpc.DialHTTP("tcp", rpcAddr(hostname, SERVER_RPC_PORT))
 	if err != nil {
-		log.Fatalf("Could not dial server for finding processed files %s", err)
+		log.Infof("Could not dial server for deleting the folder %s", err)
+		return
 	}
 	defer client.Close()
 
-	err = client.Call("ServerCommunication.DeleteFolder", "", nil)
+	err = client.Call("ServerCommunication.DeleteFolder", masterTerm, nil)
 	if err != nil {
-		log.Fatalf("Error in find delete folder", err)
+		log.Infof("Error in delete folder %s", err)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// How often every version stored on this node is read and checked against its checksum
+var SCRUB_INTERVAL time.Duration = 10 * time.Minute
+
+// Goroutine that checks the versions stored on this node each SCRUB_INTERVAL, so a copy that was
+// corrupted on disk is found and replaced before a reader or the replication needs it
+func (node *Node) ScrubManager() {
+	ticker := time.NewTicker(SCRUB_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-node.stop:
+			return
+		}
+
+		node.scrubFiles()
+	}
+}
+
+// Checks every version stored on this node that is kept in the metadata directory against its
+// checksum, and replaces the corrupt ones with a copy from another replica
+func (node *Node) scrubFiles() {
+	// A node that does not know of a leader may be behind on the directory
+	if node.Log.Leader() == "" {
+		return
+	}
+
+	checked, corrupt, repaired := 0, 0, 0
+	for fileName := range node.LocalFiles.Files() {
+		metadata, committed := node.FileMetadata(fileName)
+		if !committed {
+			continue
+		}
+
+		for _, version := range node.LocalFiles.Versions(fileName) {
+			if node.isStopped() {
+				return
+			}
+
+			fileVersion, kept := metadata.FindVersion(version)
+			if !kept || fileVersion.Checksum == "" {
+				continue
+			}
+
+			checked++
+			if node.verifyVersion(metadata, version) {
+				continue
+			}
+
+			log.Infof("Version %d of file %s does not match its checksum, replacing it", version, fileName)
+			corrupt++
+			if node.repairVersion(metadata, fileVersion) {
+				repaired++
+			}
+		}
+	}
+
+	if corrupt != 0 {
+		log.Infof("Scrubbed %d versions, %d were corrupt and %d of them were replaced", checked, corrupt, repaired)
+	}
+}
+
+// Checks the copy of a version stored on this node against its checksum in the metadata directory.
+// Returns false if the version is not stored on this node or its copy is corrupt
+func (node *Node) verifyVersion(metadata FileMetadata, version int) bool {
+	fileVersion, kept := metadata.FindVersion(version)
+	if !kept || !node.LocalFiles.HasVersion(metadata.Name, version) {
+		return false
+	}
+	if fileVersion.Checksum == "" {
+		return true
+	}
+
+	checksum, _, err := FileChecksumAt(node.versionPath(metadata.Name, version))
+	return err == nil && checksum == fileVersion.Checksum
+}
+
+// Replaces the copy of a version stored on this node with one from the other replicas of the file.
+// The download is checked against the checksum of the version before it replaces the copy
+func (node *Node) repairVersion(metadata FileMetadata, fileVersion FileVersion) bool {
+	fileGroup, _ := node.LocalFiles.FileGroup(metadata.Name)
+	hostList := []string{}
+	for _, member := range RandomOrder(append(fileGroup, fileVersion.Replicas...)) {
+		if member != node.ID && !containsMember(hostList, member) {
+			hostList = append(hostList, member)
+		}
+	}
+
+	if !FetchVersion(hostList, metadata.Name, fileVersion, node.versionPath(metadata.Name, fileVersion.Version)) {
+		log.Infof("Could not replace version %d of file %s from any of %v!", fileVersion.Version, metadata.Name, hostList)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// A download that does not match the checksum of the version is started over from the next
+// replica, and fails without writing anything if no replica has a good copy
+func TestFetchVersionChecksumMismatch(t *testing.T) {
+	nodes := newFileNodes(t, 25021, 25022)
+	storeLocalVersion(t, nodes[0], "a.txt", 1, []byte("corrupt"))
+	storeLocalVersion(t, nodes[1], "a.txt", 1, []byte("content"))
+	fileVersion := FileVersion{Version: 1, Checksum: FileChecksum([]byte("content"))}
+
+	localPath := filepath.Join(t.TempDir(), "a.txt")
+	if !FetchVersion([]string{nodes[0].ID, nodes[1].ID}, "a.txt", fileVersion, localPath) {
+		t.Fatal("Version was not fetched from the replica with a good copy")
+	}
+	if content, _ := ioutil.ReadFile(localPath); string(content) != "content" {
+		t.Fatalf("Fetched %q, expected the good copy", content)
+	}
+
+	ioutil.WriteFile(localPath, []byte("old"), 0666)
+	if FetchVersion([]string{nodes[0].ID}, "a.txt", fileVersion, localPath) {
+		t.Fatal("Corrupt copy was fetched")
+	}
+	if content, _ := ioutil.ReadFile(localPath); string(content) != "old" {
+		t.Fatalf("Failed fetch replaced the local file with %q", content)
+	}
+}
+
+// The scrubber replaces a corrupt copy stored on the node with the copy of another replica, and
+// leaves good copies alone
+func TestScrubFiles(t *testing.T) {
+	nodes := newFileNodes(t, 25031, 25032)
+	replicas := []string{nodes[0].ID, nodes[1].ID}
+	queues := putVersion(&RequestQueues{}, "a.txt", 1, replicas)
+	queues = putVersion(queues, "a.txt", 2, replicas)
+
+	node := nodes[0]
+	node.setQueues(queues)
+	node.Log.leader = nodes[1].ID
+	storeLocalVersion(t, node, "a.txt", 1, []byte{1})
+	storeLocalVersion(t, node, "a.txt", 2, []byte("corrupt"))
+	storeLocalVersion(t, nodes[1], "a.txt", 2, []byte{2})
+
+	metadata, _ := node.FileMetadata("a.txt")
+	if !node.verifyVersion(metadata, 1) || node.verifyVersion(metadata, 2) {
+		t.Fatal("Copies were not checked against their checksums")
+	}
+
+	node.scrubFiles()
+	if content, _ := ioutil.ReadFile(node.versionPath("a.txt", 2)); string(content) != string([]byte{2}) {
+		t.Fatalf("Corrupt copy was replaced with %q", content)
+	}
+	if !node.verifyVersion(metadata, 1) || !node.verifyVersion(metadata, 2) {
+		t.Fatal("Scrubbed copies do not match their checksums")
+	}
+}
@@ -0,0 +1,453 @@
+package server
+
+import (
+	log "github.com/sirupsen/logrus"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Length of one protocol period, the time a node has to ping its probe target directly and indirectly
+var PROTOCOL_PERIOD time.Duration = 1000 * time.Millisecond
+
+// Time to wait for a direct ack before asking other members to probe the target
+var PING_TIMEOUT time.Duration = 300 * time.Millisecond
+
+// Number of members asked to probe a target that did not answer the direct ping
+var INDIRECT_PROBES int = 3
+
+// An update is piggybacked RETRANSMIT_MULT * log(n) times before it is dropped, and a message
+// carries at most MAX_PIGGYBACK updates
+var RETRANSMIT_MULT int = 3
+var MAX_PIGGYBACK int = 6
+
+// Message types of the failure detector
+type SwimMessageType uint8
+
+const (
+	SWIM_PING SwimMessageType = iota
+	SWIM_PING_REQ
+	SWIM_ACK
+	SWIM_JOIN
+
+	// The rest of the updates of a message that was split into several packets. Only the first
+	// packet carries the type of the message, so the receiver answers it once
+	SWIM_UPDATE
+)
+
+// Membership change that is gossiped by piggybacking it on pings and acks
+type MemberUpdate struct {
+	Node        string
+	State       MemberState
+	Incarnation uint64
+	Heartbeat   uint64
+}
+
+// Every UDP message sent between nodes. Target is the node to probe for a PingReq and Heartbeat
+// is the heartbeat counter of the sender
+type SwimMessage struct {
+	Type      SwimMessageType
+	Seq       uint64
+	Src       string
+	Target    string
+	Heartbeat uint64
+	Updates   []MemberUpdate
+}
+
+// An update waiting to be piggybacked and how many times it has been sent
+type swimBroadcast struct {
+	update    MemberUpdate
+	transmits int
+}
+
+// Picks the next member to probe. Members are probed round robin in a random order that is
+// reshuffled every round, so every member is probed within a bounded time.
+func (node *Node) nextProbeTarget() string {
+	node.swimMutex.Lock()
+	defer node.swimMutex.Unlock()
+
+	for len(node.probeOrder) > 0 {
+		target := node.probeOrder[0]
+		node.probeOrder = node.probeOrder[1:]
+		if target != node.ID && node.Membership.Contains(target) {
+			return target
+		}
+	}
+
+	for _, member := range node.Membership.List() {
+		if member != node.ID {
+			node.probeOrder = append(node.probeOrder, member)
+		}
+	}
+	rand.Shuffle(len(node.probeOrder), func(i, j int) {
+		node.probeOrder[i], node.probeOrder[j] = node.probeOrder[j], node.probeOrder[i]
+	})
+
+	if len(node.probeOrder) == 0 {
+		return ""
+	}
+
+	target := node.probeOrder[0]
+	node.probeOrder = node.probeOrder[1:]
+	return target
+}
+
+// Function called by the heartbeat manager every protocol period. Pings the next member and if it
+// does not ack in time, asks INDIRECT_PROBES other members to ping it. If nobody gets an ack
+// before the period ends the member is suspected.
+func (node *Node) probeNextMember(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	target := node.nextProbeTarget()
+	if target == "" {
+		return
+	}
+
+	if node.pingAndWait(target, PING_TIMEOUT) {
+		return
+	}
+
+	seq, ackChan := node.newAckWaiter()
+	defer node.removeAckWaiter(seq)
+	for _, helper := range node.randomMembers(INDIRECT_PROBES, target) {
+		node.sendMessage(helper, &SwimMessage{Type: SWIM_PING_REQ, Seq: seq, Target: target})
+	}
+
+	select {
+	case <-ackChan:
+		return
+	case <-time.After(PROTOCOL_PERIOD - PING_TIMEOUT):
+	case <-node.stop:
+		return
+	}
+
+	node.swimMutex.Lock()
+	member := *node.Membership.members[target]
+	node.swimMutex.Unlock()
+
+	log.Infof("Node %s did not respond to any probes!", target)
+	node.applyUpdate(MemberUpdate{Node: target, State: MEMBER_SUSPECT, Incarnation: member.Incarnation, Heartbeat: member.Heartbeat})
+}
+
+// Sends a ping and returns whether it was acked within the timeout
+func (node *Node) pingAndWait(target string, timeout time.Duration) bool {
+	seq, ackChan := node.newAckWaiter()
+	defer node.removeAckWaiter(seq)
+
+	node.sendMessage(target, &SwimMessage{Type: SWIM_PING, Seq: seq})
+	select {
+	case <-ackChan:
+		return true
+	case <-time.After(timeout):
+		return false
+	case <-node.stop:
+		return false
+	}
+}
+
+// Registers a channel that is closed when an ack with the returned sequence number arrives
+func (node *Node) newAckWaiter() (uint64, chan struct{}) {
+	node.swimMutex.Lock()
+	defer node.swimMutex.Unlock()
+
+	node.swimSeq++
+	ackChan := make(chan struct{})
+	node.ackWaiters[node.swimSeq] = ackChan
+	return node.swimSeq, ackChan
+}
+
+func (node *Node) removeAckWaiter(seq uint64) {
+	node.swimMutex.Lock()
+	delete(node.ackWaiters, seq)
+	node.swimMutex.Unlock()
+}
+
+// Returns up to count random members of the list, excluding this node and the given node
+func (node *Node) randomMembers(count int, excluded string) []string {
+	node.swimMutex.Lock()
+	candidates := []string{}
+	for _, member := range node.Membership.List() {
+		if member != node.ID && member != excluded {
+			candidates = append(candidates, member)
+		}
+	}
+	node.swimMutex.Unlock()
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > count {
+		candidates = candidates[:count]
+	}
+
+	return candidates
+}
+
+// Fills in the sender and the piggybacked updates, then writes the message
+// to the UDP socket of the target. Messages that already carry updates get no extra piggyback.
+// Messages bigger than MAX_PACKET_SIZE are sent as several packets.
+func (node *Node) sendMessage(target string, message *SwimMessage) {
+	message.Src = node.ID
+	if message.Updates == nil {
+		message.Updates = node.piggybackUpdates()
+	}
+	node.swimMutex.Lock()
+	message.Heartbeat = node.Membership.members[node.ID].Heartbeat
+	node.swimMutex.Unlock()
+
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		log.Infof("Could not connect to node %s! %s", target, err)
+		return
+	}
+	defer conn.Close()
+
+	for _, packet := range encodeSwimMessage(message) {
+		conn.Write(packet)
+	}
+}
+
+// Handles a message read from the UDP socket
+func (node *Node) handleMessage(message *SwimMessage) {
+	for _, update := range message.Updates {
+		node.applyUpdate(update)
+	}
+	node.mergeHeartbeat(message.Src, message.Heartbeat)
+
+	switch message.Type {
+	case SWIM_PING:
+		ack := &SwimMessage{Type: SWIM_ACK, Seq: message.Seq}
+
+		// A member we already removed is still pinging us, so tell it what we think of it
+		// and let it refute by rejoining with a higher incarnation
+		if update, removed := node.removedMemberUpdate(message.Src); removed {
+			ack.Updates = append(node.piggybackUpdates(), update)
+		}
+		node.sendMessage(message.Src, ack)
+
+	case SWIM_JOIN:
+		log.Infof("Node %s is joining through this node!", message.Src)
+		node.sendMessage(message.Src, &SwimMessage{Type: SWIM_ACK, Seq: message.Seq, Updates: node.fullStateUpdates()})
+
+	case SWIM_PING_REQ:
+		go func() {
+			if node.pingAndWait(message.Target, PING_TIMEOUT) {
+				node.sendMessage(message.Src, &SwimMessage{Type: SWIM_ACK, Seq: message.Seq, Target: message.Target})
+			}
+		}()
+
+	case SWIM_ACK:
+		node.swimMutex.Lock()
+		if ackChan, contains := node.ackWaiters[message.Seq]; contains {
+			close(ackChan)
+			delete(node.ackWaiters, message.Seq)
+		}
+		node.swimMutex.Unlock()
+	}
+}
+
+// Records a newer heartbeat counter of a member. Heartbeats only grow, so the highest one wins
+// no matter which node it came through
+func (node *Node) mergeHeartbeat(memberName string, heartbeat uint64) {
+	node.swimMutex.Lock()
+	defer node.swimMutex.Unlock()
+
+	member, known := node.Membership.members[memberName]
+	if known && memberName != node.ID && heartbeat > member.Heartbeat {
+		member.Heartbeat = heartbeat
+	}
+}
+
+// Applies a gossiped update using the SWIM override rules. An update about a member in the list
+// wins if it has a higher incarnation, or the same incarnation and a later state, so Suspect
+// overrides Alive and Failed or Left removes the member. A removed member only comes back with
+// a higher incarnation. Updates that changed the state are queued to be piggybacked further and
+// published to the subscribers of membership events.
+func (node *Node) applyUpdate(update MemberUpdate) {
+	node.swimMutex.Lock()
+	defer node.swimMutex.Unlock()
+
+	memberName := update.Node
+	if memberName == node.ID {
+		node.refuteUpdate(update)
+		return
+	}
+
+	event := MembershipEvent{Node: memberName, Incarnation: update.Incarnation}
+	member, known := node.Membership.members[memberName]
+	if !known {
+		member = &Member{State: update.State, Incarnation: update.Incarnation, Heartbeat: update.Heartbeat}
+		node.Membership.members[memberName] = member
+
+		// Nodes that were removed before this node joined are only remembered
+		if !update.State.IsActive() {
+			return
+		}
+		log.Infof("Added %s to membership list!", memberName)
+		event.Type = EVENT_MEMBER_JOINED
+	} else {
+		if update.Heartbeat > member.Heartbeat {
+			member.Heartbeat = update.Heartbeat
+		}
+		if !updateOverrides(update, member) {
+			return
+		}
+
+		switch update.State {
+		case MEMBER_ALIVE:
+			event.Type = EVENT_MEMBER_ALIVE
+		case MEMBER_SUSPECT:
+			log.Infof("Suspecting node %s!", memberName)
+			event.Type = EVENT_MEMBER_SUSPECTED
+		case MEMBER_LEFT:
+			log.Infof("Node %s left the network!", memberName)
+			event.Type = EVENT_MEMBER_LEFT
+		case MEMBER_FAILED:
+			log.Infof("Node %s timed out!", memberName)
+			event.Type = EVENT_MEMBER_FAILED
+		}
+
+		if !member.State.IsActive() {
+			log.Infof("Recieved new incarnation from node %s. Adding back to list", memberName)
+			event.Type = EVENT_MEMBER_JOINED
+		}
+
+		member.State = update.State
+		member.Incarnation = update.Incarnation
+	}
+
+	if update.State == MEMBER_SUSPECT {
+		member.SuspectedAt = node.Membership.members[node.ID].Heartbeat
+	}
+	if update.State.IsActive() {
+		node.addToList(memberName)
+	} else {
+		node.removeFromList(memberName)
+	}
+
+	node.queueBroadcast(update)
+	node.publishEvent(event)
+}
+
+// Checks if an update wins over what is known about the member
+func updateOverrides(update MemberUpdate, member *Member) bool {
+	if !member.State.IsActive() {
+		return update.State.IsActive() && update.Incarnation > member.Incarnation
+	}
+	if update.Incarnation != member.Incarnation {
+		return update.Incarnation > member.Incarnation
+	}
+
+	return update.State > member.State
+}
+
+// Called when this node hears an update about itself. If it is suspected or declared failed
+// while it is still running, it refutes by gossiping Alive with a higher incarnation.
+func (node *Node) refuteUpdate(update MemberUpdate) {
+	self := node.Membership.members[node.ID]
+	if update.State == MEMBER_ALIVE || update.Incarnation < self.Incarnation || self.State == MEMBER_LEFT {
+		return
+	}
+
+	log.Infof("Refuting %s update about this node with incarnation %d", update.State, update.Incarnation+1)
+	self.Incarnation = update.Incarnation + 1
+	node.queueBroadcast(node.selfUpdate())
+}
+
+// Returns the update describing this node. The caller must hold the swim mutex
+func (node *Node) selfUpdate() MemberUpdate {
+	self := node.Membership.members[node.ID]
+	return MemberUpdate{Node: node.ID, State: self.State, Incarnation: self.Incarnation, Heartbeat: self.Heartbeat}
+}
+
+// Adds an update to the broadcast queue, replacing any older update about the same node
+func (node *Node) queueBroadcast(update MemberUpdate) {
+	for i, broadcast := range node.broadcasts {
+		if broadcast.update.Node == update.Node {
+			node.broadcasts = append(node.broadcasts[:i], node.broadcasts[i+1:]...)
+			break
+		}
+	}
+
+	node.broadcasts = append(node.broadcasts, &swimBroadcast{update: update})
+}
+
+// Returns the updates to piggyback on the next message, preferring the ones sent the fewest times.
+// Updates are dropped once they have been sent RETRANSMIT_MULT * log(n) times.
+func (node *Node) piggybackUpdates() []MemberUpdate {
+	node.swimMutex.Lock()
+	defer node.swimMutex.Unlock()
+
+	transmitLimit := RETRANSMIT_MULT * int(math.Ceil(math.Log2(float64(node.Membership.Len()+1))))
+	sort.SliceStable(node.broadcasts, func(i, j int) bool {
+		return node.broadcasts[i].transmits < node.broadcasts[j].transmits
+	})
+
+	updates := []MemberUpdate{}
+	remaining := node.broadcasts[:0]
+	for _, broadcast := range node.broadcasts {
+		if len(updates) < MAX_PIGGYBACK {
+			updates = append(updates, broadcast.update)
+			broadcast.transmits++
+		}
+
+		if broadcast.transmits < transmitLimit {
+			remaining = append(remaining, broadcast)
+		}
+	}
+	node.broadcasts = remaining
+
+	return updates
+}
+
+// Returns an update for every member this node knows of, sent to nodes that are joining
+func (node *Node) fullStateUpdates() []MemberUpdate {
+	node.swimMutex.Lock()
+	defer node.swimMutex.Unlock()
+
+	updates := []MemberUpdate{}
+	for memberName, member := range node.Membership.members {
+		updates = append(updates, MemberUpdate{Node: memberName, State: member.State, Incarnation: member.Incarnation, Heartbeat: member.Heartbeat})
+	}
+
+	return updates
+}
+
+// If the member was removed from the list, returns the update that removed it
+func (node *Node) removedMemberUpdate(memberName string) (MemberUpdate, bool) {
+	node.swimMutex.Lock()
+	defer node.swimMutex.Unlock()
+
+	member, known := node.Membership.members[memberName]
+	if !known || member.State.IsActive() {
+		return MemberUpdate{}, false
+	}
+
+	return MemberUpdate{Node: memberName, State: member.State, Incarnation: member.Incarnation, Heartbeat: member.Heartbeat}, true
+}
+
+// Helpers that keep the membership list sorted. The caller must hold the swimMutex, so the list
+// does not change between reading and replacing it
+func (node *Node) addToList(member string) {
+	if node.Membership.Contains(member) {
+		return
+	}
+
+	newList := append(node.Membership.List(), member)
+	sort.Strings(newList)
+	node.Membership.setList(newList)
+}
+
+func (node *Node) removeFromList(member string) {
+	newList := []string{}
+	for _, listMember := range node.Membership.List() {
+		if listMember != member {
+			newList = append(newList, listMember)
+		}
+	}
+
+	node.Membership.setList(newList)
+}
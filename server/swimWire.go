@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Every heartbeat starts with this version byte so nodes running another format drop it
+const SWIM_WIRE_VERSION byte = 2
+
+// Largest UDP packet a node sends. Messages that do not fit are split into several packets
+var MAX_PACKET_SIZE int = 1024
+
+// Size of the buffer UDP packets are read into. This is the largest possible UDP payload, so
+// nodes configured with a bigger MAX_PACKET_SIZE can still be read
+const UDP_READ_BUFFER_SIZE int = 65535
+
+var errShortMessage = errors.New("heartbeat message is truncated")
+var errWireVersion = errors.New("heartbeat message has an unknown version")
+
+// Helper that appends uvarints and length prefixed strings to a buffer
+type wireWriter struct {
+	buf []byte
+}
+
+func (w *wireWriter) byte(value byte) {
+	w.buf = append(w.buf, value)
+}
+
+func (w *wireWriter) uvarint(value uint64) {
+	var scratch [binary.MaxVarintLen64]byte
+	w.buf = append(w.buf, scratch[:binary.PutUvarint(scratch[:], value)]...)
+}
+
+func (w *wireWriter) string(value string) {
+	w.uvarint(uint64(len(value)))
+	w.buf = append(w.buf, value...)
+}
+
+// Helper that reads what a wireWriter wrote. The first error sticks and every later read
+// returns the zero value, so callers only check err once at the end
+type wireReader struct {
+	buf []byte
+	err error
+}
+
+func (r *wireReader) byte() byte {
+	if r.err != nil || len(r.buf) == 0 {
+		r.err = errShortMessage
+		return 0
+	}
+
+	value := r.buf[0]
+	r.buf = r.buf[1:]
+	return value
+}
+
+func (r *wireReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	value, readLen := binary.Uvarint(r.buf)
+	if readLen <= 0 {
+		r.err = errShortMessage
+		return 0
+	}
+
+	r.buf = r.buf[readLen:]
+	return value
+}
+
+func (r *wireReader) string() string {
+	length := r.uvarint()
+	if r.err != nil || length > uint64(len(r.buf)) {
+		r.err = errShortMessage
+		return ""
+	}
+
+	value := string(r.buf[:length])
+	r.buf = r.buf[length:]
+	return value
+}
+
+// Reads the length of a list. Every entry takes at least one byte, so longer lists are corrupt
+func (r *wireReader) count() int {
+	count := r.uvarint()
+	if r.err != nil || count > uint64(len(r.buf)) {
+		r.err = errShortMessage
+		return 0
+	}
+
+	return int(count)
+}
+
+// Encodes a message into one or more UDP packets of at most MAX_PACKET_SIZE bytes. The membership
+// updates are spread over the packets, and each packet is a complete message so losing one does
+// not affect the others. Only the first packet is of the type of the message, the others are
+// SWIM_UPDATE packets without a sequence number or target, so they are never answered
+func encodeSwimMessage(message *SwimMessage) [][]byte {
+	header := encodeSwimHeader(message.Type, message.Seq, message.Src, message.Target, message.Heartbeat)
+	updateHeader := encodeSwimHeader(SWIM_UPDATE, 0, message.Src, "", message.Heartbeat)
+
+	updates := [][]byte{}
+	for _, update := range message.Updates {
+		encoded := &wireWriter{}
+		encoded.string(update.Node)
+		encoded.byte(byte(update.State))
+		encoded.uvarint(update.Incarnation)
+		encoded.uvarint(update.Heartbeat)
+
+		updates = append(updates, encoded.buf)
+	}
+
+	// Fill every packet with as many updates as fit. A packet always gets at least one update,
+	// so a single oversized update is still sent on its own
+	packets := [][]byte{}
+	for len(updates) > 0 || len(packets) == 0 {
+		if len(packets) == 1 {
+			header = updateHeader
+		}
+
+		packetLen := len(header.buf) + binary.MaxVarintLen64
+		count := 0
+		for count < len(updates) && (count == 0 || packetLen+len(updates[count]) <= MAX_PACKET_SIZE) {
+			packetLen += len(updates[count])
+			count++
+		}
+
+		packet := &wireWriter{buf: append([]byte{}, header.buf...)}
+		packet.uvarint(uint64(count))
+		for _, update := range updates[:count] {
+			packet.buf = append(packet.buf, update...)
+		}
+
+		packets = append(packets, packet.buf)
+		updates = updates[count:]
+	}
+
+	return packets
+}
+
+func encodeSwimHeader(messageType SwimMessageType, seq uint64, src string, target string, heartbeat uint64) *wireWriter {
+	header := &wireWriter{}
+	header.byte(SWIM_WIRE_VERSION)
+	header.byte(byte(messageType))
+	header.uvarint(seq)
+	header.string(src)
+	header.string(target)
+	header.uvarint(heartbeat)
+	return header
+}
+
+// Decodes one UDP packet written by encodeSwimMessage
+func decodeSwimMessage(packet []byte) (*SwimMessage, error) {
+	r := &wireReader{buf: packet}
+	if r.byte() != SWIM_WIRE_VERSION {
+		return nil, errWireVersion
+	}
+
+	message := &SwimMessage{}
+	message.Type = SwimMessageType(r.byte())
+	message.Seq = r.uvarint()
+	message.Src = r.string()
+	message.Target = r.string()
+	message.Heartbeat = r.uvarint()
+
+	updateCount := r.count()
+	message.Updates = make([]MemberUpdate, 0, updateCount)
+	for i := 0; i < updateCount; i++ {
+		message.Updates = append(message.Updates, MemberUpdate{
+			Node:        r.string(),
+			State:       MemberState(r.byte()),
+			Incarnation: r.uvarint(),
+			Heartbeat:   r.uvarint(),
+		})
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return message, nil
+}
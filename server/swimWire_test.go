@@ -0,0 +1,89 @@
+package server
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestSwimMessageRoundTrip(t *testing.T) {
+	message := &SwimMessage{
+		Type:      SWIM_PING_REQ,
+		Seq:       42,
+		Src:       "localhost:4001",
+		Target:    "localhost:4002",
+		Heartbeat: 7,
+		Updates: []MemberUpdate{
+			{Node: "localhost:4003", State: MEMBER_SUSPECT, Incarnation: 3, Heartbeat: 9},
+			{Node: "localhost:4004", State: MEMBER_ALIVE, Incarnation: 1, Heartbeat: 1 << 40},
+		},
+	}
+
+	packets := encodeSwimMessage(message)
+	if len(packets) != 1 {
+		t.Fatalf("Message was split into %d packets, expected 1", len(packets))
+	}
+
+	decoded, err := decodeSwimMessage(packets[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, message) {
+		t.Fatalf("Decoded %+v, expected %+v", decoded, message)
+	}
+}
+
+// Only the first packet of a split message is answered, the others only carry updates
+func TestSwimMessageSplit(t *testing.T) {
+	defer func(maxPacketSize int) { MAX_PACKET_SIZE = maxPacketSize }(MAX_PACKET_SIZE)
+	MAX_PACKET_SIZE = 128
+
+	message := &SwimMessage{Type: SWIM_PING, Seq: 5, Src: "localhost:4001", Heartbeat: 3}
+	for i := 0; i < 50; i++ {
+		message.Updates = append(message.Updates, MemberUpdate{Node: "localhost:" + strconv.Itoa(5000+i), Incarnation: uint64(i)})
+	}
+
+	packets := encodeSwimMessage(message)
+	if len(packets) < 2 {
+		t.Fatalf("Message was not split, %d packets", len(packets))
+	}
+
+	updates := []MemberUpdate{}
+	for i, packet := range packets {
+		if len(packet) > MAX_PACKET_SIZE {
+			t.Fatalf("Packet %d has %d bytes, more than %d", i, len(packet), MAX_PACKET_SIZE)
+		}
+
+		decoded, err := decodeSwimMessage(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Src != message.Src || decoded.Heartbeat != message.Heartbeat {
+			t.Fatalf("Packet %d is from %s with heartbeat %d", i, decoded.Src, decoded.Heartbeat)
+		}
+		if i == 0 && (decoded.Type != SWIM_PING || decoded.Seq != message.Seq) {
+			t.Fatalf("First packet has type %d and seq %d", decoded.Type, decoded.Seq)
+		}
+		if i != 0 && (decoded.Type != SWIM_UPDATE || decoded.Seq != 0) {
+			t.Fatalf("Packet %d has type %d and seq %d, expected an update only packet", i, decoded.Type, decoded.Seq)
+		}
+		updates = append(updates, decoded.Updates...)
+	}
+
+	if !reflect.DeepEqual(updates, message.Updates) {
+		t.Fatalf("Packets carried %d updates, expected %d", len(updates), len(message.Updates))
+	}
+}
+
+func TestSwimMessageTruncated(t *testing.T) {
+	packet := encodeSwimMessage(&SwimMessage{Type: SWIM_ACK, Src: "localhost:4001", Updates: []MemberUpdate{{Node: "localhost:4002"}}})[0]
+	for length := 1; length < len(packet); length++ {
+		if _, err := decodeSwimMessage(packet[:length]); err == nil {
+			t.Fatalf("Packet cut at %d of %d bytes was decoded", length, len(packet))
+		}
+	}
+
+	if _, err := decodeSwimMessage(append([]byte{SWIM_WIRE_VERSION + 1}, packet[1:]...)); err != errWireVersion {
+		t.Fatalf("Packet of another version was decoded, %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"testing"
+)
+
+// Helper that returns a node that only runs the membership rules of the failure detector
+func newSwimNode(nodeID string, members ...string) *Node {
+	node := &Node{ID: nodeID, Membership: newMembershipList(nodeID), ackWaiters: map[uint64]chan struct{}{}, stop: make(chan struct{})}
+	for _, member := range members {
+		node.applyUpdate(MemberUpdate{Node: member, State: MEMBER_ALIVE})
+	}
+
+	return node
+}
+
+// Helper that counts protocol periods of the node like the heartbeat manager does
+func runPeriods(node *Node, periods int) {
+	for i := 0; i < periods; i++ {
+		node.swimMutex.Lock()
+		node.Membership.members[node.ID].Heartbeat++
+		node.swimMutex.Unlock()
+
+		node.removeExitedNodes()
+	}
+}
+
+// A suspected member stays in the list for NODE_FAIL_PERIODS periods and is declared failed after
+func TestSuspectTimesOut(t *testing.T) {
+	node := newSwimNode("n1", "n2", "n3")
+	runPeriods(node, 3)
+
+	node.applyUpdate(MemberUpdate{Node: "n2", State: MEMBER_SUSPECT})
+	if node.MemberState("n2") != MEMBER_SUSPECT || !node.Membership.Contains("n2") {
+		t.Fatal("Suspected member was not kept in the list")
+	}
+
+	runPeriods(node, int(NODE_FAIL_PERIODS))
+	if node.MemberState("n2") != MEMBER_SUSPECT {
+		t.Fatalf("Member was %s after %d periods, expected it to still be suspected", node.MemberState("n2"), NODE_FAIL_PERIODS)
+	}
+
+	runPeriods(node, 1)
+	if node.MemberState("n2") != MEMBER_FAILED || node.Membership.Contains("n2") {
+		t.Fatalf("Member was %s after %d periods, expected it to be failed", node.MemberState("n2"), NODE_FAIL_PERIODS+1)
+	}
+	if node.MemberState("n3") != MEMBER_ALIVE {
+		t.Fatal("Member that was never suspected timed out")
+	}
+}
+
+// A member that answers while it is suspected is not declared failed
+func TestSuspectAnswers(t *testing.T) {
+	node := newSwimNode("n1", "n2")
+	node.applyUpdate(MemberUpdate{Node: "n2", State: MEMBER_SUSPECT})
+	node.applyUpdate(MemberUpdate{Node: "n2", State: MEMBER_ALIVE, Incarnation: 1})
+
+	runPeriods(node, int(NODE_FAIL_PERIODS)+1)
+	if node.MemberState("n2") != MEMBER_ALIVE {
+		t.Fatalf("Member that refuted the suspicion was %s", node.MemberState("n2"))
+	}
+}
+
+// A node that hears it is suspected or failed refutes it with a higher incarnation, and ignores
+// updates about incarnations it already refuted
+func TestRefuteSuspicion(t *testing.T) {
+	node := newSwimNode("n1", "n2")
+
+	node.applyUpdate(MemberUpdate{Node: "n1", State: MEMBER_SUSPECT, Incarnation: 0})
+	node.swimMutex.Lock()
+	self := node.selfUpdate()
+	node.swimMutex.Unlock()
+	if self.State != MEMBER_ALIVE || self.Incarnation != 1 {
+		t.Fatalf("Node is %s with incarnation %d, expected alive with incarnation 1", self.State, self.Incarnation)
+	}
+
+	refuted := false
+	for _, update := range node.piggybackUpdates() {
+		refuted = refuted || update == self
+	}
+	if !refuted {
+		t.Fatal("Refutation was not queued to be gossiped")
+	}
+
+	node.applyUpdate(MemberUpdate{Node: "n1", State: MEMBER_FAILED, Incarnation: 0})
+	if node.MemberState("n1") != MEMBER_ALIVE || node.Membership.members["n1"].Incarnation != 1 {
+		t.Fatal("Update about an incarnation that was already refuted was not ignored")
+	}
+	node.applyUpdate(MemberUpdate{Node: "n1", State: MEMBER_FAILED, Incarnation: 1})
+	if node.Membership.members["n1"].Incarnation != 2 {
+		t.Fatal("Failure of the current incarnation was not refuted")
+	}
+}
+
+// Updates about a member are ordered by incarnation first and state second. A removed member is
+// only added back with a higher incarnation
+func TestUpdateOverrides(t *testing.T) {
+	node := newSwimNode("n1", "n2")
+
+	node.applyUpdate(MemberUpdate{Node: "n2", State: MEMBER_SUSPECT, Incarnation: 1})
+	node.applyUpdate(MemberUpdate{Node: "n2", State: MEMBER_ALIVE, Incarnation: 1})
+	if node.MemberState("n2") != MEMBER_SUSPECT {
+		t.Fatal("Alive overrode Suspect of the same incarnation")
+	}
+	node.applyUpdate(MemberUpdate{Node: "n2", State: MEMBER_FAILED, Incarnation: 0})
+	if node.MemberState("n2") != MEMBER_SUSPECT {
+		t.Fatal("Update about an older incarnation was applied")
+	}
+
+	node.applyUpdate(MemberUpdate{Node: "n2", State: MEMBER_FAILED, Incarnation: 1})
+	node.applyUpdate(MemberUpdate{Node: "n2", State: MEMBER_ALIVE, Incarnation: 1})
+	if node.MemberState("n2") != MEMBER_FAILED || node.Membership.Contains("n2") {
+		t.Fatal("Failed member came back without a higher incarnation")
+	}
+
+	node.applyUpdate(MemberUpdate{Node: "n2", State: MEMBER_ALIVE, Incarnation: 2})
+	if node.MemberState("n2") != MEMBER_ALIVE || !node.Membership.Contains("n2") {
+		t.Fatal("Failed member that rejoined with a higher incarnation was not added back")
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"bufio"
 	"cs-425-mp4/server"
+	"flag"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"os"
 	"strings"
@@ -10,18 +12,30 @@ import (
 )
 
 func main() {
-	hostname, _ := os.Hostname()
-
-	// Start a goroutine to handle sending out heartbeats
-	go server.HeartbeatManager()
-	time.Sleep(1 * time.Second)
-	
-	go server.FileSystemManager()
-	go server.MapleWorkerManager()
-	go server.JuiceWorkerManager()
-	go server.MapleMasterManager()
-	go server.JuiceMasterManager()
-	
+	configPath := flag.String("config", os.Getenv("SDFS_CONFIG"), "path to the cluster config file")
+	nodeID := flag.String("node", os.Getenv("SDFS_NODE_ID"), "host:port identity of this node")
+	dataDir := flag.String("dir", os.Getenv("SDFS_DATA_DIR"), "directory that holds the files of this node")
+	bindAddr := flag.String("bind", os.Getenv("SDFS_BIND_ADDR"), "address the listeners of this node bind to")
+	flag.Parse()
+
+	_, err := server.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Could not load cluster config! %s", err)
+	}
+
+	node, err := server.NewNode(*nodeID, *dataDir, *bindAddr)
+	if err != nil {
+		log.Fatalf("Could not set up the data directory! %s", err)
+	}
+
+	hostname := node.ID
+
+	// Start the goroutines of every manager, the same ones the test cluster runs
+	err = node.Start()
+	if err != nil {
+		log.Fatalf("Could not start the node! %s", err)
+	}
+
 	reader := bufio.NewReader(os.Stdin)
 	for {
 		input, _ := reader.ReadString('\n')
@@ -31,16 +45,24 @@ func main() {
 		case "id":
 			log.Infof("Current node ID: %s", hostname)
 		case "list":
-			log.Infof("Current list:\n%s", server.Membership.List)
+			memberList := []string{}
+			for _, member := range node.Membership.List() {
+				memberList = append(memberList, member+" ("+node.MemberState(member).String()+")")
+			}
+			log.Infof("Current list:\n%s", memberList)
 		case "store":
 			fileList := []string{}
-			for fileName, _ := range server.LocalFiles.Files {
-				fileList = append(fileList, fileName)
+			for fileName, _ := range node.LocalFiles.Files() {
+				fileList = append(fileList, fmt.Sprintf("%s %v", fileName, node.LocalFiles.Versions(fileName)))
 			}
 			log.Infof("Files stored in the server:\n%s", fileList)
+		case "replication":
+			status := node.Replication.Status()
+			log.Infof("Re-replication: %d pending, %d copying, %d restored, %d failed, oldest waiting %s",
+				status.Pending, status.Copying, status.Restored, status.Failed, status.Oldest.Round(time.Millisecond))
 		case "leave":
 			log.Infof("Node %s is leaving the network!", hostname)
-			server.Membership.Data[hostname] = -1 * (time.Now().UnixNano() / int64(time.Millisecond))
+			node.Leave()
 			time.Sleep(2 * time.Second)
 			os.Exit(0)
 		default:
@@ -0,0 +1,271 @@
+// Package testcluster runs a whole SDFS/MapleJuice cluster inside one process. Tests use it to
+// start nodes on localhost, kill, pause and rejoin them, and drive put/get/maple/juice end to end.
+// The cluster config is process wide, so only one cluster can run in a process at a time.
+package testcluster
+
+import (
+	"cs-425-mp4/client"
+	"cs-425-mp4/server"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var ErrTimeout = errors.New("timed out waiting for the cluster")
+
+// How often the Wait helpers check the state of the nodes
+var POLL_INTERVAL time.Duration = 100 * time.Millisecond
+
+type Cluster struct {
+	Dir   string
+	Nodes []*server.Node
+}
+
+// Starts size nodes on localhost. Node i gets the ID localhost:basePort+i+1 and the data directory
+// dir/node<i>, and the first node is the introducer. The RPC ports are basePort+1000 onwards, and
+// the first nodes up to server.DEFAULT_RAFT_PEER_COUNT vote on the replicated log.
+func Start(size int, basePort int, dir string) (*Cluster, error) {
+	config := &server.ClusterConfig{
+		UDPPort:           strconv.Itoa(basePort),
+		ClientRPCPort:     strconv.Itoa(basePort + 1000),
+		ServerRPCPort:     strconv.Itoa(basePort + 2000),
+		FileRPCPort:       strconv.Itoa(basePort + 3000),
+		MapleJuiceRPCPort: strconv.Itoa(basePort + 4000),
+		RaftRPCPort:       strconv.Itoa(basePort + 5000),
+	}
+
+	for i := 0; i < size; i++ {
+		config.Nodes = append(config.Nodes, server.NodeConfig{
+			Host:     "localhost",
+			Port:     strconv.Itoa(basePort + i + 1),
+			BindAddr: "localhost",
+			DataDir:  filepath.Join(dir, "node"+strconv.Itoa(i)),
+		})
+	}
+	config.Introducers = []string{config.Nodes[0].ID()}
+	server.ApplyConfig(config)
+
+	cluster := &Cluster{Dir: dir, Nodes: make([]*server.Node, size)}
+	for i := 0; i < size; i++ {
+		err := cluster.startNode(i)
+		if err != nil {
+			cluster.Stop()
+			return nil, err
+		}
+	}
+
+	return cluster, nil
+}
+
+// Creates and starts node i using its entry in the cluster config
+func (cluster *Cluster) startNode(i int) error {
+	nodeConfig := server.Config.Nodes[i]
+	node, err := server.NewNode(nodeConfig.ID(), nodeConfig.DataDir, nodeConfig.BindAddr)
+	if err != nil {
+		return err
+	}
+
+	err = node.Start()
+	if err != nil {
+		node.Kill()
+		return err
+	}
+
+	cluster.Nodes[i] = node
+	return nil
+}
+
+// Returns the ID of node i
+func (cluster *Cluster) ID(i int) string {
+	return server.Config.Nodes[i].ID()
+}
+
+// Crashes node i. Its data directory is kept so it can rejoin later
+func (cluster *Cluster) Kill(i int) {
+	cluster.Nodes[i].Kill()
+}
+
+// Makes node i go silent without closing its sockets
+func (cluster *Cluster) Pause(i int) {
+	cluster.Nodes[i].Pause()
+}
+
+func (cluster *Cluster) Resume(i int) {
+	cluster.Nodes[i].Resume()
+}
+
+// Restarts a killed node with the same ID and data directory
+func (cluster *Cluster) Rejoin(i int) error {
+	cluster.Nodes[i].Kill()
+	return cluster.startNode(i)
+}
+
+// Kills every node in the cluster
+func (cluster *Cluster) Stop() {
+	for _, node := range cluster.Nodes {
+		if node != nil {
+			node.Kill()
+		}
+	}
+}
+
+// Waits until each of the given nodes has exactly the given nodes in its membership list
+func (cluster *Cluster) WaitForMembers(nodes []int, timeout time.Duration) error {
+	expected := map[string]bool{}
+	for _, i := range nodes {
+		expected[cluster.ID(i)] = true
+	}
+
+	return waitFor(timeout, func() bool {
+		for _, i := range nodes {
+			memberList := cluster.Nodes[i].Membership.List()
+			if len(memberList) != len(expected) {
+				return false
+			}
+
+			for _, member := range memberList {
+				if !expected[member] {
+					return false
+				}
+			}
+		}
+
+		return true
+	})
+}
+
+// Waits until every node has its full membership list
+func (cluster *Cluster) WaitForAllMembers(timeout time.Duration) error {
+	return cluster.WaitForMembers(cluster.All(), timeout)
+}
+
+// Waits until the given nodes have no maple or juice requests left in their queue
+func (cluster *Cluster) WaitForJobs(nodes []int, timeout time.Duration) error {
+	return waitFor(timeout, func() bool {
+		for _, i := range nodes {
+			if len(cluster.Nodes[i].Queues().MJQueue) != 0 {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+// Returns the indexes of all nodes, useful with the Wait helpers
+func (cluster *Cluster) All() []int {
+	nodes := []int{}
+	for i := range cluster.Nodes {
+		nodes = append(nodes, i)
+	}
+
+	return nodes
+}
+
+// Returns the indexes of all nodes except the given ones
+func (cluster *Cluster) Except(excluded ...int) []int {
+	nodes := []int{}
+	for i := range cluster.Nodes {
+		skip := false
+		for _, j := range excluded {
+			skip = skip || i == j
+		}
+
+		if !skip {
+			nodes = append(nodes, i)
+		}
+	}
+
+	return nodes
+}
+
+// Uploads a local file to the sdfs through the first node that answers
+func (cluster *Cluster) Put(localPath string, sdfsName string) error {
+	return client.Put(localPath, sdfsName)
+}
+
+// Appends a local file to a file in the sdfs
+func (cluster *Cluster) Append(localPath string, sdfsName string) error {
+	return client.Append(localPath, sdfsName)
+}
+
+// Downloads a file from the sdfs to localPath
+func (cluster *Cluster) Get(sdfsName string, localPath string) error {
+	return client.Get(sdfsName, localPath)
+}
+
+// Downloads the newest numVersions versions of a file from the sdfs to localPath
+func (cluster *Cluster) GetVersions(sdfsName string, numVersions int, localPath string) error {
+	return client.GetVersions(sdfsName, numVersions, localPath)
+}
+
+func (cluster *Cluster) Delete(sdfsName string) error {
+	return client.Delete(sdfsName)
+}
+
+// Returns the nodes that store the file
+func (cluster *Cluster) List(sdfsName string) ([]string, error) {
+	return client.List(sdfsName)
+}
+
+// Returns the entries of a directory in the sdfs
+func (cluster *Cluster) ListDir(dirName string, recursive bool) ([]string, error) {
+	return client.ListDir(dirName, recursive)
+}
+
+func (cluster *Cluster) MakeDir(dirName string) error {
+	return client.MakeDir(dirName)
+}
+
+func (cluster *Cluster) RemoveDir(dirName string) error {
+	return client.RemoveDir(dirName)
+}
+
+// Moves a file or a directory in the sdfs. A file replaces the file at the new path if replace is set
+func (cluster *Cluster) Move(from string, to string, replace bool) error {
+	return client.Move(from, to, replace)
+}
+
+// Submits a maple job. The executable and the input directory must already be in the sdfs
+func (cluster *Cluster) Maple(exeName string, numMaples int, filePrefix string, fileDirectory string) error {
+	return client.SubmitMapleJuice(&server.MapleJuiceRequest{
+		Command:       "Maple",
+		ExeName:       exeName,
+		ProcessCount:  numMaples,
+		FilePrefix:    filePrefix,
+		FileDirectory: fileDirectory,
+	})
+}
+
+// Submits a juice job. The output is appended to destFileName in the sdfs
+func (cluster *Cluster) Juice(exeName string, numJuices int, filePrefix string, destFileName string, deleteInput bool) error {
+	return client.SubmitMapleJuice(&server.MapleJuiceRequest{
+		Command:       "Juice",
+		ExeName:       exeName,
+		ProcessCount:  numJuices,
+		FilePrefix:    filePrefix,
+		FileDirectory: destFileName,
+		DeleteInput:   deleteInput,
+	})
+}
+
+// Returns the path of a file in the data directory of node i
+func (cluster *Cluster) DataPath(i int, elem ...string) string {
+	return filepath.Join(append([]string{server.Config.Nodes[i].DataDir}, elem...)...)
+}
+
+// Polls check until it returns true or the timeout passes
+func waitFor(timeout time.Duration, check func() bool) error {
+	deadline := time.Now().Add(timeout)
+	for !check() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w after %s", ErrTimeout, timeout)
+		}
+
+		time.Sleep(POLL_INTERVAL)
+	}
+
+	return nil
+}
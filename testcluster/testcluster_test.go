@@ -0,0 +1,341 @@
+package testcluster
+
+import (
+	"cs-425-mp4/server"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Word count executables for the MapleJuice test. They only use the standard library, so go run
+// can build them outside of a module
+const wordCountMaple = `package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+func main() {
+	input, _ := os.Open(os.Args[1])
+	output, _ := os.Create(os.Args[2])
+	scanner := bufio.NewScanner(input)
+	scanner.Split(bufio.ScanWords)
+	for scanner.Scan() {
+		output.WriteString(strings.ToLower(scanner.Text()) + " 1\n")
+	}
+	output.Close()
+}
+`
+
+const wordCountJuice = `package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	input, _ := os.Open(os.Args[1])
+	scanner := bufio.NewScanner(input)
+	key, count := "", 0
+	for scanner.Scan() {
+		key = strings.Fields(scanner.Text())[0]
+		count++
+	}
+	output, _ := os.OpenFile(os.Args[2], os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	output.WriteString(key + " " + strconv.Itoa(count) + "\n")
+	output.Close()
+}
+`
+
+// Helper that writes content to a local file in the test directory and returns its path
+func writeLocalFile(t *testing.T, dir string, fileName string, content string) string {
+	localPath := filepath.Join(dir, fileName)
+	err := ioutil.WriteFile(localPath, []byte(content), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return localPath
+}
+
+// Helper that gets a file from the sdfs and fails the test if it does not have the given content
+func checkFileContent(t *testing.T, cluster *Cluster, sdfsName string, content string) {
+	localPath := filepath.Join(cluster.Dir, "get")
+	err := cluster.Get(sdfsName, localPath)
+	if err != nil {
+		t.Fatalf("Could not get file %s! %s", sdfsName, err)
+	}
+
+	fileContent, _ := ioutil.ReadFile(localPath)
+	if string(fileContent) != content {
+		t.Fatalf("File %s has content %q, expected %q", sdfsName, fileContent, content)
+	}
+}
+
+// Returns the index of the node with the given ID
+func (cluster *Cluster) index(t *testing.T, nodeID string) int {
+	for i := range cluster.Nodes {
+		if cluster.ID(i) == nodeID {
+			return i
+		}
+	}
+
+	t.Fatalf("Node %s is not in the cluster!", nodeID)
+	return -1
+}
+
+// Returns the index of the first replica that is not the introducer, so the cluster can still be
+// joined once it is killed
+func (cluster *Cluster) replicaToKill(t *testing.T, replicas []string) int {
+	for _, replica := range replicas {
+		if i := cluster.index(t, replica); i != 0 {
+			return i
+		}
+	}
+
+	t.Fatalf("File is only stored on the introducer!")
+	return -1
+}
+
+// The cluster config is process wide, and managers of killed nodes may still be finishing a call,
+// so every test runs on the same cluster. Each test leaves every node in the membership lists
+func TestCluster(t *testing.T) {
+	cluster, err := Start(6, 11000, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cluster.Stop()
+
+	err = cluster.WaitForAllMembers(30 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("PutGetKillRejoin", func(t *testing.T) { testPutGetKillRejoin(t, cluster) })
+	t.Run("ReplicationAfterFailure", func(t *testing.T) { testReplicationAfterFailure(t, cluster) })
+	t.Run("PauseResume", func(t *testing.T) { testPauseResume(t, cluster) })
+	t.Run("WordCount", func(t *testing.T) { testWordCount(t, cluster) })
+}
+
+// A file stays readable while one of its replicas is down, and a replica that rejoins sees the
+// puts made while it was down
+func testPutGetKillRejoin(t *testing.T, cluster *Cluster) {
+	err := cluster.Put(writeLocalFile(t, cluster.Dir, "first", "first version\n"), "test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFileContent(t, cluster, "test.txt", "first version\n")
+
+	replicas, err := cluster.List("test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	killed := cluster.replicaToKill(t, replicas)
+	cluster.Kill(killed)
+	checkFileContent(t, cluster, "test.txt", "first version\n")
+
+	err = cluster.WaitForMembers(cluster.Except(killed), 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cluster.Put(writeLocalFile(t, cluster.Dir, "second", "second version\n"), "test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cluster.Rejoin(killed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cluster.WaitForAllMembers(30 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rejoined node catches up with the replicated log after it is back in the membership lists
+	err = waitFor(30*time.Second, func() bool {
+		metadata, _ := cluster.Nodes[killed].FileMetadata("test.txt")
+		return metadata.Version == 2
+	})
+	if err != nil {
+		t.Fatalf("The rejoined node does not know of version 2 of the file! %s", err)
+	}
+	checkFileContent(t, cluster, "test.txt", "second version\n")
+}
+
+// The replicas of a file on a node that fails are copied to other nodes, so List shows
+// NUM_REPLICAS live replicas again before REPLICATION_DEADLINE
+func testReplicationAfterFailure(t *testing.T, cluster *Cluster) {
+	err := cluster.Put(writeLocalFile(t, cluster.Dir, "replicated", "replicated content\n"), "replicated.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replicas, err := cluster.List("replicated.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replicas) != server.NUM_REPLICAS {
+		t.Fatalf("File is stored on %v, expected %d replicas", replicas, server.NUM_REPLICAS)
+	}
+
+	killed := cluster.replicaToKill(t, replicas)
+	cluster.Kill(killed)
+	killedAt := time.Now()
+
+	err = waitFor(server.REPLICATION_DEADLINE, func() bool {
+		replicas, err = cluster.List("replicated.txt")
+		if err != nil || len(replicas) != server.NUM_REPLICAS {
+			return false
+		}
+
+		for _, replica := range replicas {
+			if replica == cluster.ID(killed) {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("File is stored on %v %s after the failure of %s! %s", replicas, time.Since(killedAt), cluster.ID(killed), err)
+	}
+
+	// Every replica must be alive and store the file
+	for _, replica := range replicas {
+		if !cluster.Nodes[0].Membership.Contains(replica) && cluster.index(t, replica) != 0 {
+			t.Fatalf("Replica %s is not alive!", replica)
+		}
+		if len(cluster.Nodes[cluster.index(t, replica)].LocalFiles.Versions("replicated.txt")) == 0 {
+			t.Fatalf("Replica %s does not store the file!", replica)
+		}
+	}
+	checkFileContent(t, cluster, "replicated.txt", "replicated content\n")
+
+	err = cluster.Rejoin(killed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cluster.WaitForAllMembers(30 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A paused node stops answering pings, so the others declare it failed within a few protocol
+// periods. Once it resumes it refutes the failure and is added back to every membership list
+func testPauseResume(t *testing.T, cluster *Cluster) {
+	paused := len(cluster.Nodes) - 1
+	cluster.Pause(paused)
+	pausedAt := time.Now()
+
+	// Every member is probed once every len(Nodes) periods, then suspected for NODE_FAIL_PERIODS
+	detection := server.PROTOCOL_PERIOD * time.Duration(2*len(cluster.Nodes)+int(server.NODE_FAIL_PERIODS))
+	err := cluster.WaitForMembers(cluster.Except(paused), detection)
+	if err != nil {
+		cluster.Resume(paused)
+		t.Fatalf("Paused node %s was not removed after %s! %s", cluster.ID(paused), time.Since(pausedAt), err)
+	}
+
+	cluster.Resume(paused)
+	err = cluster.WaitForAllMembers(30 * time.Second)
+	if err != nil {
+		t.Fatalf("Resumed node %s was not added back! %s", cluster.ID(paused), err)
+	}
+}
+
+// Counts the words of files in a directory with a maple and a juice job, and checks the counts in
+// the output file
+func testWordCount(t *testing.T, cluster *Cluster) {
+	// The executables are built by go run in the working directory, which must not be in a module
+	workDir, _ := os.Getwd()
+	err := os.Chdir(cluster.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(workDir)
+
+	err = cluster.Put(writeLocalFile(t, cluster.Dir, "maple.go", wordCountMaple), "wordCountMaple.go")
+	if err == nil {
+		err = cluster.Put(writeLocalFile(t, cluster.Dir, "juice.go", wordCountJuice), "wordCountJuice.go")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The input is written into a directory, appended to and moved in, so the job reads the
+	// newest version of every file under the directory
+	err = cluster.MakeDir("books/old")
+	if err == nil {
+		err = cluster.Put(writeLocalFile(t, cluster.Dir, "a.txt", "the quick brown fox\n"), "books/a.txt")
+	}
+	if err == nil {
+		err = cluster.Append(writeLocalFile(t, cluster.Dir, "b1.txt", "The lazy dog\n"), "books/b.txt")
+	}
+	if err == nil {
+		err = cluster.Append(writeLocalFile(t, cluster.Dir, "b2.txt", "the end\n"), "books/b.txt")
+	}
+	if err == nil {
+		err = cluster.Put(writeLocalFile(t, cluster.Dir, "c.txt", "quick quick dog\n"), "c.txt")
+	}
+	if err == nil {
+		err = cluster.Move("c.txt", "books/old/c.txt", false)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versionsPath := filepath.Join(cluster.Dir, "versions")
+	err = cluster.GetVersions("books/b.txt", 2, versionsPath)
+	if err != nil {
+		t.Fatalf("Could not get the versions of an appended file! %s", err)
+	}
+	versions, _ := ioutil.ReadFile(versionsPath)
+	expectedVersions := "===== version 2 =====\nThe lazy dog\nthe end\n===== version 1 =====\nThe lazy dog\n"
+	if string(versions) != expectedVersions {
+		t.Fatalf("Got versions %q, expected %q", versions, expectedVersions)
+	}
+
+	entries, err := cluster.ListDir("books", true)
+	if err != nil || len(entries) != 4 {
+		t.Fatalf("Listed %v under the input directory, expected 3 files and a directory %v", entries, err)
+	}
+
+	err = cluster.Maple("wordCountMaple.go", 3, "words", "books")
+	if err == nil {
+		err = cluster.WaitForJobs(cluster.All(), 120*time.Second)
+	}
+	if err != nil {
+		t.Fatalf("Maple job did not finish! %s", err)
+	}
+
+	err = cluster.Juice("wordCountJuice.go", 3, "words", "counts.txt", true)
+	if err == nil {
+		err = cluster.WaitForJobs(cluster.All(), 120*time.Second)
+	}
+	if err != nil {
+		t.Fatalf("Juice job did not finish! %s", err)
+	}
+
+	localPath := filepath.Join(cluster.Dir, "counts")
+	err = cluster.Get("counts.txt", localPath)
+	if err != nil {
+		t.Fatalf("Could not get the output of the job! %s", err)
+	}
+	content, _ := ioutil.ReadFile(localPath)
+	counts := strings.Split(strings.TrimSpace(string(content)), "\n")
+	sort.Strings(counts)
+
+	expected := []string{"brown 1", "dog 2", "end 1", "fox 1", "lazy 1", "quick 3", "the 3"}
+	if strings.Join(counts, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Job counted %v, expected %v", counts, expected)
+	}
+}